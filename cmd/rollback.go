@@ -0,0 +1,159 @@
+package cmd
+
+import (
+	"context"
+	"dvdlevanon/kubernetes-database-scaler/pkg/controller"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+var rollbackVersion string
+var rollbackTenants []string
+var rollbackOriginal string
+
+var rollbackCmd = &cobra.Command{
+	Use:   "rollback",
+	Short: "Render the duplicated deployments again from a stored version of the original deployment",
+	Long: `Render the duplicated deployments again from a stored version of the original deployment
+
+The original deployments are configured like the watch, with the config file or
+the KUBERNETES_DATABASE_SCALER_* environment variables (e.g. kubectl exec into the scaler).
+The duplicates stay on the version until the original deployment changes again.
+
+Without --version the stored versions of every original deployment are listed.
+`,
+	Run: func(cmd *cobra.Command, args []string) {
+		if err := rollback(); err != nil {
+			logger.Errorf("%s", err)
+			os.Exit(1)
+		}
+	},
+}
+
+func rollback() error {
+	config, err := ctrl.GetConfig()
+	if err != nil {
+		return err
+	}
+
+	kubeClient, err := client.New(config, client.Options{})
+	if err != nil {
+		return err
+	}
+
+	templates, err := setupTemplateStore(kubeClient, kubeClient)
+	if err != nil {
+		return err
+	}
+
+	if templates == nil {
+		return fmt.Errorf("template history is disabled")
+	}
+
+	namespaces, err := setupNamespaceManager(kubeClient)
+	if err != nil {
+		return err
+	}
+
+	originalDeployments, err := getOriginalDeployments()
+	if err != nil {
+		return err
+	}
+
+	// The versions are generations of each original deployment, they rarely match between them
+	//
+	if rollbackOriginal != "" {
+		selected := make([]originalDeployment, 0)
+		for _, original := range originalDeployments {
+			if original.Name == rollbackOriginal {
+				selected = append(selected, original)
+			}
+		}
+
+		if len(selected) == 0 {
+			return fmt.Errorf("original deployment %s is not configured", rollbackOriginal)
+		}
+
+		originalDeployments = selected
+	}
+
+	ctx := context.Background()
+	if rollbackVersion == "" {
+		for _, original := range originalDeployments {
+			versions, err := templates.Versions(ctx, original.Namespace, original.Name)
+			if err != nil {
+				return err
+			}
+
+			fmt.Printf("%s/%s: %s\n", original.Namespace, original.Name, strings.Join(versions, " "))
+		}
+
+		return nil
+	}
+
+	// The rolled back duplicates are rendered with the overrides of their tenants, like the watch does
+	//
+	overrides, err := setupRollbackOverrides(ctx)
+	if err != nil {
+		return err
+	}
+
+	targetDeploymentName := viper.GetString("target-deployment-name")
+	driftIgnoreFields := splitEnvironmentVariable(viper.GetStringSlice("drift-ignore-field"))
+	for _, original := range originalDeployments {
+		deploymentController, err := controller.New(kubeClient, original.Namespace, original.Name,
+			targetDeploymentName, original.Environment, original.ExcludeLabel, original.IdentityLabel, nil)
+		if err != nil {
+			return err
+		}
+
+		deploymentController.SetNamespaceManager(namespaces)
+		deploymentController.SetTemplateStore(templates)
+		if overrides != nil {
+			deploymentController.SetOverrides(overrides)
+		}
+
+		if err := deploymentController.SetDriftPolicy(controller.DRIFT_MODE_OFF, driftIgnoreFields); err != nil {
+			return err
+		}
+
+		if err := deploymentController.Rollback(ctx, rollbackVersion, rollbackTenants); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// setupRollbackOverrides connects to the database sources only when an overrides table is set
+func setupRollbackOverrides(ctx context.Context) (*controller.Overrides, error) {
+	if viper.GetString("overrides-table") == "" {
+		return nil, nil
+	}
+
+	databaseSources, err := getDatabaseSources()
+	if err != nil {
+		return nil, err
+	}
+
+	watchers, err := setupWatchers(databaseSources)
+	if err != nil {
+		return nil, err
+	}
+
+	defer closeWatchers(watchers)
+	return setupOverrides(ctx, watchers)
+}
+
+func init() {
+	rollbackCmd.Flags().StringVar(&rollbackVersion, "version", "", "The version of the original deployment to roll back to (its observed generation)")
+	rollbackCmd.Flags().StringVar(&rollbackOriginal, "original", "", "Roll back only the duplicates of this original deployment")
+	rollbackCmd.Flags().StringArrayVar(&rollbackTenants, "tenant", make([]string, 0), "Roll back only the duplicates of these tenants")
+	rootCmd.AddCommand(rollbackCmd)
+}
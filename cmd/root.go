@@ -1,24 +1,29 @@
 package cmd
 
 import (
+	"context"
 	"dvdlevanon/kubernetes-database-scaler/pkg/cleaner"
 	"dvdlevanon/kubernetes-database-scaler/pkg/controller"
+	"dvdlevanon/kubernetes-database-scaler/pkg/logs"
+	"dvdlevanon/kubernetes-database-scaler/pkg/source"
 	"dvdlevanon/kubernetes-database-scaler/pkg/tablewatch"
 	"fmt"
 	"os"
 	"strings"
+	"sync"
 	"time"
 
 	_ "github.com/lib/pq"
-	"github.com/op/go-logging"
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
 	vpa_types "k8s.io/autoscaler/vertical-pod-autoscaler/pkg/apis/autoscaling.k8s.io/v1"
 	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/healthz"
 	"sigs.k8s.io/controller-runtime/pkg/manager"
 )
 
-var logger = logging.MustGetLogger("main")
+var logger = logs.MustGetLogger("main")
 var cfgFile string
 
 var rootCmd = &cobra.Command{
@@ -42,27 +47,40 @@ A list of environment variables can be passed to the new deployment, their value
 	},
 }
 
-func setupWatcher(rows chan<- tablewatch.Row) error {
-	driver := viper.GetString("database-driver")
-	dbname := viper.GetString("database-name")
-	port := viper.GetString("database-port")
-	host := viper.GetString("database-host")
-	username := viper.GetString("database-username")
-	password := viper.GetString("database-password")
-	usernameFile := viper.GetString("database-username-file")
-	passwordFile := viper.GetString("database-password-file")
-	tableName := viper.GetString("table-name")
-	sqlCondition := viper.GetString("sql-condition")
-	rawSql := viper.GetString("raw-sql")
-	watcher, err := tablewatch.New(driver, host, port, dbname,
-		username, password, usernameFile, passwordFile, tableName, sqlCondition, rawSql)
-	if err != nil {
-		return err
+func setupStatusWriter(sources []databaseSource, watchers []*tablewatch.Tablewatch,
+	deploymentController *controller.DeploymentReconciler) (*statusRouter, error) {
+	statusColumn := viper.GetString("status-column")
+	readyReplicasColumn := viper.GetString("status-ready-replicas-column")
+	updatedAtColumn := viper.GetString("status-updated-at-column")
+
+	if statusColumn == "" && readyReplicasColumn == "" && updatedAtColumn == "" {
+		return nil, nil
 	}
 
-	checkInterval := viper.GetInt("check-interval")
-	go watcher.Watch(checkInterval, rows)
-	return nil
+	statusTableName := viper.GetString("status-table")
+	keyColumn := viper.GetString("target-deployment-name")
+	router := newStatusRouter(keyColumn)
+
+	for i, watcher := range watchers {
+		// Without a dedicated status table, the status is written to the watched row itself
+		//
+		insert := statusTableName != ""
+		tableName := statusTableName
+		if !insert {
+			tableName = sources[i].TableName
+		}
+
+		statusWriter, err := watcher.NewStatusWriter(tableName, keyColumn,
+			statusColumn, readyReplicasColumn, updatedAtColumn, insert)
+		if err != nil {
+			return nil, fmt.Errorf("database source %s: %w", sources[i].Name, err)
+		}
+
+		router.addWriter(watcher.Name(), statusWriter)
+	}
+
+	deploymentController.SetStatusReporter(router)
+	return router, nil
 }
 
 func splitEnvironmentVariable(arr []string) []string {
@@ -76,7 +94,8 @@ func splitEnvironmentVariable(arr []string) []string {
 	return arr
 }
 
-func setupVpaController(manager manager.Manager) (*controller.VpaReconciler, error) {
+func setupVpaController(manager manager.Manager, original originalDeployment,
+	namespaces *controller.NamespaceManager, throttle *controller.Throttle) (*controller.VpaReconciler, error) {
 	originalVpaName := viper.GetString("original-vpa-name")
 
 	if originalVpaName == "" {
@@ -87,16 +106,17 @@ func setupVpaController(manager manager.Manager) (*controller.VpaReconciler, err
 		return nil, err
 	}
 
-	originalVpaNamespace := viper.GetString("original-deployment-namespace")
-	originalDeploymentName := viper.GetString("original-deployment-name")
 	targetDeploymentName := viper.GetString("target-deployment-name")
 
 	controller, err := controller.NewVpaController(manager.GetClient(),
-		originalVpaNamespace, originalVpaName, targetDeploymentName, originalDeploymentName)
+		original.Namespace, originalVpaName, targetDeploymentName, original.Name)
 	if err != nil {
 		return nil, err
 	}
 
+	controller.SetNamespaceManager(namespaces)
+	controller.SetThrottle(throttle)
+
 	if err := controller.SetupWithManager(manager); err != nil {
 		return nil, err
 	}
@@ -104,18 +124,26 @@ func setupVpaController(manager manager.Manager) (*controller.VpaReconciler, err
 	return controller, nil
 }
 
-func setupDeploymentController(manager manager.Manager, removeDeploys <-chan string) (*controller.DeploymentReconciler, error) {
-	originalDeploymentNamespace := viper.GetString("original-deployment-namespace")
-	originalDeploymentName := viper.GetString("original-deployment-name")
+func setupHpaController(manager manager.Manager, original originalDeployment,
+	namespaces *controller.NamespaceManager, throttle *controller.Throttle) (*controller.HpaReconciler, error) {
+	originalHpaName := viper.GetString("original-hpa-name")
+
+	if originalHpaName == "" {
+		return nil, nil
+	}
+
 	targetDeploymentName := viper.GetString("target-deployment-name")
-	environments := splitEnvironmentVariable(viper.GetStringSlice("environment"))
-	excludeLabels := splitEnvironmentVariable(viper.GetStringSlice("exclude-label"))
-	controller, err := controller.New(manager.GetClient(),
-		originalDeploymentNamespace, originalDeploymentName, targetDeploymentName, environments, excludeLabels, removeDeploys)
+	minReplicasColumn := viper.GetString("hpa-min-replicas-column")
+	maxReplicasColumn := viper.GetString("hpa-max-replicas-column")
+
+	controller, err := controller.NewHpaController(manager.GetClient(), original.Namespace, originalHpaName,
+		targetDeploymentName, original.Name, minReplicasColumn, maxReplicasColumn)
 	if err != nil {
 		return nil, err
 	}
 
+	controller.SetNamespaceManager(namespaces)
+	controller.SetThrottle(throttle)
 	if err := controller.SetupWithManager(manager); err != nil {
 		return nil, err
 	}
@@ -123,18 +151,283 @@ func setupDeploymentController(manager manager.Manager, removeDeploys <-chan str
 	return controller, nil
 }
 
+func setupNamespaceManager(client client.Client) (*controller.NamespaceManager, error) {
+	originalDeploymentNamespace := viper.GetString("original-deployment-namespace")
+	namespaceColumn := viper.GetString("target-namespace-column")
+	namespaceTemplate := viper.GetString("target-namespace-template")
+	create := viper.GetBool("create-target-namespace")
+	remove := viper.GetBool("remove-target-namespace")
+	labels := splitEnvironmentVariable(viper.GetStringSlice("target-namespace-label"))
+	resourceQuotaTemplate := viper.GetString("resource-quota-template")
+	limitRangeTemplate := viper.GetString("limit-range-template")
+
+	return controller.NewNamespaceManager(client, originalDeploymentNamespace,
+		namespaceColumn, namespaceTemplate, create, remove, labels, resourceQuotaTemplate, limitRangeTemplate)
+}
+
+func setupTemplateStore(client client.Client, reader client.Reader) (*controller.TemplateStore, error) {
+	templateHistory := viper.GetInt("template-history")
+	if templateHistory == 0 {
+		return nil, nil
+	}
+
+	return controller.NewTemplateStore(client, reader, templateHistory)
+}
+
+// setupOverrides reads the overrides table from the first database, the overrides are read once
+//
+//	before the controllers start so the first duplicates are rendered with them.
+func setupOverrides(ctx context.Context, watchers []*tablewatch.Tablewatch) (*controller.Overrides, error) {
+	overridesTable := viper.GetString("overrides-table")
+	if overridesTable == "" {
+		return nil, nil
+	}
+
+	if len(watchers) == 0 {
+		return nil, fmt.Errorf("overrides table %s requires a database source", overridesTable)
+	}
+
+	reader, err := watchers[0].NewOverridesReader(overridesTable, viper.GetString("overrides-tenant-column"),
+		viper.GetString("overrides-patch-column"), viper.GetString("overrides-type-column"),
+		viper.GetString("overrides-order-column"))
+	if err != nil {
+		return nil, err
+	}
+
+	overrides, err := controller.NewOverrides(reader)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := overrides.Refresh(ctx); err != nil {
+		return nil, err
+	}
+
+	return overrides, nil
+}
+
+func setupThrottle() (*controller.Throttle, error) {
+	creationsPerSecond := viper.GetFloat64("max-creations-per-second")
+	removalsPerSecond := viper.GetFloat64("max-removals-per-second")
+	maxInFlight := viper.GetInt("max-in-flight")
+	maxManaged := viper.GetInt("max-managed-deployments")
+
+	return controller.NewThrottle(creationsPerSecond, removalsPerSecond, maxInFlight, maxManaged)
+}
+
+type originalDeployment struct {
+	Namespace     string   `mapstructure:"namespace"`
+	Name          string   `mapstructure:"name"`
+	Environment   []string `mapstructure:"environment"`
+	ExcludeLabel  []string `mapstructure:"exclude-label"`
+	IdentityLabel []string `mapstructure:"identity-label"`
+}
+
+// getOriginalDeployments returns the deployments duplicated for every row, the one passed with
+//
+//	--original-deployment-name comes first, followed by the original-deployments list of the config file.
+func getOriginalDeployments() ([]originalDeployment, error) {
+	originalDeploymentNamespace := viper.GetString("original-deployment-namespace")
+	identityLabels := splitEnvironmentVariable(viper.GetStringSlice("identity-label"))
+	result := make([]originalDeployment, 0)
+
+	if originalDeploymentName := viper.GetString("original-deployment-name"); originalDeploymentName != "" {
+		result = append(result, originalDeployment{
+			Namespace:     originalDeploymentNamespace,
+			Name:          originalDeploymentName,
+			Environment:   splitEnvironmentVariable(viper.GetStringSlice("environment")),
+			ExcludeLabel:  splitEnvironmentVariable(viper.GetStringSlice("exclude-label")),
+			IdentityLabel: identityLabels,
+		})
+	}
+
+	bundle := make([]originalDeployment, 0)
+	if err := viper.UnmarshalKey("original-deployments", &bundle); err != nil {
+		return nil, err
+	}
+
+	for _, deployment := range bundle {
+		if deployment.Namespace == "" {
+			deployment.Namespace = originalDeploymentNamespace
+		}
+
+		if len(deployment.IdentityLabel) == 0 {
+			deployment.IdentityLabel = identityLabels
+		}
+
+		result = append(result, deployment)
+	}
+
+	if len(result) == 0 {
+		return nil, fmt.Errorf("no original deployment configured")
+	}
+
+	return result, nil
+}
+
+func setupPriority() (*controller.Priority, error) {
+	priorityColumn := viper.GetString("priority-column")
+	if priorityColumn == "" {
+		return nil, nil
+	}
+
+	priorityOrder := viper.GetString("priority-order")
+	priorityValues := splitEnvironmentVariable(viper.GetStringSlice("priority-value"))
+	return controller.NewPriority(priorityColumn, priorityOrder, priorityValues)
+}
+
+type rowHandler interface {
+	OnRow(row tablewatch.Row)
+}
+
+// processRows hands a batch of rows to the handlers in the order of priority, every handler
+//
+//	gets a row before the next one so all the duplicates of a row are created together.
+func processRows(rows []tablewatch.Row, priority *controller.Priority, handlers []rowHandler) {
+	for _, row := range priority.Sort(rows) {
+		for _, handler := range handlers {
+			handler.OnRow(row)
+		}
+	}
+}
+
+func setupDeploymentControllers(manager manager.Manager, originalDeployments []originalDeployment,
+	namespaces *controller.NamespaceManager, throttle *controller.Throttle, priority *controller.Priority,
+	templates *controller.TemplateStore, overrides *controller.Overrides) ([]*controller.DeploymentReconciler, []chan string, error) {
+	targetDeploymentName := viper.GetString("target-deployment-name")
+	driftMode := viper.GetString("drift-mode")
+	driftIgnoreFields := splitEnvironmentVariable(viper.GetStringSlice("drift-ignore-field"))
+	pinnedVersionColumn := viper.GetString("pinned-version-column")
+	canaryColumn := viper.GetString("canary-column")
+	canarySelector := viper.GetString("canary-selector")
+	canaryBakeTime := time.Duration(viper.GetInt("canary-bake-time")) * time.Second
+	canaryTimeout := time.Duration(viper.GetInt("canary-timeout")) * time.Second
+	canaryRollback := viper.GetBool("canary-rollback")
+	if pinnedVersionColumn != "" && templates == nil {
+		return nil, nil, fmt.Errorf("pinned version column needs the template history, set --template-history")
+	}
+
+	controllers := make([]*controller.DeploymentReconciler, 0)
+	removeChannels := make([]chan string, 0)
+	for _, original := range originalDeployments {
+		removeDeploys := make(chan string)
+		controller, err := controller.New(manager.GetClient(), original.Namespace, original.Name,
+			targetDeploymentName, original.Environment, original.ExcludeLabel, original.IdentityLabel, removeDeploys)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		controller.SetNamespaceManager(namespaces)
+		controller.SetThrottle(throttle)
+		controller.SetPriority(priority)
+		controller.SetTemplateStore(templates)
+		controller.SetPinnedVersionColumn(pinnedVersionColumn)
+		if overrides != nil {
+			controller.SetOverrides(overrides)
+		}
+
+		if err := controller.SetDriftPolicy(driftMode, driftIgnoreFields); err != nil {
+			return nil, nil, err
+		}
+
+		if err := controller.SetCanaryPolicy(canaryColumn, canarySelector, canaryBakeTime, canaryTimeout, canaryRollback); err != nil {
+			return nil, nil, err
+		}
+
+		if err := controller.SetupWithManager(manager); err != nil {
+			return nil, nil, err
+		}
+
+		controllers = append(controllers, controller)
+		removeChannels = append(removeChannels, removeDeploys)
+	}
+
+	return controllers, removeChannels, nil
+}
+
+// All the duplicates of a row are removed together, every deployment controller
+//
+//	and the hpa controller get the stale deploys found by the cleaner.
+func distributeRemovals(ctx context.Context, removeDeploys <-chan string, removeChannels []chan string) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case deploy := <-removeDeploys:
+			for _, removeChannel := range removeChannels {
+				select {
+				case removeChannel <- deploy:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}
+	}
+}
+
+// notifyRowsReady tells the deployment controllers once every source delivered a full snapshot
+func notifyRowsReady(snapshot tablewatch.Snapshot, pendingSources map[string]bool,
+	deploymentControllers []*controller.DeploymentReconciler) {
+	if snapshot.Partial || !pendingSources[snapshot.Source] {
+		return
+	}
+
+	delete(pendingSources, snapshot.Source)
+	if len(pendingSources) > 0 {
+		return
+	}
+
+	logger.Infof("Every source delivered its rows")
+	for _, deploymentController := range deploymentControllers {
+		deploymentController.OnRowsReady()
+	}
+}
+
+func setupHealthChecks(manager manager.Manager, sources []source.Source,
+	deploymentControllers []*controller.DeploymentReconciler) error {
+	if err := manager.AddHealthzCheck("ping", healthz.Ping); err != nil {
+		return err
+	}
+
+	for _, source := range sources {
+		name := fmt.Sprintf("source-%s", source.Name())
+		if err := manager.AddReadyzCheck(name, source.ReadyCheck); err != nil {
+			return err
+		}
+	}
+
+	for _, deploymentController := range deploymentControllers {
+		name := fmt.Sprintf("deployments-%s", deploymentController.Name())
+		if err := manager.AddReadyzCheck(name, deploymentController.ReadyCheck); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
 func watch() error {
-	rows := make(chan tablewatch.Row)
-	if err := setupWatcher(rows); err != nil {
+	databaseSources, err := getDatabaseSources()
+	if err != nil {
+		return err
+	}
+
+	snapshots := make(chan tablewatch.Snapshot)
+	watchers, err := setupWatchers(databaseSources)
+	if err != nil {
 		return err
 	}
 
+	defer closeWatchers(watchers)
+
 	config, err := ctrl.GetConfig()
 	if err != nil {
 		return err
 	}
 
-	manager, err := ctrl.NewManager(config, manager.Options{})
+	manager, err := ctrl.NewManager(config, manager.Options{
+		HealthProbeBindAddress: viper.GetString("health-probe-bind-address"),
+	})
 	if err != nil {
 		return err
 	}
@@ -144,31 +437,191 @@ func watch() error {
 	targetDeploymentName := viper.GetString("target-deployment-name")
 	cleanInterval := time.Duration(checkInterval) * 3 * time.Second
 	cleaner := cleaner.NewCleaner(cleanInterval, targetDeploymentName, removeDeploys)
-	go cleaner.Run()
+	originalDeployments, err := getOriginalDeployments()
+	if err != nil {
+		return err
+	}
 
-	deploymentController, err := setupDeploymentController(manager, removeDeploys)
+	// The binlog positions are kept next to the first original deployment
+	//
+	checkpoints, err := controller.NewConfigMapCheckpointStore(manager.GetClient(), manager.GetAPIReader(),
+		originalDeployments[0].Namespace, viper.GetString("replication-checkpoint-config-map"))
 	if err != nil {
 		return err
 	}
 
-	vpaController, err := setupVpaController(manager)
+	sources, err := setupSources(databaseSources, watchers, checkpoints, manager.GetAPIReader())
 	if err != nil {
 		return err
 	}
 
-	go manager.Start(ctrl.SetupSignalHandler())
-	go deploymentController.Run(cleaner)
+	pendingSources := make(map[string]bool)
+	for _, source := range sources {
+		cleaner.AddSource(source.Name())
+		pendingSources[source.Name()] = true
+	}
 
-	for row := range rows {
-		deploymentController.OnRow(row)
-		cleaner.OnRow(row)
+	namespaces, err := setupNamespaceManager(manager.GetClient())
+	if err != nil {
+		return err
+	}
 
-		if vpaController != nil {
-			vpaController.OnRow(row)
+	throttle, err := setupThrottle()
+	if err != nil {
+		return err
+	}
+
+	priority, err := setupPriority()
+	if err != nil {
+		return err
+	}
+
+	templates, err := setupTemplateStore(manager.GetClient(), manager.GetAPIReader())
+	if err != nil {
+		return err
+	}
+
+	overrides, err := setupOverrides(context.Background(), watchers)
+	if err != nil {
+		return err
+	}
+
+	deploymentControllers, removeChannels, err := setupDeploymentControllers(manager, originalDeployments,
+		namespaces, throttle, priority, templates, overrides)
+	if err != nil {
+		return err
+	}
+
+	// The status of the first original deployment represents the whole row
+	//
+	statusRouter, err := setupStatusWriter(databaseSources, watchers, deploymentControllers[0])
+	if err != nil {
+		return err
+	}
+
+	if err := setupHealthChecks(manager, sources, deploymentControllers); err != nil {
+		return err
+	}
+
+	// The autoscalers are duplicated for the first original deployment
+	//
+	vpaController, err := setupVpaController(manager, originalDeployments[0], namespaces, throttle)
+	if err != nil {
+		return err
+	}
+
+	hpaController, err := setupHpaController(manager, originalDeployments[0], namespaces, throttle)
+	if err != nil {
+		return err
+	}
+
+	if hpaController != nil {
+		removeHpas := make(chan string)
+		hpaController.SetRemoveChannel(removeHpas)
+		removeChannels = append(removeChannels, removeHpas)
+	}
+
+	handlers := make([]rowHandler, 0)
+	for _, deploymentController := range deploymentControllers {
+		handlers = append(handlers, deploymentController)
+	}
+
+	if vpaController != nil {
+		handlers = append(handlers, vpaController)
+	}
+
+	if hpaController != nil {
+		handlers = append(handlers, hpaController)
+	}
+
+	ctx, cancel := context.WithCancel(ctrl.SetupSignalHandler())
+	defer cancel()
+
+	managerResult := make(chan error, 1)
+	go func() {
+		managerResult <- manager.Start(ctx)
+	}()
+
+	// Every routine below stops once ctx is done, the shutdown waits for them so in flight
+	//	creations and removals are completed before the database connections are closed.
+	//
+	var routines sync.WaitGroup
+	for _, rowSource := range sources {
+		routines.Add(1)
+		go func(rowSource source.Source) {
+			defer routines.Done()
+			rowSource.Watch(ctx, checkInterval, snapshots)
+		}(rowSource)
+	}
+
+	routines.Add(1)
+	go func() {
+		defer routines.Done()
+		cleaner.Run(ctx)
+	}()
+
+	routines.Add(1)
+	go func() {
+		defer routines.Done()
+		distributeRemovals(ctx, removeDeploys, removeChannels)
+	}()
+
+	routines.Add(1)
+	go func() {
+		defer routines.Done()
+		throttle.Run(ctx)
+	}()
+
+	if overrides != nil {
+		routines.Add(1)
+		go func() {
+			defer routines.Done()
+			overrides.Run(ctx, time.Duration(checkInterval)*time.Second)
+		}()
+	}
+
+	if hpaController != nil {
+		routines.Add(1)
+		go func() {
+			defer routines.Done()
+			hpaController.Run(ctx)
+		}()
+	}
+
+	for _, deploymentController := range deploymentControllers {
+		routines.Add(1)
+		go func(deploymentController *controller.DeploymentReconciler) {
+			defer routines.Done()
+			deploymentController.Run(ctx, cleaner)
+		}(deploymentController)
+	}
+
+	var result error
+	for running := true; running; {
+		select {
+		case <-ctx.Done():
+			running = false
+		case err := <-managerResult:
+			logger.Errorf("Manager stopped %s", err)
+			result = err
+			running = false
+		case snapshot := <-snapshots:
+			statusRouter.OnSnapshot(snapshot)
+			processRows(snapshot.Rows, priority, handlers)
+			cleaner.OnSnapshot(snapshot)
+			notifyRowsReady(snapshot, pendingSources, deploymentControllers)
 		}
 	}
 
-	return nil
+	logger.Infof("Shutting down")
+	cancel()
+	routines.Wait()
+
+	if result == nil {
+		result = <-managerResult
+	}
+
+	return result
 }
 
 func Execute() {
@@ -178,24 +631,25 @@ func Execute() {
 	}
 }
 
+// configureLogger is called again once the config and environment are read
 func configureLogger() {
-	logFormat := `[%{time:2006-01-02 15:04:05.000}] %{color}%{level:-7s}%{color:reset} %{message} [%{module} - %{shortfile}]`
-	formatter, err := logging.NewStringFormatter(logFormat)
-	if err != nil {
-		// continue with default config
-		return
+	if err := logs.Configure(viper.GetString("log-format"), viper.GetString("log-level")); err != nil {
+		// continue with the previous config
+		fmt.Fprintln(os.Stderr, err)
 	}
-
-	logging.SetBackend(logging.NewLogBackend(os.Stdout, "", 0))
-	logging.SetFormatter(formatter)
 }
 
 func init() {
-	configureLogger()
 	cobra.OnInitialize(initConfig)
 	rootCmd.PersistentFlags().StringVar(&cfgFile, "config", "", "config file (default is $HOME/.kubernetes-database-scaler.yaml)")
+	rootCmd.PersistentFlags().StringP("log-format", "", logs.LOG_FORMAT_TEXT, "Log format (text, json)")
+	rootCmd.PersistentFlags().StringP("log-level", "", "info", "Log level (debug, info, warning, error)")
 
+	rootCmd.Flags().StringP("database-source-name", "", tablewatch.DEFAULT_SOURCE_NAME, "Name of the database source defined by the database flags")
+	rootCmd.Flags().StringP("source-column", "", "", "A pseudo column added to every row, holding the name of the database source it came from")
 	rootCmd.Flags().StringP("database-driver", "", "", "Database driver name (postgres, mysql e.g.)")
+	rootCmd.Flags().StringP("database-url", "", "", "Database connection url or dsn (e.g. postgres://user@host:5432/name?sslmode=require)")
+	rootCmd.Flags().StringP("database-url-file", "", "", "A file containing a database connection url or dsn")
 	rootCmd.Flags().StringP("database-name", "", "", "Database name")
 	rootCmd.Flags().StringP("database-port", "", "", "Database port")
 	rootCmd.Flags().StringP("database-host", "", "", "Database hostname")
@@ -203,20 +657,76 @@ func init() {
 	rootCmd.Flags().StringP("database-password", "", "", "Database password")
 	rootCmd.Flags().StringP("database-username-file", "", "", "A file containing a database username")
 	rootCmd.Flags().StringP("database-password-file", "", "", "A file containing a database password")
+	rootCmd.Flags().StringP("database-sslmode", "", "", "Database ssl mode (disable, require, verify-ca, verify-full e.g.)")
+	rootCmd.Flags().StringP("database-sslrootcert", "", "", "A file containing the certificate authorities of the database server")
+	rootCmd.Flags().StringP("database-sslcert", "", "", "A file containing the client certificate")
+	rootCmd.Flags().StringP("database-sslkey", "", "", "A file containing the client certificate key")
 
 	rootCmd.Flags().IntP("check-interval", "", 10, "Periodic check interval in seconds")
+	rootCmd.Flags().IntP("query-timeout", "", 30, "Timeout of every database query and http source request in seconds, 0 disables it")
+	rootCmd.Flags().StringP("health-probe-bind-address", "", ":8081", "The address the liveness and readiness probes endpoint binds to")
 	rootCmd.Flags().StringP("table-name", "t", "", "Specify the database table to monitor for changes")
+	rootCmd.Flags().StringArrayP("select-column", "", make([]string, 0), "Columns to select from the table instead of all of them")
 	rootCmd.Flags().StringP("sql-condition", "", "", "Filter rows using a WHERE clause (e.g., 'status = \"active\"')")
 	rootCmd.Flags().StringP("raw-sql", "", "", "Execute a custom SQL query instead of using table-name and sql-condition (Warning: No SQL injection protection)")
+	rootCmd.Flags().StringP("replication-slot", "", "", "Consume the changes of table-name from this postgres logical replication slot instead of polling")
+	rootCmd.Flags().StringP("replication-publication", "", "", "The publication of table-name, created when missing (defaults to the slot name)")
+	rootCmd.Flags().IntP("replication-snapshot-interval", "", 3600, "Interval in seconds of the full table query reconciling missed changes")
+	rootCmd.Flags().UintP("replication-server-id", "", 0, "The mysql server id of the binlog replication, derived from the slot name by default")
+	rootCmd.Flags().StringP("replication-checkpoint-config-map", "", "kubernetes-database-scaler-checkpoints", "A config map in the namespace of the first original deployment keeping the binlog positions")
 
 	rootCmd.Flags().StringP("original-deployment-namespace", "", "", "Deployment namespace to duplicate")
 	rootCmd.Flags().StringP("original-deployment-name", "", "", "Deployment name to duplicate")
 	rootCmd.Flags().StringP("target-deployment-name", "", "", "A column name to append to the copied deployment")
 	rootCmd.Flags().StringArrayP("environment", "", make([]string, 0), "Names of columns to add as environment variables")
-	rootCmd.Flags().StringP("original-vpa-name", "", "", "A vertical pod autoscaler to duplicate")
+	rootCmd.Flags().StringP("original-vpa-name", "", "", "A vertical pod autoscaler to duplicate, it scales the duplicates of the first original deployment")
+	rootCmd.Flags().StringP("original-hpa-name", "", "", "A horizontal pod autoscaler to duplicate, it scales the duplicates of the first original deployment")
+	rootCmd.Flags().StringP("hpa-min-replicas-column", "", "", "A column holding the min replicas of the duplicated horizontal pod autoscaler")
+	rootCmd.Flags().StringP("hpa-max-replicas-column", "", "", "A column holding the max replicas of the duplicated horizontal pod autoscaler")
 	rootCmd.Flags().StringArrayP("exclude-label", "", make([]string, 0), "Specify label names to exclude from the duplicated deployment")
+	rootCmd.Flags().StringP("drift-mode", "", "off", "What to do when a duplicated deployment is changed by hand (off, report, revert)")
+	rootCmd.Flags().StringArrayP("drift-ignore-field", "", make([]string, 0), "Spec fields excluded from drift detection (e.g. spec.replicas)")
+	rootCmd.Flags().StringArrayP("identity-label", "", []string{"name"}, "Label names set to the duplicated deployment name in its labels, selector and pod template")
+	rootCmd.Flags().StringP("overrides-table", "", "", "A table of per tenant patches applied on the duplicated deployments, empty to disable overrides")
+	rootCmd.Flags().StringP("overrides-tenant-column", "", "tenant_id", "The column of the overrides table holding the tenant, the target deployment name of its row")
+	rootCmd.Flags().StringP("overrides-patch-column", "", "patch", "The column of the overrides table holding the patch")
+	rootCmd.Flags().StringP("overrides-type-column", "", "patch_type", "The column of the overrides table holding the patch type (strategic, json), empty for strategic merge patches only")
+	rootCmd.Flags().StringP("overrides-order-column", "", "", "The column of the overrides table ordering the patches of a tenant")
+	rootCmd.Flags().StringP("pinned-version-column", "", "", "A column holding the template version a tenant is pinned to, empty to follow the original deployment")
+	rootCmd.Flags().StringP("canary-column", "", "", "A column marking with a true value the tenants whose duplicates get changes of the original deployment first")
+	rootCmd.Flags().StringP("canary-selector", "", "", "A label selector of the duplicates getting changes of the original deployment first")
+	rootCmd.Flags().IntP("canary-bake-time", "", 300, "Seconds the canaries must be available before the rest of the duplicates are updated")
+	rootCmd.Flags().IntP("canary-timeout", "", 600, "Seconds the canaries have to become available before the rollout is halted")
+	rootCmd.Flags().BoolP("canary-rollback", "", false, "Roll the canaries of a halted rollout back to the previous generation")
+	rootCmd.Flags().IntP("template-history", "", 0, "Versions of every original deployment kept in config maps for rollbacks and pinning, 0 disables it")
+	rootCmd.Flags().StringP("priority-column", "", "", "A column ordering the rows, the duplicates of the first rows are created and updated first")
+	rootCmd.Flags().StringP("priority-order", "", controller.PRIORITY_ORDER_ASCENDING, "Order of priority-column (asc, desc)")
+	rootCmd.Flags().StringArrayP("priority-value", "", make([]string, 0), "Values of priority-column from first to last (e.g. enterprise), instead of comparing the values")
+	rootCmd.Flags().Float64P("max-creations-per-second", "", 0, "Rate limit of the duplicated deployments and autoscalers creations, 0 disables it")
+	rootCmd.Flags().Float64P("max-removals-per-second", "", 0, "Rate limit of the stale duplicates removals, 0 disables it")
+	rootCmd.Flags().IntP("max-in-flight", "", 4, "Max creations and removals running at the same time")
+	rootCmd.Flags().IntP("max-managed-deployments", "", 0, "Max duplicated deployments, rows beyond it are queued until others are removed, 0 disables it")
+
+	rootCmd.Flags().StringP("target-namespace-column", "", "", "A column holding the namespace to place the duplicates in")
+	rootCmd.Flags().StringP("target-namespace-template", "", "", "A template of the namespace to place the duplicates in (e.g. 'tenant-{{ .tenant_id }}')")
+	rootCmd.Flags().BoolP("create-target-namespace", "", false, "Create the target namespace when it doesn't exist")
+	rootCmd.Flags().BoolP("remove-target-namespace", "", false, "Remove target namespaces created by the scaler when their last row disappears")
+	rootCmd.Flags().StringArrayP("target-namespace-label", "", make([]string, 0), "Labels to add to created target namespaces (e.g. name=value)")
+	rootCmd.Flags().StringP("resource-quota-template", "", "", "A resource quota in the original namespace to copy into created target namespaces")
+	rootCmd.Flags().StringP("limit-range-template", "", "", "A limit range in the original namespace to copy into created target namespaces")
+
+	rootCmd.Flags().StringP("status-table", "", "", "Insert deployment status into this table instead of updating the watched row")
+	rootCmd.Flags().StringP("status-column", "", "", "A column to write the deployment status to (Queued, Created, Progressing, Available, Failed)")
+	rootCmd.Flags().StringP("status-ready-replicas-column", "", "", "A column to write the number of ready replicas to")
+	rootCmd.Flags().StringP("status-updated-at-column", "", "", "A column to write the time of the last status change to")
 
 	viper.BindPFlags(rootCmd.Flags())
+	viper.BindPFlags(rootCmd.PersistentFlags())
+	configureLogger()
+
+	// controller-runtime and client-go log through the same backend and format
+	//
+	ctrl.SetLogger(logs.NewLogr())
 }
 
 func initConfig() {
@@ -238,4 +748,6 @@ func initConfig() {
 	if err := viper.ReadInConfig(); err == nil {
 		fmt.Fprintln(os.Stderr, "Using config file:", viper.ConfigFileUsed())
 	}
+
+	configureLogger()
 }
@@ -0,0 +1,356 @@
+package cmd
+
+import (
+	"dvdlevanon/kubernetes-database-scaler/pkg/controller"
+	"dvdlevanon/kubernetes-database-scaler/pkg/source"
+	"dvdlevanon/kubernetes-database-scaler/pkg/tablewatch"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/spf13/viper"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+type databaseSource struct {
+	Name         string              `mapstructure:"name"`
+	Driver       string              `mapstructure:"database-driver"`
+	Url          string              `mapstructure:"database-url"`
+	UrlFile      string              `mapstructure:"database-url-file"`
+	Host         string              `mapstructure:"database-host"`
+	Port         string              `mapstructure:"database-port"`
+	Database     string              `mapstructure:"database-name"`
+	Username     string              `mapstructure:"database-username"`
+	Password     string              `mapstructure:"database-password"`
+	UsernameFile string              `mapstructure:"database-username-file"`
+	PasswordFile string              `mapstructure:"database-password-file"`
+	SslMode      string              `mapstructure:"database-sslmode"`
+	SslRootCert  string              `mapstructure:"database-sslrootcert"`
+	SslCert      string              `mapstructure:"database-sslcert"`
+	SslKey       string              `mapstructure:"database-sslkey"`
+	TableName    string              `mapstructure:"table-name"`
+	Columns      []string            `mapstructure:"select-column"`
+	SqlCondition string              `mapstructure:"sql-condition"`
+	Filters      []tablewatch.Filter `mapstructure:"filters"`
+	RawSql       string              `mapstructure:"raw-sql"`
+	Slot         string              `mapstructure:"replication-slot"`
+	Publication  string              `mapstructure:"replication-publication"`
+}
+
+func getFlagsDatabaseSource() (databaseSource, error) {
+	filters := make([]tablewatch.Filter, 0)
+	if err := viper.UnmarshalKey("filters", &filters); err != nil {
+		return databaseSource{}, err
+	}
+
+	return databaseSource{
+		Name:         viper.GetString("database-source-name"),
+		Driver:       viper.GetString("database-driver"),
+		Url:          viper.GetString("database-url"),
+		UrlFile:      viper.GetString("database-url-file"),
+		Host:         viper.GetString("database-host"),
+		Port:         viper.GetString("database-port"),
+		Database:     viper.GetString("database-name"),
+		Username:     viper.GetString("database-username"),
+		Password:     viper.GetString("database-password"),
+		UsernameFile: viper.GetString("database-username-file"),
+		PasswordFile: viper.GetString("database-password-file"),
+		SslMode:      viper.GetString("database-sslmode"),
+		SslRootCert:  viper.GetString("database-sslrootcert"),
+		SslCert:      viper.GetString("database-sslcert"),
+		SslKey:       viper.GetString("database-sslkey"),
+		TableName:    viper.GetString("table-name"),
+		Columns:      splitEnvironmentVariable(viper.GetStringSlice("select-column")),
+		SqlCondition: viper.GetString("sql-condition"),
+		Filters:      filters,
+		RawSql:       viper.GetString("raw-sql"),
+		Slot:         viper.GetString("replication-slot"),
+		Publication:  viper.GetString("replication-publication"),
+	}, nil
+}
+
+func withDefault(value string, defaultValue string) string {
+	if value == "" {
+		return defaultValue
+	}
+
+	return value
+}
+
+// inherit fills the fields missing from a source of the config file with the values of the flags,
+//
+//	so shards sharing the same table and credentials only differ by name and host.
+func (s databaseSource) inherit(defaults databaseSource) databaseSource {
+	s.Driver = withDefault(s.Driver, defaults.Driver)
+	if s.Url == "" && s.UrlFile == "" {
+		s.Url = defaults.Url
+		s.UrlFile = defaults.UrlFile
+	}
+
+	s.Host = withDefault(s.Host, defaults.Host)
+	s.Port = withDefault(s.Port, defaults.Port)
+	s.Database = withDefault(s.Database, defaults.Database)
+	s.Username = withDefault(s.Username, defaults.Username)
+	s.Password = withDefault(s.Password, defaults.Password)
+	s.UsernameFile = withDefault(s.UsernameFile, defaults.UsernameFile)
+	s.PasswordFile = withDefault(s.PasswordFile, defaults.PasswordFile)
+	s.SslMode = withDefault(s.SslMode, defaults.SslMode)
+	s.SslRootCert = withDefault(s.SslRootCert, defaults.SslRootCert)
+	s.SslCert = withDefault(s.SslCert, defaults.SslCert)
+	s.SslKey = withDefault(s.SslKey, defaults.SslKey)
+	s.Slot = withDefault(s.Slot, defaults.Slot)
+	s.Publication = withDefault(s.Publication, defaults.Publication)
+
+	if s.RawSql == "" && s.TableName == "" {
+		s.TableName = defaults.TableName
+		s.Columns = defaults.Columns
+		s.SqlCondition = defaults.SqlCondition
+		s.Filters = defaults.Filters
+		s.RawSql = defaults.RawSql
+	}
+
+	return s
+}
+
+func (s databaseSource) getTLSConfig() tablewatch.TLSConfig {
+	return tablewatch.TLSConfig{
+		Mode:     s.SslMode,
+		RootCert: s.SslRootCert,
+		Cert:     s.SslCert,
+		Key:      s.SslKey,
+	}
+}
+
+// getDatabaseSources returns the sources whose rows are merged, the one defined by the flags
+//
+//	comes first when --database-driver is set, followed by the database-sources list of the config file.
+func getDatabaseSources() ([]databaseSource, error) {
+	defaults, err := getFlagsDatabaseSource()
+	if err != nil {
+		return nil, err
+	}
+
+	// A url without a driver is taken as a postgres url or dsn, a mysql dsn requires --database-driver mysql
+	//
+	if defaults.Driver == "" && (defaults.Url != "" || defaults.UrlFile != "") {
+		defaults.Driver = "postgres"
+	}
+
+	result := make([]databaseSource, 0)
+
+	if defaults.Driver != "" {
+		result = append(result, defaults)
+	}
+
+	sources := make([]databaseSource, 0)
+	if err := viper.UnmarshalKey("database-sources", &sources); err != nil {
+		return nil, err
+	}
+
+	for _, source := range sources {
+		result = append(result, source.inherit(defaults))
+	}
+
+	return result, nil
+}
+
+func setupWatchers(sources []databaseSource) ([]*tablewatch.Tablewatch, error) {
+	sourceColumn := viper.GetString("source-column")
+	queryTimeout := time.Duration(viper.GetInt("query-timeout")) * time.Second
+	watchers := make([]*tablewatch.Tablewatch, 0)
+	for _, source := range sources {
+		watcher, err := tablewatch.New(source.Driver, source.Url, source.UrlFile, source.Host, source.Port, source.Database,
+			source.Username, source.Password, source.UsernameFile, source.PasswordFile, source.getTLSConfig(),
+			source.TableName, source.Columns, source.SqlCondition, source.Filters, source.RawSql)
+		if err != nil {
+			closeWatchers(watchers)
+			return nil, fmt.Errorf("database source %s: %w", source.Name, err)
+		}
+
+		watcher.SetSource(source.Name, sourceColumn)
+		watcher.SetQueryTimeout(queryTimeout)
+		watchers = append(watchers, watcher)
+	}
+
+	return watchers, nil
+}
+
+func closeWatchers(watchers []*tablewatch.Tablewatch) {
+	for _, watcher := range watchers {
+		if err := watcher.Close(); err != nil {
+			logger.Errorf("Unable to close database source %s %s", watcher.Name(), err)
+		}
+	}
+}
+
+// sourceConfig is an entry of the sources list of the config file, the fields used depend on the type.
+type sourceConfig struct {
+	Name            string            `mapstructure:"name"`
+	Type            string            `mapstructure:"type"`
+	Url             string            `mapstructure:"url"`
+	Headers         map[string]string `mapstructure:"headers"`
+	BearerTokenFile string            `mapstructure:"bearer-token-file"`
+	RowsField       string            `mapstructure:"rows-field"`
+	ApiVersion      string            `mapstructure:"api-version"`
+	Kind            string            `mapstructure:"kind"`
+	Namespace       string            `mapstructure:"namespace"`
+	LabelSelector   string            `mapstructure:"label-selector"`
+	Path            string            `mapstructure:"path"`
+}
+
+func buildSource(config sourceConfig, reader client.Reader, sourceColumn string) (source.Source, error) {
+	switch config.Type {
+	case "http":
+		timeout := time.Duration(viper.GetInt("query-timeout")) * time.Second
+		return source.NewHttpSource(config.Name, config.Url, config.Headers,
+			config.BearerTokenFile, config.RowsField, timeout, sourceColumn)
+	case "kubernetes":
+		apiVersion := withDefault(config.ApiVersion, "v1")
+		kind := withDefault(config.Kind, "ConfigMap")
+		return source.NewKubernetesSource(config.Name, reader, apiVersion, kind,
+			config.Namespace, config.LabelSelector, sourceColumn)
+	case "file":
+		return source.NewFileSource(config.Name, config.Path, sourceColumn)
+	default:
+		return nil, fmt.Errorf("invalid source type %s of %s (e.g. http, kubernetes, file)", config.Type, config.Name)
+	}
+}
+
+// buildDatabaseSource replicates the changes of the table when a replication slot is set, from
+//
+//	a logical replication slot of postgres or from the binlog of mysql, otherwise the watcher
+//	queries the whole table every check interval.
+func buildDatabaseSource(databaseSource databaseSource, watcher *tablewatch.Tablewatch,
+	checkpoints tablewatch.CheckpointStore) (source.Source, error) {
+
+	if databaseSource.Slot == "" {
+		return watcher, nil
+	}
+
+	keyColumn := viper.GetString("target-deployment-name")
+	snapshotInterval := time.Duration(viper.GetInt("replication-snapshot-interval")) * time.Second
+
+	var result source.Source
+	var err error
+	switch databaseSource.Driver {
+	case "mysql":
+		var replication *tablewatch.BinlogReplication
+		replication, err = watcher.NewBinlogReplication(databaseSource.TableName, keyColumn,
+			databaseSource.Slot, uint32(viper.GetUint("replication-server-id")), snapshotInterval)
+		if err == nil {
+			replication.SetCheckpointStore(checkpoints)
+			result = replication
+		}
+	default:
+		result, err = watcher.NewReplication(databaseSource.TableName, keyColumn,
+			databaseSource.Slot, databaseSource.Publication, snapshotInterval)
+	}
+
+	if err != nil {
+		return nil, fmt.Errorf("database source %s: %w", databaseSource.Name, err)
+	}
+
+	return result, nil
+}
+
+// setupSources returns the database sources followed by the sources of the config file.
+func setupSources(databaseSources []databaseSource, watchers []*tablewatch.Tablewatch,
+	checkpoints tablewatch.CheckpointStore, reader client.Reader) ([]source.Source, error) {
+
+	sourceColumn := viper.GetString("source-column")
+	result := make([]source.Source, 0)
+	for i, watcher := range watchers {
+		source, err := buildDatabaseSource(databaseSources[i], watcher, checkpoints)
+		if err != nil {
+			return nil, err
+		}
+
+		result = append(result, source)
+	}
+
+	configs := make([]sourceConfig, 0)
+	if err := viper.UnmarshalKey("sources", &configs); err != nil {
+		return nil, err
+	}
+
+	for _, config := range configs {
+		source, err := buildSource(config, reader, sourceColumn)
+		if err != nil {
+			return nil, err
+		}
+
+		result = append(result, source)
+	}
+
+	if len(result) == 0 {
+		return nil, fmt.Errorf("no source configured")
+	}
+
+	names := make(map[string]bool)
+	for _, source := range result {
+		if source.Name() == "" {
+			return nil, fmt.Errorf("source name is empty")
+		}
+
+		if names[source.Name()] {
+			return nil, fmt.Errorf("duplicated source name %s", source.Name())
+		}
+
+		names[source.Name()] = true
+	}
+
+	return result, nil
+}
+
+// statusRouter writes the status of a deployment to the source its row was last seen in.
+type statusRouter struct {
+	keyColumn string
+	writers   map[string]controller.StatusReporter
+	lock      sync.Mutex
+	sources   map[string]string
+}
+
+func newStatusRouter(keyColumn string) *statusRouter {
+	return &statusRouter{
+		keyColumn: keyColumn,
+		writers:   make(map[string]controller.StatusReporter),
+		sources:   make(map[string]string),
+	}
+}
+
+func (r *statusRouter) addWriter(source string, writer controller.StatusReporter) {
+	r.writers[source] = writer
+}
+
+func (r *statusRouter) OnSnapshot(snapshot tablewatch.Snapshot) {
+	if r == nil {
+		return
+	}
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	for _, row := range snapshot.Rows {
+		if deploymentId, ok := row[r.keyColumn]; ok {
+			r.sources[deploymentId] = snapshot.Source
+		}
+	}
+}
+
+func (r *statusRouter) ReportStatus(deploymentId string, status string, readyReplicas int32) error {
+	r.lock.Lock()
+	source, ok := r.sources[deploymentId]
+	r.lock.Unlock()
+
+	if !ok {
+		return fmt.Errorf("source of %s is unknown", deploymentId)
+	}
+
+	writer, ok := r.writers[source]
+	if !ok {
+		logger.Debugf("Source %s of %s doesn't support status write-back", source, deploymentId)
+		return nil
+	}
+
+	return writer.ReportStatus(deploymentId, status, readyReplicas)
+}
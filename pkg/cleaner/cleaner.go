@@ -1,66 +1,199 @@
 package cleaner
 
 import (
+	"context"
+	"dvdlevanon/kubernetes-database-scaler/pkg/logs"
 	"dvdlevanon/kubernetes-database-scaler/pkg/tablewatch"
 	"time"
-
-	"github.com/op/go-logging"
 )
 
-var logger = logging.MustGetLogger("cleaner")
+var logger = logs.MustGetLogger("cleaner")
+var cleanLogger = logger.WithOperation(logs.OPERATION_CLEAN)
+
+// Deploys found in the cluster before any source returned them are seen by this pseudo source
+const unknownSource = ""
 
 func NewCleaner(cleanInterval time.Duration, deploymentColumnName string, removeChannel chan<- string) *Cleaner {
 	return &Cleaner{
 		cleanInterval:        cleanInterval,
 		deploymentColumnName: deploymentColumnName,
-		lastSeenMap:          make(map[string]time.Time, 0),
+		lastSeenMap:          make(map[string]map[string]time.Time, 0),
+		lastSnapshotMap:      make(map[string]time.Time, 0),
 		lastSeenChannel:      make(chan string),
+		snapshotChannel:      make(chan tablewatch.Snapshot),
 		removeChannel:        removeChannel,
+		done:                 make(chan struct{}),
 	}
 }
 
+// Cleaner removes deploys whose row disappeared, a deploy is removed only when it's absent
+//
+//	from all the healthy sources and none of the sources it was seen in is unhealthy.
+//	A source is healthy when it returned a full snapshot during the last clean interval.
 type Cleaner struct {
 	cleanInterval        time.Duration
 	deploymentColumnName string
-	lastSeenMap          map[string]time.Time
+	lastSeenMap          map[string]map[string]time.Time
+	lastSnapshotMap      map[string]time.Time
 	lastSeenChannel      chan string
+	snapshotChannel      chan tablewatch.Snapshot
 	removeChannel        chan<- string
+	done                 chan struct{}
+}
+
+// AddSource registers a source before Run, a source that never returned a snapshot is unhealthy.
+func (c *Cleaner) AddSource(source string) {
+	c.lastSnapshotMap[source] = time.Time{}
 }
 
-func (c *Cleaner) Run() {
+// Run tracks the seen deploys until ctx is done, once it returns OnSnapshot and OnDeploy
+//
+//	no longer block.
+func (c *Cleaner) Run(ctx context.Context) {
 	ticker := time.NewTicker(time.Minute)
 	defer ticker.Stop()
+	defer close(c.done)
 
 	for {
 		select {
+		case <-ctx.Done():
+			cleanLogger.Infof("Stopping cleaner")
+			return
 		case <-ticker.C:
-			c.periodicClean()
+			c.periodicClean(ctx)
 		case deploy := <-c.lastSeenChannel:
-			c.lastSeenMap[deploy] = time.Now()
+			c.markSeen(deploy, unknownSource)
+		case snapshot := <-c.snapshotChannel:
+			c.handleSnapshot(ctx, snapshot)
 		}
 	}
 }
 
-func (c *Cleaner) periodicClean() {
-	for deploy, lastSeen := range c.lastSeenMap {
-		threshold := time.Now().Add(-c.cleanInterval)
-		if lastSeen.Before(threshold) {
-			logger.Infof("About to remove stale deploy %s", deploy)
-			c.removeChannel <- deploy
+func (c *Cleaner) markSeen(deploy string, source string) {
+	seenBy, ok := c.lastSeenMap[deploy]
+	if !ok {
+		seenBy = make(map[string]time.Time)
+		c.lastSeenMap[deploy] = seenBy
+	}
+
+	seenBy[source] = time.Now()
+}
+
+func (c *Cleaner) handleSnapshot(ctx context.Context, snapshot tablewatch.Snapshot) {
+	// A partial snapshot holds only the changed rows, it doesn't tell the other rows are still returned
+	//
+	if !snapshot.Partial {
+		c.lastSnapshotMap[snapshot.Source] = time.Now()
+	}
+
+	for _, row := range snapshot.Removed {
+		if deploy, ok := row[c.deploymentColumnName]; ok {
+			c.handleRemovedRow(ctx, deploy, snapshot.Source)
+		}
+	}
+
+	for _, row := range snapshot.Rows {
+		deploy, ok := row[c.deploymentColumnName]
+		if !ok {
+			cleanLogger.With(logs.FIELD_SOURCE, snapshot.Source).Warningf("Column %s not found on row %v", c.deploymentColumnName, row)
+			continue
 		}
+
+		c.markSeen(deploy, snapshot.Source)
 	}
 }
 
-func (c *Cleaner) OnRow(row tablewatch.Row) {
-	deploy, ok := row[c.deploymentColumnName]
+// handleRemovedRow removes a deploy right away when its source reported the row as deleted,
+//
+//	unless another source has seen it, then it's left for the periodic clean.
+func (c *Cleaner) handleRemovedRow(ctx context.Context, deploy string, source string) {
+	seenBy, ok := c.lastSeenMap[deploy]
 	if !ok {
-		logger.Warningf("Column %s not found on row %v", c.deploymentColumnName, row)
 		return
 	}
 
-	c.lastSeenChannel <- deploy
+	delete(seenBy, source)
+	delete(seenBy, unknownSource)
+	if len(seenBy) > 0 {
+		return
+	}
+
+	delete(c.lastSeenMap, deploy)
+	cleanLogger.WithTenant(deploy).With(logs.FIELD_SOURCE, source).Infof("About to remove deleted deploy %s", deploy)
+	select {
+	case c.removeChannel <- deploy:
+	case <-ctx.Done():
+	}
+}
+
+func (c *Cleaner) isHealthy(source string, threshold time.Time) bool {
+	lastSnapshot, ok := c.lastSnapshotMap[source]
+	return ok && lastSnapshot.After(threshold)
+}
+
+func (c *Cleaner) areAllSourcesHealthy(threshold time.Time) bool {
+	for source := range c.lastSnapshotMap {
+		if !c.isHealthy(source, threshold) {
+			return false
+		}
+	}
+
+	return true
+}
+
+func (c *Cleaner) isStale(deploy string, seenBy map[string]time.Time, threshold time.Time) bool {
+	for source, lastSeen := range seenBy {
+		if lastSeen.After(threshold) {
+			return false
+		}
+
+		// We can't tell which source an unknown deploy belongs to, all of them must be healthy
+		//
+		if source == unknownSource {
+			if !c.areAllSourcesHealthy(threshold) {
+				cleanLogger.WithTenant(deploy).Debugf("Keeping deploy %s, not all sources are healthy", deploy)
+				return false
+			}
+
+			continue
+		}
+
+		if !c.isHealthy(source, threshold) {
+			cleanLogger.WithTenant(deploy).With(logs.FIELD_SOURCE, source).Debugf("Keeping deploy %s, source %s is unhealthy", deploy, source)
+			return false
+		}
+	}
+
+	return true
+}
+
+func (c *Cleaner) periodicClean(ctx context.Context) {
+	threshold := time.Now().Add(-c.cleanInterval)
+	for deploy, seenBy := range c.lastSeenMap {
+		if !c.isStale(deploy, seenBy, threshold) {
+			continue
+		}
+
+		cleanLogger.WithTenant(deploy).Infof("About to remove stale deploy %s", deploy)
+		select {
+		case c.removeChannel <- deploy:
+			delete(c.lastSeenMap, deploy)
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (c *Cleaner) OnSnapshot(snapshot tablewatch.Snapshot) {
+	select {
+	case c.snapshotChannel <- snapshot:
+	case <-c.done:
+	}
 }
 
 func (c *Cleaner) OnDeploy(deploy string) {
-	c.lastSeenChannel <- deploy
+	select {
+	case c.lastSeenChannel <- deploy:
+	case <-c.done:
+	}
 }
@@ -0,0 +1,163 @@
+package cleaner
+
+import (
+	"context"
+	"dvdlevanon/kubernetes-database-scaler/pkg/tablewatch"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+)
+
+const testCleanInterval = time.Minute
+
+func receiveRemoved(removeChannel chan string) []string {
+	removed := make([]string, 0)
+	for {
+		select {
+		case deploy := <-removeChannel:
+			removed = append(removed, deploy)
+		default:
+			sort.Strings(removed)
+			return removed
+		}
+	}
+}
+
+func TestPeriodicClean(t *testing.T) {
+	now := time.Now()
+	old := now.Add(-2 * testCleanInterval)
+
+	tests := []struct {
+		name          string
+		lastSnapshots map[string]time.Time
+		seenBy        map[string]time.Time
+		removed       bool
+	}{
+		{
+			name:          "seen recently",
+			lastSnapshots: map[string]time.Time{"a": now},
+			seenBy:        map[string]time.Time{"a": now},
+		},
+		{
+			name:          "gone from a healthy source",
+			lastSnapshots: map[string]time.Time{"a": now},
+			seenBy:        map[string]time.Time{"a": old},
+			removed:       true,
+		},
+		{
+			name:          "gone from an unhealthy source",
+			lastSnapshots: map[string]time.Time{"a": old},
+			seenBy:        map[string]time.Time{"a": old},
+		},
+		{
+			name:          "source never returned a snapshot",
+			lastSnapshots: map[string]time.Time{"a": {}},
+			seenBy:        map[string]time.Time{"a": old},
+		},
+		{
+			name:          "gone from one source, seen by another",
+			lastSnapshots: map[string]time.Time{"a": now, "b": now},
+			seenBy:        map[string]time.Time{"a": old, "b": now},
+		},
+		{
+			name:          "gone from one source, the other unhealthy",
+			lastSnapshots: map[string]time.Time{"a": now, "b": old},
+			seenBy:        map[string]time.Time{"a": old, "b": old},
+		},
+		{
+			name:          "unknown deploy, all sources healthy",
+			lastSnapshots: map[string]time.Time{"a": now, "b": now},
+			seenBy:        map[string]time.Time{unknownSource: old},
+			removed:       true,
+		},
+		{
+			name:          "unknown deploy, a source unhealthy",
+			lastSnapshots: map[string]time.Time{"a": now, "b": old},
+			seenBy:        map[string]time.Time{unknownSource: old},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			removeChannel := make(chan string, 1)
+			c := NewCleaner(testCleanInterval, "tenant_id", removeChannel)
+			c.lastSnapshotMap = test.lastSnapshots
+			c.lastSeenMap["t1"] = test.seenBy
+
+			c.periodicClean(context.Background())
+
+			removed := receiveRemoved(removeChannel)
+			if test.removed != reflect.DeepEqual(removed, []string{"t1"}) {
+				t.Fatalf("expected removed %v, got %v", test.removed, removed)
+			}
+
+			c.periodicClean(context.Background())
+			if removed := receiveRemoved(removeChannel); len(removed) != 0 {
+				t.Fatalf("expected a stale deploy to be removed once, got %v again", removed)
+			}
+		})
+	}
+}
+
+func TestHandleSnapshot(t *testing.T) {
+	tests := []struct {
+		name     string
+		seenBy   map[string]time.Time
+		snapshot tablewatch.Snapshot
+		removed  []string
+		healthy  bool
+	}{
+		{
+			name:     "rows are seen",
+			snapshot: tablewatch.Snapshot{Source: "a", Rows: []tablewatch.Row{{"tenant_id": "t1"}}},
+			removed:  []string{},
+			healthy:  true,
+		},
+		{
+			name:     "deleted row",
+			seenBy:   map[string]time.Time{"a": time.Now(), unknownSource: time.Now()},
+			snapshot: tablewatch.Snapshot{Source: "a", Removed: []tablewatch.Row{{"tenant_id": "t1"}}, Partial: true},
+			removed:  []string{"t1"},
+		},
+		{
+			name:     "deleted row seen by another source",
+			seenBy:   map[string]time.Time{"a": time.Now(), "b": time.Now()},
+			snapshot: tablewatch.Snapshot{Source: "a", Removed: []tablewatch.Row{{"tenant_id": "t1"}}, Partial: true},
+			removed:  []string{},
+		},
+		{
+			name:     "deleted row never seen",
+			snapshot: tablewatch.Snapshot{Source: "a", Removed: []tablewatch.Row{{"tenant_id": "t1"}}},
+			removed:  []string{},
+			healthy:  true,
+		},
+		{
+			name:     "partial snapshot",
+			snapshot: tablewatch.Snapshot{Source: "a", Rows: []tablewatch.Row{{"tenant_id": "t1"}}, Partial: true},
+			removed:  []string{},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			removeChannel := make(chan string, 1)
+			c := NewCleaner(testCleanInterval, "tenant_id", removeChannel)
+			c.AddSource("a")
+			if test.seenBy != nil {
+				c.lastSeenMap["t1"] = test.seenBy
+			}
+
+			c.handleSnapshot(context.Background(), test.snapshot)
+
+			removed := receiveRemoved(removeChannel)
+			if !reflect.DeepEqual(removed, test.removed) {
+				t.Fatalf("expected removed %v, got %v", test.removed, removed)
+			}
+
+			if healthy := c.isHealthy("a", time.Now().Add(-testCleanInterval)); healthy != test.healthy {
+				t.Fatalf("expected healthy %v, got %v", test.healthy, healthy)
+			}
+		})
+	}
+}
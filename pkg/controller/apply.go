@@ -0,0 +1,117 @@
+package controller
+
+import (
+	"context"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/sets"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/client-go/util/csaupgrade"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+const FIELD_MANAGER = "kubernetes-database-scaler"
+
+const REASON_APPLY_CONFLICT = "ApplyConflict"
+
+var deploymentGvk = schema.GroupVersionKind{Group: "apps", Version: "v1", Kind: "Deployment"}
+var hpaGvk = schema.GroupVersionKind{Group: "autoscaling", Version: "v2", Kind: "HorizontalPodAutoscaler"}
+var vpaGvk = schema.GroupVersionKind{Group: "autoscaling.k8s.io", Version: "v1", Kind: "VerticalPodAutoscaler"}
+
+// buildApplyConfiguration converts obj to the configuration we apply, the removed fields
+//
+//	are left for other field managers to own (e.g. spec.replicas owned by an hpa).
+func buildApplyConfiguration(obj runtime.Object, gvk schema.GroupVersionKind, removeFields []string) (*unstructured.Unstructured, error) {
+	content, err := runtime.DefaultUnstructuredConverter.ToUnstructured(obj)
+	if err != nil {
+		return nil, err
+	}
+
+	delete(content, "status")
+	unstructured.RemoveNestedField(content, "metadata", "creationTimestamp")
+	unstructured.RemoveNestedField(content, "metadata", "resourceVersion")
+	unstructured.RemoveNestedField(content, "metadata", "managedFields")
+
+	for _, field := range removeFields {
+		unstructured.RemoveNestedField(content, strings.Split(field, ".")...)
+	}
+
+	result := &unstructured.Unstructured{Object: content}
+	result.SetGroupVersionKind(gvk)
+	return result, nil
+}
+
+// applyObject creates or updates obj using server side apply. Without force, fields owned
+//
+//	by another manager are reported as a conflict instead of being taken over.
+func applyObject(ctx context.Context, c client.Client, obj client.Object,
+	gvk schema.GroupVersionKind, removeFields []string, force bool) error {
+	configuration, err := buildApplyConfiguration(obj, gvk, removeFields)
+	if err != nil {
+		return err
+	}
+
+	options := []client.PatchOption{client.FieldOwner(FIELD_MANAGER)}
+	if force {
+		options = append(options, client.ForceOwnership)
+	}
+
+	err = c.Patch(ctx, configuration, client.Apply, options...)
+	if apierrors.IsConflict(err) && !force {
+		// Objects created before server side apply are owned by our Update operations
+		//
+		upgraded, upgradeErr := upgradeManagedFields(ctx, c, configuration)
+		if upgradeErr != nil {
+			return upgradeErr
+		}
+
+		if upgraded {
+			err = c.Patch(ctx, configuration, client.Apply, options...)
+		}
+	}
+
+	if err != nil {
+		return err
+	}
+
+	obj.SetUID(configuration.GetUID())
+	obj.SetResourceVersion(configuration.GetResourceVersion())
+	return nil
+}
+
+// upgradeManagedFields moves the fields owned by our Update operations, from before the scaler used
+//
+//	server side apply, to our Apply manager. Returns false when there is nothing to upgrade.
+func upgradeManagedFields(ctx context.Context, c client.Client, configuration *unstructured.Unstructured) (bool, error) {
+	existing := &unstructured.Unstructured{}
+	existing.SetGroupVersionKind(configuration.GroupVersionKind())
+	if err := c.Get(ctx, client.ObjectKeyFromObject(configuration), existing); err != nil {
+		return false, err
+	}
+
+	patch, err := csaupgrade.UpgradeManagedFieldsPatch(existing, sets.New(FIELD_MANAGER), FIELD_MANAGER)
+	if err != nil || patch == nil {
+		return false, err
+	}
+
+	logger.Infof("Upgrading the managed fields of %s %s", configuration.GetKind(), configuration.GetName())
+	if err := c.Patch(ctx, existing, client.RawPatch(types.JSONPatchType, patch)); err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
+
+func recordApplyError(recorder record.EventRecorder, object runtime.Object, err error, messageFmt string, args ...interface{}) {
+	if apierrors.IsConflict(err) {
+		recordEvent(recorder, object, corev1.EventTypeWarning, REASON_APPLY_CONFLICT, messageFmt, args...)
+	} else {
+		recordEvent(recorder, object, corev1.EventTypeWarning, REASON_UPDATE_FAILED, messageFmt, args...)
+	}
+}
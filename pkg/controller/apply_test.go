@@ -0,0 +1,222 @@
+package controller
+
+import (
+	"context"
+	"testing"
+
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+	"k8s.io/client-go/kubernetes/scheme"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+// applyClient emulates the conflicts of server side apply, which the fake client doesn't support,
+//
+//	an apply conflicts with every Update manager owning a field of the object, and fails to
+//	change the immutable selector.
+type applyClient struct {
+	client.Client
+	applies int
+	applied *unstructured.Unstructured
+}
+
+func (c *applyClient) Patch(ctx context.Context, obj client.Object, patch client.Patch, opts ...client.PatchOption) error {
+	if patch != client.Apply {
+		return c.Client.Patch(ctx, obj, patch, opts...)
+	}
+
+	existing := &unstructured.Unstructured{}
+	existing.SetGroupVersionKind(obj.GetObjectKind().GroupVersionKind())
+	if err := c.Get(ctx, client.ObjectKeyFromObject(obj), existing); err != nil {
+		if !apierrors.IsNotFound(err) {
+			return err
+		}
+
+		c.applies++
+		c.applied = obj.(*unstructured.Unstructured)
+		return c.Create(ctx, obj)
+	}
+
+	selector, _, _ := unstructured.NestedFieldNoCopy(existing.Object, "spec", "selector")
+	applied, _, _ := unstructured.NestedFieldNoCopy(obj.(*unstructured.Unstructured).Object, "spec", "selector")
+	if !equality.Semantic.DeepEqual(selector, applied) {
+		return apierrors.NewInvalid(schema.GroupKind{Group: "apps", Kind: "Deployment"}, obj.GetName(),
+			field.ErrorList{field.Invalid(field.NewPath("spec", "selector"), applied, "field is immutable")})
+	}
+
+	for _, entry := range existing.GetManagedFields() {
+		if entry.Operation == metav1.ManagedFieldsOperationUpdate {
+			return apierrors.NewConflict(schema.GroupResource{Group: "apps", Resource: "deployments"},
+				obj.GetName(), nil)
+		}
+	}
+
+	c.applies++
+	c.applied = obj.(*unstructured.Unstructured)
+	return nil
+}
+
+func newManagedFieldsEntry(manager string, operation metav1.ManagedFieldsOperationType) metav1.ManagedFieldsEntry {
+	return metav1.ManagedFieldsEntry{
+		Manager:    manager,
+		Operation:  operation,
+		APIVersion: "apps/v1",
+		FieldsType: "FieldsV1",
+		FieldsV1:   &metav1.FieldsV1{Raw: []byte(`{"f:spec":{"f:replicas":{}}}`)},
+	}
+}
+
+func TestApplyObjectUpgradesManagedFields(t *testing.T) {
+	tests := []struct {
+		name          string
+		managedFields []metav1.ManagedFieldsEntry
+		conflict      bool
+		applies       int
+	}{
+		{
+			name:          "applied before",
+			managedFields: []metav1.ManagedFieldsEntry{newManagedFieldsEntry(FIELD_MANAGER, metav1.ManagedFieldsOperationApply)},
+			applies:       1,
+		},
+		{
+			name:          "created with update",
+			managedFields: []metav1.ManagedFieldsEntry{newManagedFieldsEntry(FIELD_MANAGER, metav1.ManagedFieldsOperationUpdate)},
+			applies:       1,
+		},
+		{
+			name: "updated after apply",
+			managedFields: []metav1.ManagedFieldsEntry{
+				newManagedFieldsEntry(FIELD_MANAGER, metav1.ManagedFieldsOperationApply),
+				newManagedFieldsEntry(FIELD_MANAGER, metav1.ManagedFieldsOperationUpdate),
+			},
+			applies: 1,
+		},
+		{
+			name:          "changed by someone else",
+			managedFields: []metav1.ManagedFieldsEntry{newManagedFieldsEntry("kubectl-edit", metav1.ManagedFieldsOperationUpdate)},
+			conflict:      true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			existing := &appsv1.Deployment{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:          "app-1",
+					Namespace:     "default",
+					ManagedFields: test.managedFields,
+				},
+			}
+
+			c := &applyClient{Client: fake.NewClientBuilder().WithScheme(scheme.Scheme).WithObjects(existing).Build()}
+			obj := &appsv1.Deployment{ObjectMeta: metav1.ObjectMeta{Name: "app-1", Namespace: "default"}}
+
+			err := applyObject(context.Background(), c, obj, deploymentGvk, nil, false)
+			if test.conflict != apierrors.IsConflict(err) {
+				t.Fatalf("expected conflict %v, got %v", test.conflict, err)
+			}
+
+			if !test.conflict && err != nil {
+				t.Fatalf("unexpected error %v", err)
+			}
+
+			if c.applies != test.applies {
+				t.Fatalf("expected %d applies, got %d", test.applies, c.applies)
+			}
+
+			stored := &appsv1.Deployment{}
+			if err := c.Get(context.Background(), client.ObjectKeyFromObject(obj), stored); err != nil {
+				t.Fatal(err)
+			}
+
+			for _, entry := range stored.ManagedFields {
+				if entry.Manager == FIELD_MANAGER && entry.Operation == metav1.ManagedFieldsOperationUpdate {
+					t.Fatalf("update entry of %s wasn't upgraded", FIELD_MANAGER)
+				}
+			}
+		})
+	}
+}
+
+func newTestDuplicatedDeployment(selector map[string]string) *appsv1.Deployment {
+	return &appsv1.Deployment{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "web-a",
+			Namespace: "default",
+			Labels:    map[string]string{"name": "web-a"},
+			Annotations: map[string]string{
+				DEPLOYMENT_ID_ANNOTATION_NAME:                "a",
+				ORIGINAL_DEPLOYMENT_ANNOTATION_NAME:          "default/web",
+				ORIGINAL_OBSERVED_GENERATION_ANNOTATION_NAME: "1",
+			},
+		},
+		Spec: appsv1.DeploymentSpec{
+			Selector: &metav1.LabelSelector{MatchLabels: selector},
+			Template: corev1.PodTemplateSpec{
+				ObjectMeta: metav1.ObjectMeta{Labels: selector},
+				Spec:       corev1.PodSpec{Containers: []corev1.Container{{Name: "web", Image: "web:1"}}},
+			},
+		},
+	}
+}
+
+func TestOriginalDeploymentChangedSelector(t *testing.T) {
+	tests := []struct {
+		name     string
+		selector map[string]string
+	}{
+		{
+			name:     "current selector",
+			selector: map[string]string{"name": "web-a", TENANT_LABEL_NAME: "a"},
+		},
+		{
+			name:     "selector of an older version",
+			selector: map[string]string{"name": "web-a", "web": "web-a"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			original := &appsv1.Deployment{
+				ObjectMeta: metav1.ObjectMeta{Name: "web", Namespace: "default", Labels: map[string]string{"name": "web"}},
+				Spec: appsv1.DeploymentSpec{
+					Selector: &metav1.LabelSelector{MatchLabels: map[string]string{"name": "web"}},
+					Template: corev1.PodTemplateSpec{
+						ObjectMeta: metav1.ObjectMeta{Labels: map[string]string{"name": "web"}},
+						Spec:       corev1.PodSpec{Containers: []corev1.Container{{Name: "web", Image: "web:2"}}},
+					},
+				},
+				Status: appsv1.DeploymentStatus{ObservedGeneration: 2},
+			}
+
+			c := &applyClient{Client: fake.NewClientBuilder().WithScheme(scheme.Scheme).
+				WithObjects(original, newTestDuplicatedDeployment(test.selector)).Build()}
+			r, err := New(c, "default", "web", "tenant_id", nil, nil, []string{"name"}, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			r.originalDeploymentChanged(context.Background(), *original)
+			if c.applies != 1 {
+				t.Fatalf("expected the duplicate to be applied once, got %d", c.applies)
+			}
+
+			stored := &appsv1.Deployment{}
+			if err := c.Get(context.Background(), client.ObjectKey{Namespace: "default", Name: "web-a"}, stored); err != nil {
+				t.Fatal(err)
+			}
+
+			expected := map[string]string{"name": "web-a", TENANT_LABEL_NAME: "a"}
+			if !equality.Semantic.DeepEqual(stored.Spec.Selector.MatchLabels, expected) {
+				t.Fatalf("expected selector %v, got %v", expected, stored.Spec.Selector.MatchLabels)
+			}
+		})
+	}
+}
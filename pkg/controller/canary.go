@@ -0,0 +1,278 @@
+package controller
+
+import (
+	"context"
+	"dvdlevanon/kubernetes-database-scaler/pkg/logs"
+	"fmt"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	ctrl "sigs.k8s.io/controller-runtime"
+)
+
+const CANARY_CHECK_INTERVAL = 10 * time.Second
+
+const (
+	REASON_CANARY_STARTED     = "CanaryStarted"
+	REASON_CANARY_PROMOTED    = "CanaryPromoted"
+	REASON_CANARY_HALTED      = "CanaryHalted"
+	REASON_CANARY_ROLLED_BACK = "CanaryRolledBack"
+)
+
+// canaryPolicy rolls a change of the original deployment out to the canary duplicates first,
+//
+//	the others are updated once all the canaries were available for bakeTime. A rollout whose
+//	canaries fail, or aren't available within timeout, is halted until the next change.
+type canaryPolicy struct {
+	column   string
+	selector labels.Selector
+	bakeTime time.Duration
+	timeout  time.Duration
+	rollback bool
+
+	// previous is the last original deployment rolled out to all the duplicates, and the state
+	//	of the rollout in progress. Reconciles of a controller don't run concurrently.
+	//
+	previous       *appsv1.Deployment
+	generation     string
+	startedAt      time.Time
+	availableSince time.Time
+	halted         bool
+
+	// lastGood is the original new duplicates are created from while the rollout is halted, the
+	//	rows are delivered apart from the reconciles so it's read atomically.
+	//
+	lastGood atomic.Pointer[appsv1.Deployment]
+}
+
+// SetCanaryPolicy takes a row column marking canary tenants with a true value, and/or a label
+//
+//	selector of canary duplicates, the canary rollout is disabled when both are empty.
+func (r *DeploymentReconciler) SetCanaryPolicy(column string, selector string,
+	bakeTime time.Duration, timeout time.Duration, rollback bool) error {
+
+	if column == "" && selector == "" {
+		r.canary = nil
+		return nil
+	}
+
+	var parsedSelector labels.Selector
+	if selector != "" {
+		var err error
+		parsedSelector, err = labels.Parse(selector)
+		if err != nil {
+			return fmt.Errorf("invalid canary selector %s %s", selector, err)
+		}
+	}
+
+	if timeout <= 0 {
+		return fmt.Errorf("canary timeout must be positive")
+	}
+
+	r.canary = &canaryPolicy{
+		column:   column,
+		selector: parsedSelector,
+		bakeTime: bakeTime,
+		timeout:  timeout,
+		rollback: rollback,
+	}
+
+	return nil
+}
+
+func (r *DeploymentReconciler) isCanary(deployment appsv1.Deployment) bool {
+	if r.canary.selector != nil && r.canary.selector.Matches(labels.Set(deployment.Labels)) {
+		return true
+	}
+
+	if r.canary.column == "" {
+		return false
+	}
+
+	row, ok := r.getRow(deployment.Annotations[DEPLOYMENT_ID_ANNOTATION_NAME])
+	if !ok {
+		return false
+	}
+
+	canary, err := strconv.ParseBool(row[r.canary.column])
+	return err == nil && canary
+}
+
+func isOutdated(deployments []appsv1.Deployment, generation string) bool {
+	for _, deployment := range deployments {
+		if deployment.Annotations[ORIGINAL_OBSERVED_GENERATION_ANNOTATION_NAME] != generation {
+			return true
+		}
+	}
+
+	return false
+}
+
+// rolloutCanary returns the duplicates that may be updated to generation now, and when to
+//
+//	check the canaries again.
+func (r *DeploymentReconciler) rolloutCanary(ctx context.Context, original *appsv1.Deployment,
+	deployments []appsv1.Deployment, generation string) ([]appsv1.Deployment, ctrl.Result) {
+
+	if !isOutdated(deployments, generation) {
+		if r.canary.previous == nil || r.canary.generation != "" {
+			r.log(logs.OPERATION_CANARY).Infof("All duplicates of %s are on generation %s", r.deploymentName, generation)
+		}
+
+		r.canary.previous = original.DeepCopy()
+		r.canary.generation = ""
+		r.canary.lastGood.Store(nil)
+		return nil, ctrl.Result{}
+	}
+
+	canaries := make([]appsv1.Deployment, 0)
+	for _, deployment := range deployments {
+		if r.isCanary(deployment) {
+			canaries = append(canaries, deployment)
+		}
+	}
+
+	if len(canaries) == 0 {
+		r.log(logs.OPERATION_CANARY).Warningf("No canary duplicates of %s, updating all of them", r.deploymentName)
+		return deployments, ctrl.Result{}
+	}
+
+	if r.canary.generation != generation {
+		r.canary.generation = generation
+		r.canary.startedAt = time.Now()
+		r.canary.availableSince = time.Time{}
+		r.canary.halted = false
+		r.canary.lastGood.Store(nil)
+
+		r.log(logs.OPERATION_CANARY).Infof("Rolling out generation %s of %s to %d canaries", generation, r.deploymentName, len(canaries))
+		recordEvent(r.recorder, original, corev1.EventTypeNormal, REASON_CANARY_STARTED,
+			"Rolling out generation %s to %d canaries", generation, len(canaries))
+	}
+
+	if r.canary.halted {
+		return nil, ctrl.Result{}
+	}
+
+	if isOutdated(canaries, generation) {
+		return canaries, ctrl.Result{RequeueAfter: CANARY_CHECK_INTERVAL}
+	}
+
+	status := getCanariesStatus(canaries)
+	if status == STATUS_FAILED || (status != STATUS_AVAILABLE && time.Since(r.canary.startedAt) > r.canary.timeout) {
+		r.haltCanary(ctx, original, canaries, generation)
+		return nil, ctrl.Result{}
+	}
+
+	if status != STATUS_AVAILABLE {
+		r.canary.availableSince = time.Time{}
+		return nil, ctrl.Result{RequeueAfter: CANARY_CHECK_INTERVAL}
+	}
+
+	if r.canary.availableSince.IsZero() {
+		r.canary.availableSince = time.Now()
+	}
+
+	if baked := time.Since(r.canary.availableSince); baked < r.canary.bakeTime {
+		wait := r.canary.bakeTime - baked
+		if wait > CANARY_CHECK_INTERVAL {
+			wait = CANARY_CHECK_INTERVAL
+		}
+
+		return nil, ctrl.Result{RequeueAfter: wait}
+	}
+
+	r.log(logs.OPERATION_CANARY).Infof("Canaries of %s are available on generation %s, updating the rest", r.deploymentName, generation)
+	recordEvent(r.recorder, original, corev1.EventTypeNormal, REASON_CANARY_PROMOTED,
+		"Canaries are available on generation %s for %s, updating the rest", generation, r.canary.bakeTime)
+	return deployments, ctrl.Result{}
+}
+
+// getCanariesStatus is Failed if any canary failed, Available if all of them are available
+func getCanariesStatus(canaries []appsv1.Deployment) string {
+	result := STATUS_AVAILABLE
+	for i := range canaries {
+		switch getDeploymentStatus(&canaries[i]) {
+		case STATUS_FAILED:
+			return STATUS_FAILED
+		case STATUS_AVAILABLE:
+		default:
+			result = STATUS_PROGRESSING
+		}
+	}
+
+	return result
+}
+
+func (r *DeploymentReconciler) haltCanary(ctx context.Context, original *appsv1.Deployment,
+	canaries []appsv1.Deployment, generation string) {
+
+	r.canary.halted = true
+	r.log(logs.OPERATION_CANARY).Warningf("Canaries of %s failed on generation %s, halting the rollout", r.deploymentName, generation)
+	recordEvent(r.recorder, original, corev1.EventTypeWarning, REASON_CANARY_HALTED,
+		"Halted the rollout of generation %s, canaries failed to become available", generation)
+
+	// The previous generation is known once a rollout completed since startup, otherwise
+	//	it's looked up in the stored versions of the original.
+	//
+	if r.canary.previous == nil && r.templates != nil {
+		previous, err := r.templates.Previous(ctx, r.deploymentNamespace, r.deploymentName, generation)
+		if err != nil {
+			r.log(logs.OPERATION_CANARY).Errorf("Unable to load the previous version of %s %s", r.deploymentName, err)
+		}
+
+		r.canary.previous = previous
+	}
+
+	if r.canary.previous == nil {
+		r.log(logs.OPERATION_CANARY).Warningf("No previous generation of %s to create new duplicates from, or roll the canaries back to", r.deploymentName)
+		return
+	}
+
+	r.canary.lastGood.Store(r.canary.previous)
+	if !r.canary.rollback {
+		return
+	}
+
+	previousGeneration := fmt.Sprintf("%d", r.canary.previous.Status.ObservedGeneration)
+	for _, canary := range canaries {
+		environmentMap, err := r.getEnvironmentMap(canary)
+		if err != nil {
+			r.duplicateLog(logs.OPERATION_CANARY, canary).Errorf("Unable to build envrionment map of canary %s %s", canary.Name, err)
+			continue
+		}
+
+		nameSuffix := canary.Annotations[DEPLOYMENT_ID_ANNOTATION_NAME]
+		rolledBack := r.duplicateDeployment(r.canary.previous, nameSuffix, environmentMap, canary.Namespace)
+		if err := r.applyDuplicate(ctx, rolledBack, &canary, false); err != nil {
+			r.duplicateLog(logs.OPERATION_CANARY, canary).Errorf("Unable to roll back canary %s %s", canary.Name, err)
+			recordApplyError(r.recorder, &canary, err,
+				"Unable to roll back to generation %s: %s", previousGeneration, err)
+			continue
+		}
+
+		recordEvent(r.recorder, &canary, corev1.EventTypeWarning, REASON_CANARY_ROLLED_BACK,
+			"Rolled back to generation %s of %s", previousGeneration, r.deploymentName)
+	}
+}
+
+// creationTemplate is the original a new duplicate is rendered from, the last good generation
+//
+//	while a canary rollout is halted, so new tenants don't start on the failing one.
+func (r *DeploymentReconciler) creationTemplate(orig *appsv1.Deployment, nameSuffix string) *appsv1.Deployment {
+	if r.canary == nil {
+		return orig
+	}
+
+	lastGood := r.canary.lastGood.Load()
+	if lastGood == nil {
+		return orig
+	}
+
+	r.tenantLog(logs.OPERATION_CREATE, nameSuffix).Infof("Rollout of %s is halted, creating %s from generation %d",
+		r.deploymentName, nameSuffix, lastGood.Status.ObservedGeneration)
+	return lastGood
+}
@@ -0,0 +1,129 @@
+package controller
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/scheme"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+func newTestDeploymentReconciler(t *testing.T) *DeploymentReconciler {
+	original := &appsv1.Deployment{ObjectMeta: v1.ObjectMeta{Name: "web", Namespace: "default"}}
+	c := fake.NewClientBuilder().WithScheme(scheme.Scheme).WithObjects(original).Build()
+
+	r, err := New(c, "default", "web", "tenant_id", nil, nil, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return r
+}
+
+func TestOriginalDeploymentChangedWaitsForRows(t *testing.T) {
+	tests := []struct {
+		name           string
+		canaryColumn   string
+		canarySelector string
+		rowsReady      bool
+		requeue        bool
+	}{
+		{name: "no canary"},
+		{name: "canary column before the rows", canaryColumn: "canary", requeue: true},
+		{name: "canary column after the rows", canaryColumn: "canary", rowsReady: true},
+		{name: "canary selector before the rows", canarySelector: "track=canary"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			r := newTestDeploymentReconciler(t)
+			if err := r.SetCanaryPolicy(test.canaryColumn, test.canarySelector, 0, time.Minute, false); err != nil {
+				t.Fatal(err)
+			}
+
+			if test.rowsReady {
+				r.OnRowsReady()
+			}
+
+			original := appsv1.Deployment{ObjectMeta: v1.ObjectMeta{Name: "web", Namespace: "default"}}
+			result := r.originalDeploymentChanged(context.Background(), original)
+			if test.requeue != (result.RequeueAfter == ROWS_READY_CHECK_INTERVAL) {
+				t.Fatalf("expected requeue %v, got %v", test.requeue, result)
+			}
+		})
+	}
+}
+
+func TestCreateDeploymentWhileHalted(t *testing.T) {
+	tests := []struct {
+		name     string
+		halted   bool
+		previous bool
+		promoted bool
+		image    string
+	}{
+		{name: "rolling out", image: "web:3"},
+		{name: "halted", halted: true, previous: true, image: "web:2"},
+		{name: "halted without a previous generation", halted: true, image: "web:3"},
+		{name: "halted then promoted", halted: true, previous: true, promoted: true, image: "web:3"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			original := &appsv1.Deployment{
+				ObjectMeta: v1.ObjectMeta{Name: "web", Namespace: "default", Generation: 3},
+				Spec: appsv1.DeploymentSpec{
+					Selector: &v1.LabelSelector{MatchLabels: map[string]string{"name": "web"}},
+					Template: corev1.PodTemplateSpec{
+						ObjectMeta: v1.ObjectMeta{Labels: map[string]string{"name": "web"}},
+						Spec:       corev1.PodSpec{Containers: []corev1.Container{{Name: "web", Image: "web:3"}}},
+					},
+				},
+				Status: appsv1.DeploymentStatus{ObservedGeneration: 3},
+			}
+
+			c := &applyClient{Client: fake.NewClientBuilder().WithScheme(scheme.Scheme).WithObjects(original).Build()}
+			r, err := New(c, "default", "web", "tenant_id", nil, nil, []string{"name"}, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if err := r.SetCanaryPolicy("", "track=canary", 0, time.Minute, false); err != nil {
+				t.Fatal(err)
+			}
+
+			if test.previous {
+				previous := original.DeepCopy()
+				previous.Status.ObservedGeneration = 2
+				previous.Spec.Template.Spec.Containers[0].Image = "web:2"
+				r.canary.previous = previous
+			}
+
+			if test.halted {
+				r.haltCanary(context.Background(), original, nil, "3")
+			}
+
+			if test.promoted {
+				r.rolloutCanary(context.Background(), original, nil, "3")
+			}
+
+			if _, err := r.createDeployment("b", map[string]string{}, "default", ""); err != nil {
+				t.Fatal(err)
+			}
+
+			created := appsv1.Deployment{}
+			if err := runtime.DefaultUnstructuredConverter.FromUnstructured(c.applied.Object, &created); err != nil {
+				t.Fatal(err)
+			}
+
+			if image := created.Spec.Template.Spec.Containers[0].Image; image != test.image {
+				t.Fatalf("expected image %s, got %s", test.image, image)
+			}
+		})
+	}
+}
@@ -0,0 +1,86 @@
+package controller
+
+import (
+	"context"
+	"dvdlevanon/kubernetes-database-scaler/pkg/tablewatch"
+	"fmt"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// ConfigMapCheckpointStore keeps the replication checkpoints as keys of a single ConfigMap,
+//
+//	it's read directly from the api server so ConfigMaps aren't cached.
+type ConfigMapCheckpointStore struct {
+	client    client.Client
+	reader    client.Reader
+	namespace string
+	name      string
+}
+
+var _ tablewatch.CheckpointStore = (*ConfigMapCheckpointStore)(nil)
+
+func NewConfigMapCheckpointStore(client client.Client, reader client.Reader,
+	namespace string, name string) (*ConfigMapCheckpointStore, error) {
+
+	if namespace == "" {
+		return nil, fmt.Errorf("checkpoint namespace is empty")
+	}
+
+	if name == "" {
+		return nil, fmt.Errorf("checkpoint config map name is empty")
+	}
+
+	return &ConfigMapCheckpointStore{
+		client:    client,
+		reader:    reader,
+		namespace: namespace,
+		name:      name,
+	}, nil
+}
+
+func (s *ConfigMapCheckpointStore) Load(ctx context.Context, name string) (string, error) {
+	configMap := corev1.ConfigMap{}
+	err := s.reader.Get(ctx, types.NamespacedName{Namespace: s.namespace, Name: s.name}, &configMap)
+	if apierrors.IsNotFound(err) {
+		return "", nil
+	}
+
+	if err != nil {
+		return "", err
+	}
+
+	return configMap.Data[name], nil
+}
+
+func (s *ConfigMapCheckpointStore) Save(ctx context.Context, name string, checkpoint string) error {
+	configMap := corev1.ConfigMap{}
+	err := s.reader.Get(ctx, types.NamespacedName{Namespace: s.namespace, Name: s.name}, &configMap)
+	if apierrors.IsNotFound(err) {
+		configMap = corev1.ConfigMap{
+			ObjectMeta: v1.ObjectMeta{
+				Namespace: s.namespace,
+				Name:      s.name,
+				Labels:    map[string]string{MANAGED_BY_LABEL_NAME: MANAGED_BY_LABEL_VALUE},
+			},
+			Data: map[string]string{name: checkpoint},
+		}
+
+		return s.client.Create(ctx, &configMap)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	if configMap.Data == nil {
+		configMap.Data = make(map[string]string)
+	}
+
+	configMap.Data[name] = checkpoint
+	return s.client.Update(ctx, &configMap)
+}
@@ -3,17 +3,23 @@ package controller
 import (
 	"context"
 	"dvdlevanon/kubernetes-database-scaler/pkg/cleaner"
+	"dvdlevanon/kubernetes-database-scaler/pkg/logs"
 	"dvdlevanon/kubernetes-database-scaler/pkg/tablewatch"
 	"fmt"
+	"net/http"
+	"sort"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
-	"github.com/op/go-logging"
 	appsv1 "k8s.io/api/apps/v1"
 	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
 	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/record"
 	ctrl "sigs.k8s.io/controller-runtime"
 	"sigs.k8s.io/controller-runtime/pkg/client"
 	"sigs.k8s.io/controller-runtime/pkg/log"
@@ -21,8 +27,12 @@ import (
 
 const DEPLOYMENT_ID_ANNOTATION_NAME = "kubernetes-database-scaler/deployment-id"
 const ORIGINAL_OBSERVED_GENERATION_ANNOTATION_NAME = "kubernetes-database-scaler/original-observed-generation"
+const ORIGINAL_DEPLOYMENT_ANNOTATION_NAME = "kubernetes-database-scaler/original-deployment"
+const TENANT_LABEL_NAME = "kubernetes-database-scaler/tenant"
 
-var logger = logging.MustGetLogger("controller")
+const ROWS_READY_CHECK_INTERVAL = 5 * time.Second
+
+var logger = logs.MustGetLogger("controller")
 
 type DeploymentReconciler struct {
 	client.Client
@@ -31,7 +41,23 @@ type DeploymentReconciler struct {
 	deploymentColumnName      string
 	environmentsDefinitionMap map[string]string
 	excludeLabels             []string
+	identityLabels            []string
 	removeDeploys             <-chan string
+	statusTracker             *statusTracker
+	recorder                  record.EventRecorder
+	initialized               atomic.Bool
+	rowsReady                 atomic.Bool
+	namespaces                *NamespaceManager
+	throttle                  *Throttle
+	priority                  *Priority
+	canary                    *canaryPolicy
+	templates                 *TemplateStore
+	pinnedVersionColumn       string
+	overrides                 *Overrides
+	driftMode                 string
+	ignoredFields             []string
+	rowsLock                  sync.Mutex
+	rows                      map[string]tablewatch.Row
 }
 
 func buildEnvironmentDefinitionMap(environments []string) (map[string]string, error) {
@@ -49,7 +75,8 @@ func buildEnvironmentDefinitionMap(environments []string) (map[string]string, er
 }
 
 func New(client client.Client, deploymentNamespace string, deploymentName string,
-	deploymentColumnName string, environments []string, excludeLabels []string, removeDeploys <-chan string) (*DeploymentReconciler, error) {
+	deploymentColumnName string, environments []string, excludeLabels []string, identityLabels []string,
+	removeDeploys <-chan string) (*DeploymentReconciler, error) {
 
 	if deploymentName == "" {
 		return nil, fmt.Errorf("deployment name is empty")
@@ -75,7 +102,9 @@ func New(client client.Client, deploymentNamespace string, deploymentName string
 		deploymentColumnName:      deploymentColumnName,
 		environmentsDefinitionMap: environmentsDefinitionMap,
 		excludeLabels:             excludeLabels,
+		identityLabels:            identityLabels,
 		removeDeploys:             removeDeploys,
+		rows:                      make(map[string]tablewatch.Row),
 	}, nil
 }
 
@@ -83,37 +112,132 @@ func (r *DeploymentReconciler) Reconcile(ctx context.Context, req ctrl.Request)
 	_ = log.FromContext(ctx)
 
 	if req.Namespace == r.deploymentNamespace && req.Name == r.deploymentName {
-		r.reconcileDeployment(ctx, req)
+		return r.reconcileDeployment(ctx, req), nil
+	}
+
+	if r.statusTracker != nil || r.isDriftDetectionEnabled() {
+		r.reconcileDuplicatedDeployment(ctx, req)
 	}
 
 	return ctrl.Result{}, nil
 }
 
-func (r *DeploymentReconciler) reconcileDeployment(ctx context.Context, req ctrl.Request) {
+func (r *DeploymentReconciler) reconcileDuplicatedDeployment(ctx context.Context, req ctrl.Request) {
+	deployment := appsv1.Deployment{}
+	if err := r.Get(ctx, req.NamespacedName, &deployment); err != nil {
+		if !apierrors.IsNotFound(err) {
+			r.log(logs.OPERATION_RECONCILE).WithDeployment(req.Name).Errorf("Unable to get deployment %v upon reconciling %s", req.NamespacedName, err)
+		}
+		return
+	}
+
+	if !r.isDuplicatedDeployment(deployment) {
+		return
+	}
+
+	r.duplicatedDeploymentChanged(ctx, deployment)
+	r.detectDrift(ctx, deployment)
+}
+
+// Several original deployments may be duplicated into the same namespace, so a duplicate
+//
+//	belongs to this reconciler only if it was created from r.deploymentName.
+func (r *DeploymentReconciler) isDuplicatedDeployment(deployment appsv1.Deployment) bool {
+	deploymentId, ok := deployment.Annotations[DEPLOYMENT_ID_ANNOTATION_NAME]
+	if !ok {
+		return false
+	}
+
+	if original, ok := deployment.Annotations[ORIGINAL_DEPLOYMENT_ANNOTATION_NAME]; ok {
+		return original == r.originalKey() ||
+			(original == r.deploymentName && deployment.Namespace == r.deploymentNamespace)
+	}
+
+	// Duplicates created before the original deployment annotation was introduced
+	//
+	return deployment.Namespace == r.deploymentNamespace &&
+		deployment.Name == buildDeploymentName(r.deploymentName, deploymentId)
+}
+
+func (r *DeploymentReconciler) originalKey() string {
+	return fmt.Sprintf("%s/%s", r.deploymentNamespace, r.deploymentName)
+}
+
+func (r *DeploymentReconciler) managedKey(deploymentSuffix string) string {
+	return buildManagedKey(r.deploymentNamespace, r.deploymentName, deploymentSuffix)
+}
+
+// log is the logger of lines about the original deployment
+func (r *DeploymentReconciler) log(operation string) *logs.Logger {
+	return logger.WithDeployment(r.deploymentName).WithOperation(operation)
+}
+
+// tenantLog is the logger of lines about the duplicate of a tenant
+func (r *DeploymentReconciler) tenantLog(operation string, deploymentSuffix string) *logs.Logger {
+	return logger.WithTenant(deploymentSuffix).
+		WithDeployment(buildDeploymentName(r.deploymentName, deploymentSuffix)).
+		WithOperation(operation)
+}
+
+// duplicateLog is the logger of lines about an existing duplicate
+func (r *DeploymentReconciler) duplicateLog(operation string, deployment appsv1.Deployment) *logs.Logger {
+	return r.tenantLog(operation, deployment.Annotations[DEPLOYMENT_ID_ANNOTATION_NAME])
+}
+
+func (r *DeploymentReconciler) reconcileDeployment(ctx context.Context, req ctrl.Request) ctrl.Result {
 	deployment := appsv1.Deployment{}
 	err := r.Get(ctx, req.NamespacedName, &deployment)
 	if err == nil {
-		r.originalDeploymentChanged(ctx, deployment)
+		return r.originalDeploymentChanged(ctx, deployment)
 	} else if apierrors.IsNotFound(err) {
 		r.originalDeploymentDeleted(ctx)
 	} else {
-		logger.Errorf("Unable to get deployment upon reconciling %s", err)
+		r.log(logs.OPERATION_RECONCILE).Errorf("Unable to get deployment upon reconciling %s", err)
 	}
+
+	return ctrl.Result{}
 }
 
-func (r *DeploymentReconciler) originalDeploymentChanged(ctx context.Context, original appsv1.Deployment) error {
+// originalDeploymentChanged updates the duplicates of an older generation, the result asks
+//
+//	to check a canary rollout in progress again.
+func (r *DeploymentReconciler) originalDeploymentChanged(ctx context.Context, original appsv1.Deployment) ctrl.Result {
+	// Until every source delivered its rows, the rows of most duplicates aren't known yet
+	//
+	if r.needsRows() && !r.rowsReady.Load() {
+		r.log(logs.OPERATION_UPDATE).Infof("Waiting for the rows of every source before updating the duplicates of %s", r.deploymentName)
+		return ctrl.Result{RequeueAfter: ROWS_READY_CHECK_INTERVAL}
+	}
+
 	deployments, err := r.listDuplicatedDeployments(ctx)
 	if err != nil {
-		return err
+		return ctrl.Result{}
+	}
+
+	if r.templates != nil {
+		if err := r.templates.Save(ctx, &original); err != nil {
+			r.log(logs.OPERATION_TEMPLATE).Errorf("Unable to store version %s of %s %s", getTemplateVersion(&original), r.deploymentName, err)
+		}
+	}
+
+	deployments, pinned := r.splitPinnedDeployments(deployments)
+	for _, deployment := range pinned {
+		r.updatePinnedDeployment(ctx, deployment, r.getPinnedVersion(deployment))
 	}
 
 	actualObservedGeneration := fmt.Sprintf("%d", original.Status.ObservedGeneration)
-	logger.Infof("Original deployment may changed (generation %s), updating %d duplicated deployments",
+	result := ctrl.Result{}
+	if r.canary != nil {
+		deployments, result = r.rolloutCanary(ctx, &original, deployments, actualObservedGeneration)
+	}
+
+	r.log(logs.OPERATION_UPDATE).Infof("Original deployment may changed (generation %s), updating %d duplicated deployments",
 		actualObservedGeneration, len(deployments))
-	for _, deployment := range deployments {
+	for _, deployment := range r.sortDeployments(deployments) {
+		nameSuffix := deployment.Annotations[DEPLOYMENT_ID_ANNOTATION_NAME]
 		origObserevedGeneration, ok := deployment.Annotations[ORIGINAL_OBSERVED_GENERATION_ANNOTATION_NAME]
 		if !ok {
-			logger.Errorf("Error getting original observed generation annotation from %v", deployment)
+			r.tenantLog(logs.OPERATION_UPDATE, nameSuffix).Errorf("Error getting original observed generation annotation from %v", deployment)
 			continue
 		}
 
@@ -121,27 +245,70 @@ func (r *DeploymentReconciler) originalDeploymentChanged(ctx context.Context, or
 			continue
 		}
 
-		if err := r.Delete(ctx, &deployment); err != nil {
-			logger.Errorf("Unable to remove deployment %s", err)
+		environmentMap, err := r.getEnvironmentMap(deployment)
+		if err != nil {
+			r.tenantLog(logs.OPERATION_UPDATE, nameSuffix).Errorf("Unable to build envrionment map from deployment %s", err)
+			recordEvent(r.recorder, &original, corev1.EventTypeWarning, REASON_ROW_SKIPPED,
+				"Unable to update duplicate %s: %s", deployment.Name, err)
 			continue
 		}
 
-		nameSuffix, ok := deployment.Annotations[DEPLOYMENT_ID_ANNOTATION_NAME]
-		if !ok {
-			logger.Errorf("Unable to get name suffix annotation from %v", deployment)
+		new := r.duplicateDeployment(&original, nameSuffix, environmentMap, deployment.Namespace)
+		if err := r.applyDuplicate(ctx, new, &deployment, false); err != nil {
+			r.tenantLog(logs.OPERATION_UPDATE, nameSuffix).Errorf("Unable to update deployment %s %s", deployment.Name, err)
+			recordApplyError(r.recorder, &deployment, err,
+				"Unable to update from %s generation %s: %s", r.deploymentName, actualObservedGeneration, err)
 			continue
 		}
 
-		environmentMap, err := r.buildEnvironmentMapFromDeployment(deployment)
-		if err != nil {
-			logger.Errorf("Unable to build envrionment map from deployment %s", err)
-			continue
-		}
+		recordEvent(r.recorder, &original, corev1.EventTypeNormal, REASON_DUPLICATE_UPDATED,
+			"Updated duplicate %s to generation %s", new.Name, actualObservedGeneration)
+		recordEvent(r.recorder, new, corev1.EventTypeNormal, REASON_DUPLICATE_UPDATED,
+			"Updated from %s generation %s", r.deploymentName, actualObservedGeneration)
+	}
+
+	return result
+}
 
-		r.createDeployment(nameSuffix, environmentMap)
+// sortDeployments orders the duplicates by the priority of their rows, duplicates whose row
+//
+//	isn't known come last. The duplicates aren't updated before the rows of every source were seen.
+func (r *DeploymentReconciler) sortDeployments(deployments []appsv1.Deployment) []appsv1.Deployment {
+	if r.priority == nil {
+		return deployments
 	}
 
-	return nil
+	rows := make([]tablewatch.Row, len(deployments))
+	for i, deployment := range deployments {
+		rows[i], _ = r.getRow(deployment.Annotations[DEPLOYMENT_ID_ANNOTATION_NAME])
+	}
+
+	order := make([]int, len(deployments))
+	for i := range order {
+		order[i] = i
+	}
+
+	sort.SliceStable(order, func(i, j int) bool {
+		return r.priority.less(rows[order[i]], rows[order[j]])
+	})
+
+	result := make([]appsv1.Deployment, 0, len(deployments))
+	for _, i := range order {
+		result = append(result, deployments[i])
+	}
+
+	return result
+}
+
+// getEnvironmentMap prefers the last row seen in the database, and falls back to the
+//
+//	values set on the deployment when the row wasn't seen yet since startup.
+func (r *DeploymentReconciler) getEnvironmentMap(deployment appsv1.Deployment) (map[string]string, error) {
+	if row, ok := r.getRow(deployment.Annotations[DEPLOYMENT_ID_ANNOTATION_NAME]); ok {
+		return r.buildEnvironmentMapFromRow(row)
+	}
+
+	return r.buildEnvironmentMapFromDeployment(deployment)
 }
 
 func (r *DeploymentReconciler) originalDeploymentDeleted(ctx context.Context) {
@@ -150,27 +317,34 @@ func (r *DeploymentReconciler) originalDeploymentDeleted(ctx context.Context) {
 		return
 	}
 
-	logger.Infof("Original deployment deleted, removing %d duplicated deployments", len(deployments))
+	r.log(logs.OPERATION_REMOVE).Infof("Original deployment deleted, removing %d duplicated deployments", len(deployments))
 
 	for _, deployment := range deployments {
 		if err := r.Delete(ctx, &deployment); err != nil {
-			logger.Errorf("Error removing deployment %s", err)
+			r.tenantLog(logs.OPERATION_REMOVE, deployment.Annotations[DEPLOYMENT_ID_ANNOTATION_NAME]).Errorf("Error removing deployment %s", err)
+			recordEvent(r.recorder, &deployment, corev1.EventTypeWarning, REASON_DELETE_FAILED,
+				"Unable to remove duplicate after %s was deleted: %s", r.deploymentName, err)
 			continue
 		}
+
+		r.throttle.release(r.managedKey(deployment.Annotations[DEPLOYMENT_ID_ANNOTATION_NAME]))
+
+		recordEvent(r.recorder, &deployment, corev1.EventTypeNormal, REASON_DUPLICATE_DELETED,
+			"Removed since %s was deleted", r.deploymentName)
 	}
 }
 
 func (r *DeploymentReconciler) listDuplicatedDeployments(ctx context.Context) ([]appsv1.Deployment, error) {
 	deployments := appsv1.DeploymentList{}
-	err := r.List(ctx, &deployments, client.InNamespace(r.deploymentNamespace))
+	err := r.List(ctx, &deployments, r.namespaces.ListOptions(r.deploymentNamespace)...)
 	if err != nil {
-		logger.Errorf("Error getting duplicated deployments %s", err)
+		r.log(logs.OPERATION_RECONCILE).Errorf("Error getting duplicated deployments %s", err)
 		return nil, err
 	}
 
 	result := make([]appsv1.Deployment, 0)
 	for _, deployment := range deployments.Items {
-		if _, ok := deployment.Annotations[DEPLOYMENT_ID_ANNOTATION_NAME]; ok {
+		if r.isDuplicatedDeployment(deployment) {
 			result = append(result, deployment)
 		}
 	}
@@ -178,6 +352,21 @@ func (r *DeploymentReconciler) listDuplicatedDeployments(ctx context.Context) ([
 	return result, nil
 }
 
+func (r *DeploymentReconciler) findDuplicatedDeployment(ctx context.Context, deploymentSuffix string) (*appsv1.Deployment, error) {
+	deployments, err := r.listDuplicatedDeployments(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, deployment := range deployments {
+		if deployment.Annotations[DEPLOYMENT_ID_ANNOTATION_NAME] == deploymentSuffix {
+			return &deployment, nil
+		}
+	}
+
+	return nil, nil
+}
+
 func buildDeploymentName(deploymentName string, deploymentSuffix string) string {
 	return fmt.Sprintf("%s-%s", deploymentName, deploymentSuffix)
 }
@@ -190,7 +379,7 @@ func (r *DeploymentReconciler) getExistingDeployment() (*appsv1.Deployment, erro
 
 	deployment := appsv1.Deployment{}
 	if err := r.Get(context.Background(), key, &deployment); err != nil {
-		logger.Errorf("Unable to get original deployment %v %s", key, err)
+		r.log(logs.OPERATION_RECONCILE).Errorf("Unable to get original deployment %v %s", key, err)
 		return nil, err
 	}
 
@@ -216,66 +405,163 @@ func (r *DeploymentReconciler) replaceOrAddEnv(envs []corev1.EnvVar, name string
 }
 
 func (r *DeploymentReconciler) duplicateDeployment(orig *appsv1.Deployment,
-	nameSuffix string, environmentsMap map[string]string) *appsv1.Deployment {
+	nameSuffix string, environmentsMap map[string]string, namespace string) *appsv1.Deployment {
 	new := orig.DeepCopy()
+	newName := buildDeploymentName(r.deploymentName, nameSuffix)
+
+	labels := make(map[string]string)
+	for key, value := range orig.ObjectMeta.Labels {
+		labels[key] = value
+	}
 
 	for _, key := range r.excludeLabels {
-		delete(orig.ObjectMeta.Labels, key)
+		delete(labels, key)
+	}
+
+	annotations := make(map[string]string)
+	for key, value := range orig.ObjectMeta.Annotations {
+		annotations[key] = value
 	}
 
 	new.Status = appsv1.DeploymentStatus{}
 	new.ObjectMeta = v1.ObjectMeta{
-		Name:                       buildDeploymentName(r.deploymentName, nameSuffix),
-		Namespace:                  orig.ObjectMeta.Namespace,
-		Annotations:                orig.ObjectMeta.Annotations,
-		Labels:                     orig.ObjectMeta.Labels,
+		Name:                       newName,
+		Namespace:                  namespace,
+		Annotations:                annotations,
+		Labels:                     labels,
 		DeletionGracePeriodSeconds: orig.ObjectMeta.DeletionGracePeriodSeconds,
 	}
 
 	new.ObjectMeta.Annotations[ORIGINAL_OBSERVED_GENERATION_ANNOTATION_NAME] =
 		fmt.Sprintf("%d", orig.Status.ObservedGeneration)
+	new.ObjectMeta.Annotations[TEMPLATE_VERSION_ANNOTATION_NAME] = getTemplateVersion(orig)
 	new.ObjectMeta.Annotations[DEPLOYMENT_ID_ANNOTATION_NAME] = nameSuffix
+	new.ObjectMeta.Annotations[ORIGINAL_DEPLOYMENT_ANNOTATION_NAME] = r.originalKey()
 
-	for key, value := range new.Spec.Selector.MatchLabels {
-		if key == "name" && value == orig.ObjectMeta.Name {
-			new.Spec.Selector.MatchLabels[value] = buildDeploymentName(r.deploymentName, nameSuffix)
-		}
+	r.rewriteIdentityLabels(new, newName, nameSuffix)
+
+	// Sorted so rendering the same row twice gives the same spec
+	//
+	names := make([]string, 0, len(environmentsMap))
+	for name := range environmentsMap {
+		names = append(names, name)
 	}
+	sort.Strings(names)
 
-	for key, value := range new.Spec.Template.ObjectMeta.Labels {
-		if key == "name" && value == orig.ObjectMeta.Name {
-			new.Spec.Template.ObjectMeta.Labels[value] = buildDeploymentName(r.deploymentName, nameSuffix)
+	for i := range new.Spec.Template.Spec.Containers {
+		for _, name := range names {
+			new.Spec.Template.Spec.Containers[i].Env = r.replaceOrAddEnv(new.Spec.Template.Spec.Containers[i].Env, name, environmentsMap[name])
 		}
 	}
 
-	for i := range new.Spec.Template.Spec.Containers {
-		for name, value := range environmentsMap {
-			new.Spec.Template.Spec.Containers[i].Env = r.replaceOrAddEnv(new.Spec.Template.Spec.Containers[i].Env, name, value)
+	return r.applyOverrides(new, nameSuffix)
+}
+
+// rewriteIdentityLabels makes sure the selector of a duplicate matches only its own pods,
+//
+//	the identity labels are set to the duplicate name and every object is labeled with its tenant.
+func (r *DeploymentReconciler) rewriteIdentityLabels(new *appsv1.Deployment, newName string, nameSuffix string) {
+	if new.Spec.Selector == nil {
+		new.Spec.Selector = &v1.LabelSelector{}
+	}
+
+	if new.Spec.Selector.MatchLabels == nil {
+		new.Spec.Selector.MatchLabels = make(map[string]string)
+	}
+
+	if new.Spec.Template.ObjectMeta.Labels == nil {
+		new.Spec.Template.ObjectMeta.Labels = make(map[string]string)
+	}
+
+	for _, key := range r.identityLabels {
+		if _, ok := new.ObjectMeta.Labels[key]; ok {
+			new.ObjectMeta.Labels[key] = newName
+		}
+
+		if _, ok := new.Spec.Selector.MatchLabels[key]; ok {
+			new.Spec.Selector.MatchLabels[key] = newName
+		}
+
+		if _, ok := new.Spec.Template.ObjectMeta.Labels[key]; ok {
+			new.Spec.Template.ObjectMeta.Labels[key] = newName
 		}
 	}
 
-	return new
+	new.ObjectMeta.Labels[TENANT_LABEL_NAME] = nameSuffix
+	new.Spec.Selector.MatchLabels[TENANT_LABEL_NAME] = nameSuffix
+	new.Spec.Template.ObjectMeta.Labels[TENANT_LABEL_NAME] = nameSuffix
 }
 
-func (r *DeploymentReconciler) createDeployment(nameSuffix string, environmentsMap map[string]string) error {
-	logger.Infof("Creating a new deployment with suffix %v", nameSuffix)
+func (r *DeploymentReconciler) originalReference() *corev1.ObjectReference {
+	return buildObjectReference("apps/v1", "Deployment", r.deploymentNamespace, r.deploymentName)
+}
+
+// createDeployment renders the duplicate from the original deployment, or from a stored version
+//
+//	when it's pinned to one.
+func (r *DeploymentReconciler) createDeployment(nameSuffix string,
+	environmentsMap map[string]string, namespace string, pinnedVersion string) (*appsv1.Deployment, error) {
+	log := r.tenantLog(logs.OPERATION_CREATE, nameSuffix)
+	log.Infof("Creating a new deployment with suffix %v in %s", nameSuffix, namespace)
+	start := time.Now()
 	orig, err := r.getExistingDeployment()
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	new := r.duplicateDeployment(orig, nameSuffix, environmentsMap)
-	if err := r.Create(context.Background(), new); err != nil {
-		logger.Errorf("Unable to create a new deployment for %s %s", nameSuffix, err)
-		return err
+	if err := r.namespaces.Ensure(context.Background(), namespace, nameSuffix); err != nil {
+		recordEvent(r.recorder, orig, corev1.EventTypeWarning, REASON_CREATE_FAILED,
+			"Unable to prepare namespace %s for %s: %s", namespace, nameSuffix, err)
+		return nil, err
 	}
 
-	return nil
+	new := r.duplicateDeployment(r.creationTemplate(orig, nameSuffix), nameSuffix, environmentsMap, namespace)
+	if pinnedVersion != "" {
+		new, err = r.renderPinnedDeployment(context.Background(), nameSuffix, environmentsMap, namespace, pinnedVersion)
+		if err != nil {
+			log.Errorf("Unable to render pinned %s %s", nameSuffix, err)
+			recordEvent(r.recorder, orig, corev1.EventTypeWarning, REASON_CREATE_FAILED,
+				"Unable to create duplicate of %s: %s", nameSuffix, err)
+			return nil, err
+		}
+	}
+
+	if err := applyObject(context.Background(), r.Client, new, deploymentGvk, r.ignoredFields, false); err != nil {
+		log.WithDuration(time.Since(start)).Errorf("Unable to create a new deployment for %s %s", nameSuffix, err)
+		recordEvent(r.recorder, orig, corev1.EventTypeWarning, REASON_CREATE_FAILED,
+			"Unable to create duplicate %s: %s", new.Name, err)
+		return nil, err
+	}
+
+	log.WithDuration(time.Since(start)).Infof("Created %s in %s", new.Name, namespace)
+	r.statusTracker.report(nameSuffix, STATUS_CREATED, 0)
+	return new, nil
 }
 
-func (r *DeploymentReconciler) isDeploymentExists(deploymentSuffix string) (bool, error) {
+// applyDuplicate applies a rendered duplicate over the existing one. The selector of a deployment
+//
+//	is immutable, so duplicates created with another selector (e.g. before they were labeled with
+//	their tenant) are deleted and created again.
+func (r *DeploymentReconciler) applyDuplicate(ctx context.Context, new *appsv1.Deployment,
+	existing *appsv1.Deployment, force bool) error {
+
+	if existing != nil && !equality.Semantic.DeepEqual(existing.Spec.Selector, new.Spec.Selector) {
+		r.duplicateLog(logs.OPERATION_UPDATE, *existing).Infof("Selector of %s changed, recreating it", existing.Name)
+		err := r.Delete(ctx, existing, client.Preconditions{UID: &existing.UID})
+		if err != nil && !apierrors.IsNotFound(err) {
+			return err
+		}
+
+		recordEvent(r.recorder, r.originalReference(), corev1.EventTypeNormal, REASON_DUPLICATE_RECREATED,
+			"Recreated duplicate %s, its selector changed", existing.Name)
+	}
+
+	return applyObject(ctx, r.Client, new, deploymentGvk, r.ignoredFields, force)
+}
+
+func (r *DeploymentReconciler) getDuplicatedDeployment(deploymentSuffix string, namespace string) (*appsv1.Deployment, error) {
 	key := types.NamespacedName{
-		Namespace: r.deploymentNamespace,
+		Namespace: namespace,
 		Name:      buildDeploymentName(r.deploymentName, deploymentSuffix),
 	}
 
@@ -283,40 +569,111 @@ func (r *DeploymentReconciler) isDeploymentExists(deploymentSuffix string) (bool
 	err := r.Get(context.Background(), key, &deployment)
 
 	if err == nil {
-		return true, nil
+		return &deployment, nil
 	}
 
 	if apierrors.IsNotFound(err) {
-		return false, nil
+		return nil, nil
 	}
 
-	return false, err
+	return nil, err
 }
 
 func (r *DeploymentReconciler) OnRow(row tablewatch.Row) {
 	deploymentSuffix, ok := row[r.deploymentColumnName]
 	if !ok {
-		logger.Warningf("Column %s not found on row %v", r.deploymentColumnName, row)
+		r.log(logs.OPERATION_CREATE).Warningf("Column %s not found on row %v", r.deploymentColumnName, row)
+		recordEvent(r.recorder, r.originalReference(), corev1.EventTypeWarning, REASON_ROW_SKIPPED,
+			"Column %s not found on row", r.deploymentColumnName)
 		return
 	}
 
-	exists, err := r.isDeploymentExists(deploymentSuffix)
-	if exists {
+	r.setRow(deploymentSuffix, row)
+
+	namespace, err := r.namespaces.Resolve(r.deploymentNamespace, row)
+	if err != nil {
+		r.tenantLog(logs.OPERATION_NAMESPACE, deploymentSuffix).Errorf("Unable to resolve namespace of %s %s", deploymentSuffix, err)
+		recordEvent(r.recorder, r.originalReference(), corev1.EventTypeWarning, REASON_ROW_SKIPPED,
+			"Skipping %s: %s", deploymentSuffix, err)
 		return
 	}
 
+	existing, err := r.getDuplicatedDeployment(deploymentSuffix, namespace)
 	if err != nil {
-		logger.Errorf("Unable to get deployment info for %s %s", deploymentSuffix, err)
+		r.tenantLog(logs.OPERATION_CREATE, deploymentSuffix).Errorf("Unable to get deployment info for %s %s", deploymentSuffix, err)
+		return
+	}
+
+	if existing != nil {
+		r.onExistingRow(*existing)
 		return
 	}
 
 	environmentsMap, err := r.buildEnvironmentMapFromRow(row)
 	if err != nil {
-		logger.Errorf("Unable to build environment map %s", err)
+		r.tenantLog(logs.OPERATION_CREATE, deploymentSuffix).Errorf("Unable to build environment map %s", err)
+		recordEvent(r.recorder, r.originalReference(), corev1.EventTypeWarning, REASON_ROW_SKIPPED,
+			"Skipping %s: %s", deploymentSuffix, err)
+		return
+	}
+
+	managedKey := r.managedKey(deploymentSuffix)
+	wasQueued := r.throttle.isQueued(managedKey)
+	if !r.throttle.reserve(managedKey) {
+		if !wasQueued {
+			r.tenantLog(logs.OPERATION_CREATE, deploymentSuffix).Warningf("Max managed deployments reached, queueing %s", deploymentSuffix)
+			recordEvent(r.recorder, r.originalReference(), corev1.EventTypeWarning, REASON_ROW_QUEUED,
+				"Queueing %s, max managed deployments reached", deploymentSuffix)
+		}
+
+		r.statusTracker.report(deploymentSuffix, STATUS_QUEUED, 0)
 		return
 	}
 
-	r.createDeployment(deploymentSuffix, environmentsMap)
+	pinnedVersion := r.getRowPinnedVersion(row)
+	r.throttle.submitCreation("deployment", managedKey, func() {
+		new, err := r.createDeployment(deploymentSuffix, environmentsMap, namespace, pinnedVersion)
+		if err != nil {
+			r.throttle.release(managedKey)
+			return
+		}
+
+		recordEvent(r.recorder, r.originalReference(), corev1.EventTypeNormal, REASON_DUPLICATE_CREATED,
+			"Created duplicate %s", new.Name)
+		recordEvent(r.recorder, new, corev1.EventTypeNormal, REASON_DUPLICATE_CREATED,
+			"Duplicated from %s", r.deploymentName)
+	})
+}
+
+// onExistingRow keeps the environment of a pinned duplicate up to date with its row, duplicates
+//
+//	following the original are updated by originalDeploymentChanged.
+func (r *DeploymentReconciler) onExistingRow(deployment appsv1.Deployment) {
+	if version := r.getPinnedVersion(deployment); version != "" {
+		r.updatePinnedDeployment(context.Background(), deployment, version)
+	}
+}
+
+func (r *DeploymentReconciler) setRow(deploymentSuffix string, row tablewatch.Row) {
+	r.rowsLock.Lock()
+	defer r.rowsLock.Unlock()
+
+	r.rows[deploymentSuffix] = row
+}
+
+func (r *DeploymentReconciler) getRow(deploymentSuffix string) (tablewatch.Row, bool) {
+	r.rowsLock.Lock()
+	defer r.rowsLock.Unlock()
+
+	row, ok := r.rows[deploymentSuffix]
+	return row, ok
+}
+
+func (r *DeploymentReconciler) forgetRow(deploymentSuffix string) {
+	r.rowsLock.Lock()
+	defer r.rowsLock.Unlock()
+
+	delete(r.rows, deploymentSuffix)
 }
 
 func (r *DeploymentReconciler) buildEnvironmentMapFromRow(row tablewatch.Row) (map[string]string, error) {
@@ -365,44 +722,136 @@ func (r *DeploymentReconciler) buildEnvironmentMapFromDeployment(deployment apps
 }
 
 func (r *DeploymentReconciler) SetupWithManager(mgr ctrl.Manager) error {
+	r.recorder = mgr.GetEventRecorderFor(EVENT_RECORDER_NAME)
+
 	return ctrl.NewControllerManagedBy(mgr).
+		Named(fmt.Sprintf("deployment-%s-%s", r.deploymentNamespace, r.deploymentName)).
 		For(&appsv1.Deployment{}).
 		Complete(r)
 }
 
-func (r *DeploymentReconciler) Run(cleaner *cleaner.Cleaner) {
+// OnRowsReady is called once every source delivered a full snapshot, the rows seen by then
+//
+//	stand for all the tenants.
+func (r *DeploymentReconciler) OnRowsReady() {
+	r.rowsReady.Store(true)
+}
+
+// needsRows tells whether updating the duplicates depends on their rows, e.g. to tell the
+//
+//	canaries apart from the others, or to order them by priority.
+func (r *DeploymentReconciler) needsRows() bool {
+	return r.priority != nil || r.canary != nil && r.canary.column != ""
+}
+
+// ReadyCheck fails until the existing duplicated deployments were listed, it matches healthz.Checker.
+func (r *DeploymentReconciler) ReadyCheck(_ *http.Request) error {
+	if !r.initialized.Load() {
+		return fmt.Errorf("initial duplicated deployments were not listed yet")
+	}
+
+	return nil
+}
+
+func (r *DeploymentReconciler) SetNamespaceManager(namespaces *NamespaceManager) {
+	r.namespaces = namespaces
+}
+
+func (r *DeploymentReconciler) SetThrottle(throttle *Throttle) {
+	r.throttle = throttle
+}
+
+func (r *DeploymentReconciler) SetPriority(priority *Priority) {
+	r.priority = priority
+}
+
+func (r *DeploymentReconciler) SetTemplateStore(templates *TemplateStore) {
+	r.templates = templates
+}
+
+func (r *DeploymentReconciler) Name() string {
+	return r.deploymentName
+}
+
+func (r *DeploymentReconciler) addInitialDeployments(ctx context.Context, cleaner *cleaner.Cleaner) error {
 	for {
-		deploys, err := r.listDuplicatedDeployments(context.TODO())
+		deploys, err := r.listDuplicatedDeployments(ctx)
 		if err == nil {
 			for _, dep := range deploys {
 				deployName := dep.ObjectMeta.Annotations[DEPLOYMENT_ID_ANNOTATION_NAME]
 				cleaner.OnDeploy(deployName)
+				r.throttle.addManaged(r.managedKey(deployName))
 			}
-			logger.Infof("Added %d initial deployments", len(deploys))
-			break
-		} else {
-			logger.Errorf("Unable to get initial deployments %s", err)
-			time.Sleep(time.Second)
+			r.log(logs.OPERATION_RECONCILE).Infof("Added %d initial deployments", len(deploys))
+			r.initialized.Store(true)
+			return nil
 		}
-	}
 
-	logger.Infof("Starting deploy remove routine")
+		r.log(logs.OPERATION_RECONCILE).Errorf("Unable to get initial deployments %s", err)
 
-	for deploy := range r.removeDeploys {
-		key := types.NamespacedName{
-			Namespace: r.deploymentNamespace,
-			Name:      buildDeploymentName(r.deploymentName, deploy),
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(time.Second):
 		}
+	}
+}
 
-		deployment := appsv1.Deployment{}
-		if err := r.Get(context.TODO(), key, &deployment); err != nil {
-			logger.Errorf("Unable to get deployment %s %s", deploy, err)
-			continue
-		}
+// Run submits the removals of stale deploys to the throttle until ctx is done, a removal
+//
+//	in progress is completed by the throttle before it returns.
+func (r *DeploymentReconciler) Run(ctx context.Context, cleaner *cleaner.Cleaner) {
+	if err := r.addInitialDeployments(ctx, cleaner); err != nil {
+		return
+	}
 
-		if err := r.Delete(context.TODO(), &deployment); err != nil {
-			logger.Errorf("Unable to remove deployment %s %s", deploy, err)
-			continue
+	r.log(logs.OPERATION_REMOVE).Infof("Starting deploy remove routine")
+
+	for {
+		select {
+		case <-ctx.Done():
+			r.log(logs.OPERATION_REMOVE).Infof("Stopping deploy remove routine of %s", r.deploymentName)
+			return
+		case deploy, ok := <-r.removeDeploys:
+			if !ok {
+				return
+			}
+
+			r.throttle.submitRemoval("deployment", r.managedKey(deploy), func() {
+				r.removeDeploy(deploy)
+			})
 		}
 	}
 }
+
+func (r *DeploymentReconciler) removeDeploy(deploy string) {
+	deployment, err := r.findDuplicatedDeployment(context.TODO(), deploy)
+	if err != nil {
+		r.tenantLog(logs.OPERATION_REMOVE, deploy).Errorf("Unable to get deployment %s %s", deploy, err)
+		return
+	}
+
+	if deployment == nil {
+		r.tenantLog(logs.OPERATION_REMOVE, deploy).Debugf("Deployment %s not found, nothing to remove", deploy)
+		r.throttle.release(r.managedKey(deploy))
+		r.statusTracker.forget(deploy)
+		r.namespaces.Remove(context.TODO(), deploy)
+		return
+	}
+
+	if err := r.Delete(context.TODO(), deployment); err != nil {
+		r.tenantLog(logs.OPERATION_REMOVE, deploy).Errorf("Unable to remove deployment %s %s", deploy, err)
+		recordEvent(r.recorder, deployment, corev1.EventTypeWarning, REASON_DELETE_FAILED,
+			"Unable to remove stale duplicate: %s", err)
+		return
+	}
+
+	recordEvent(r.recorder, r.originalReference(), corev1.EventTypeNormal, REASON_STALE_REMOVED,
+		"Removed duplicate %s, %s no longer found in the database", deployment.Name, deploy)
+	recordEvent(r.recorder, deployment, corev1.EventTypeNormal, REASON_STALE_REMOVED,
+		"Removed, %s no longer found in the database", deploy)
+	r.throttle.release(r.managedKey(deploy))
+	r.statusTracker.forget(deploy)
+	r.forgetRow(deploy)
+	r.namespaces.Remove(context.TODO(), deploy)
+}
@@ -0,0 +1,121 @@
+package controller
+
+import (
+	"context"
+	"dvdlevanon/kubernetes-database-scaler/pkg/logs"
+	"sync"
+
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+)
+
+const STATUS_CREATED = "Created"
+const STATUS_PROGRESSING = "Progressing"
+const STATUS_AVAILABLE = "Available"
+const STATUS_FAILED = "Failed"
+const STATUS_QUEUED = "Queued"
+
+type StatusReporter interface {
+	ReportStatus(deploymentId string, status string, readyReplicas int32) error
+}
+
+type reportedStatus struct {
+	status        string
+	readyReplicas int32
+}
+
+// statusTracker remembers the last status written per deployment id,
+//
+//	reconciles are triggered on every status update of the deployment
+//	and we only want to hit the database when something actually changed.
+type statusTracker struct {
+	reporter StatusReporter
+	lock     sync.Mutex
+	reported map[string]reportedStatus
+}
+
+func newStatusTracker(reporter StatusReporter) *statusTracker {
+	return &statusTracker{
+		reporter: reporter,
+		reported: make(map[string]reportedStatus),
+	}
+}
+
+func (t *statusTracker) report(deploymentId string, status string, readyReplicas int32) {
+	if t == nil {
+		return
+	}
+
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	current := reportedStatus{status: status, readyReplicas: readyReplicas}
+	if last, ok := t.reported[deploymentId]; ok && last == current {
+		return
+	}
+
+	if err := t.reporter.ReportStatus(deploymentId, status, readyReplicas); err != nil {
+		logger.WithTenant(deploymentId).WithOperation(logs.OPERATION_STATUS).Errorf("Unable to report status of %s %s", deploymentId, err)
+		return
+	}
+
+	t.reported[deploymentId] = current
+}
+
+func (t *statusTracker) forget(deploymentId string) {
+	if t == nil {
+		return
+	}
+
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	delete(t.reported, deploymentId)
+}
+
+func getDeploymentCondition(deployment *appsv1.Deployment, conditionType appsv1.DeploymentConditionType) *appsv1.DeploymentCondition {
+	for i := range deployment.Status.Conditions {
+		if deployment.Status.Conditions[i].Type == conditionType {
+			return &deployment.Status.Conditions[i]
+		}
+	}
+
+	return nil
+}
+
+func getDeploymentStatus(deployment *appsv1.Deployment) string {
+	progressing := getDeploymentCondition(deployment, appsv1.DeploymentProgressing)
+	if progressing != nil && progressing.Status == corev1.ConditionFalse {
+		return STATUS_FAILED
+	}
+
+	replicaFailure := getDeploymentCondition(deployment, appsv1.DeploymentReplicaFailure)
+	if replicaFailure != nil && replicaFailure.Status == corev1.ConditionTrue {
+		return STATUS_FAILED
+	}
+
+	if deployment.Status.ObservedGeneration < deployment.Generation {
+		return STATUS_PROGRESSING
+	}
+
+	available := getDeploymentCondition(deployment, appsv1.DeploymentAvailable)
+	if available != nil && available.Status == corev1.ConditionTrue &&
+		deployment.Status.UpdatedReplicas == deployment.Status.Replicas {
+		return STATUS_AVAILABLE
+	}
+
+	return STATUS_PROGRESSING
+}
+
+func (r *DeploymentReconciler) SetStatusReporter(reporter StatusReporter) {
+	r.statusTracker = newStatusTracker(reporter)
+}
+
+func (r *DeploymentReconciler) duplicatedDeploymentChanged(ctx context.Context, deployment appsv1.Deployment) {
+	deploymentId, ok := deployment.Annotations[DEPLOYMENT_ID_ANNOTATION_NAME]
+	if !ok {
+		return
+	}
+
+	r.statusTracker.report(deploymentId, getDeploymentStatus(&deployment), deployment.Status.ReadyReplicas)
+}
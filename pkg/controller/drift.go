@@ -0,0 +1,159 @@
+package controller
+
+import (
+	"context"
+	"dvdlevanon/kubernetes-database-scaler/pkg/logs"
+	"fmt"
+	"strings"
+
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+const DRIFT_MODE_OFF = "off"
+const DRIFT_MODE_REPORT = "report"
+const DRIFT_MODE_REVERT = "revert"
+
+const (
+	REASON_DRIFT_DETECTED = "DriftDetected"
+	REASON_DRIFT_REVERTED = "DriftReverted"
+)
+
+// The selector of a deployment is immutable, it can't drift and can't be reverted
+var alwaysIgnoredDriftFields = []string{"spec.selector"}
+
+func (r *DeploymentReconciler) SetDriftPolicy(mode string, ignoreFields []string) error {
+	switch mode {
+	case "", DRIFT_MODE_OFF:
+		mode = DRIFT_MODE_OFF
+	case DRIFT_MODE_REPORT, DRIFT_MODE_REVERT:
+	default:
+		return fmt.Errorf("invalid drift mode %s (e.g. off, report, revert)", mode)
+	}
+
+	for _, field := range ignoreFields {
+		if !strings.HasPrefix(field, "spec.") {
+			return fmt.Errorf("invalid drift ignore field %s, only spec fields are supported (e.g spec.replicas)", field)
+		}
+	}
+
+	r.driftMode = mode
+	r.ignoredFields = ignoreFields
+	return nil
+}
+
+func (r *DeploymentReconciler) isDriftDetectionEnabled() bool {
+	return r.driftMode != "" && r.driftMode != DRIFT_MODE_OFF
+}
+
+func toUnstructured(deployment *appsv1.Deployment) (map[string]interface{}, error) {
+	return runtime.DefaultUnstructuredConverter.ToUnstructured(deployment)
+}
+
+func (r *DeploymentReconciler) getDriftIgnoredFields() []string {
+	return append(append([]string{}, r.ignoredFields...), alwaysIgnoredDriftFields...)
+}
+
+func (r *DeploymentReconciler) removeIgnoredFields(obj map[string]interface{}) {
+	for _, field := range r.getDriftIgnoredFields() {
+		unstructured.RemoveNestedField(obj, strings.Split(field, ".")...)
+	}
+}
+
+func (r *DeploymentReconciler) hasDrifted(expected *appsv1.Deployment, actual *appsv1.Deployment) (bool, error) {
+	expectedObj, err := toUnstructured(expected)
+	if err != nil {
+		return false, err
+	}
+
+	actualObj, err := toUnstructured(actual)
+	if err != nil {
+		return false, err
+	}
+
+	r.removeIgnoredFields(expectedObj)
+	r.removeIgnoredFields(actualObj)
+
+	return !equality.Semantic.DeepEqual(expectedObj["spec"], actualObj["spec"]), nil
+}
+
+func (r *DeploymentReconciler) buildExpectedDeployment(deployment appsv1.Deployment) (*appsv1.Deployment, error) {
+	nameSuffix := deployment.Annotations[DEPLOYMENT_ID_ANNOTATION_NAME]
+	orig, err := r.getExistingDeployment()
+	if err != nil {
+		return nil, err
+	}
+
+	// A duplicate of an older generation is updated by originalDeploymentChanged
+	//
+	if deployment.Annotations[ORIGINAL_OBSERVED_GENERATION_ANNOTATION_NAME] != fmt.Sprintf("%d", orig.Status.ObservedGeneration) {
+		return nil, nil
+	}
+
+	// A duplicate rolled back to an older version isn't rendered from the current original
+	//
+	if version, ok := deployment.Annotations[TEMPLATE_VERSION_ANNOTATION_NAME]; ok && version != getTemplateVersion(orig) {
+		return nil, nil
+	}
+
+	environmentsMap, err := r.getEnvironmentMap(deployment)
+	if err != nil {
+		return nil, err
+	}
+
+	return r.duplicateDeployment(orig, nameSuffix, environmentsMap, deployment.Namespace), nil
+}
+
+func (r *DeploymentReconciler) detectDrift(ctx context.Context, deployment appsv1.Deployment) {
+	if !r.isDriftDetectionEnabled() || deployment.DeletionTimestamp != nil {
+		return
+	}
+
+	expected, err := r.buildExpectedDeployment(deployment)
+	if err != nil {
+		r.duplicateLog(logs.OPERATION_DRIFT, deployment).Errorf("Unable to build expected deployment of %s %s", deployment.Name, err)
+		return
+	}
+
+	if expected == nil {
+		return
+	}
+
+	drifted, err := r.hasDrifted(expected, &deployment)
+	if err != nil {
+		r.duplicateLog(logs.OPERATION_DRIFT, deployment).Errorf("Unable to compare deployment %s %s", deployment.Name, err)
+		return
+	}
+
+	if !drifted {
+		return
+	}
+
+	if r.driftMode == DRIFT_MODE_REPORT {
+		r.duplicateLog(logs.OPERATION_DRIFT, deployment).Warningf("Deployment %s drifted from %s", deployment.Name, r.deploymentName)
+		recordEvent(r.recorder, &deployment, corev1.EventTypeWarning, REASON_DRIFT_DETECTED,
+			"Spec differs from the one rendered from %s", r.deploymentName)
+		return
+	}
+
+	if version, ok := deployment.Annotations[ROW_PINNED_VERSION_ANNOTATION_NAME]; ok {
+		expected.Annotations[ROW_PINNED_VERSION_ANNOTATION_NAME] = version
+	}
+
+	// A forced apply takes back the ownership of the fields changed by hand (e.g. by kubectl edit),
+	//	while the ignored fields are left to their managers (like replicas managed by an hpa).
+	//
+	r.duplicateLog(logs.OPERATION_DRIFT, deployment).Infof("Deployment %s drifted from %s, reverting", deployment.Name, r.deploymentName)
+	if err := r.applyDuplicate(ctx, expected, &deployment, true); err != nil {
+		r.duplicateLog(logs.OPERATION_DRIFT, deployment).Errorf("Unable to revert deployment %s %s", deployment.Name, err)
+		recordEvent(r.recorder, &deployment, corev1.EventTypeWarning, REASON_UPDATE_FAILED,
+			"Unable to revert drift from %s: %s", r.deploymentName, err)
+		return
+	}
+
+	recordEvent(r.recorder, expected, corev1.EventTypeNormal, REASON_DRIFT_REVERTED,
+		"Spec reverted to the one rendered from %s", r.deploymentName)
+}
@@ -0,0 +1,42 @@
+package controller
+
+import (
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/tools/record"
+)
+
+const EVENT_RECORDER_NAME = "kubernetes-database-scaler"
+
+const (
+	REASON_DUPLICATE_CREATED   = "DuplicateCreated"
+	REASON_DUPLICATE_RECREATED = "DuplicateRecreated"
+	REASON_DUPLICATE_UPDATED   = "DuplicateUpdated"
+	REASON_DUPLICATE_DELETED   = "DuplicateDeleted"
+	REASON_STALE_REMOVED       = "StaleDuplicateRemoved"
+	REASON_CREATE_FAILED       = "CreateFailed"
+	REASON_DELETE_FAILED       = "DeleteFailed"
+	REASON_UPDATE_FAILED       = "UpdateFailed"
+	REASON_ROW_SKIPPED         = "RowSkipped"
+	REASON_ROW_QUEUED          = "RowQueued"
+	REASON_ROLLED_BACK         = "RolledBack"
+)
+
+func buildObjectReference(apiVersion string, kind string, namespace string, name string) *corev1.ObjectReference {
+	return &corev1.ObjectReference{
+		APIVersion: apiVersion,
+		Kind:       kind,
+		Namespace:  namespace,
+		Name:       name,
+	}
+}
+
+// recordEvent is safe to call before the recorder is set up with the manager
+func recordEvent(recorder record.EventRecorder, object runtime.Object, eventType string,
+	reason string, messageFmt string, args ...interface{}) {
+	if recorder == nil || object == nil {
+		return
+	}
+
+	recorder.Eventf(object, eventType, reason, messageFmt, args...)
+}
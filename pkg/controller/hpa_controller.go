@@ -0,0 +1,477 @@
+package controller
+
+import (
+	"context"
+	"dvdlevanon/kubernetes-database-scaler/pkg/logs"
+	"dvdlevanon/kubernetes-database-scaler/pkg/tablewatch"
+	"fmt"
+	"strconv"
+
+	autoscalingv2 "k8s.io/api/autoscaling/v2"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/record"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+)
+
+const HPA_ID_ANNOTATION_NAME = "kubernetes-database-scaler/hpa-id"
+const ORIGINAL_HPA_GENERATION_ANNOTATION_NAME = "kubernetes-database-scaler/original-hpa-generation"
+
+type HpaReconciler struct {
+	client.Client
+	hpaNamespace      string
+	hpaName           string
+	hpaColumnName     string
+	deploymentName    string
+	minReplicasColumn string
+	maxReplicasColumn string
+	recorder          record.EventRecorder
+	namespaces        *NamespaceManager
+	throttle          *Throttle
+	removeHpas        <-chan string
+}
+
+func NewHpaController(client client.Client, hpaNamespace string, hpaName string, hpaColumnName string,
+	deploymentName string, minReplicasColumn string, maxReplicasColumn string) (*HpaReconciler, error) {
+
+	if hpaName == "" {
+		return nil, fmt.Errorf("hpa name is empty")
+	}
+
+	if hpaNamespace == "" {
+		return nil, fmt.Errorf("hpa namespace is empty")
+	}
+
+	if hpaColumnName == "" {
+		return nil, fmt.Errorf("hpa column name is empty")
+	}
+
+	if deploymentName == "" {
+		return nil, fmt.Errorf("deployment name is empty")
+	}
+
+	return &HpaReconciler{
+		Client:            client,
+		hpaName:           hpaName,
+		hpaNamespace:      hpaNamespace,
+		hpaColumnName:     hpaColumnName,
+		deploymentName:    deploymentName,
+		minReplicasColumn: minReplicasColumn,
+		maxReplicasColumn: maxReplicasColumn,
+	}, nil
+}
+
+func (r *HpaReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
+	_ = log.FromContext(ctx)
+
+	if req.Namespace == r.hpaNamespace && req.Name == r.hpaName {
+		r.reconcileHpa(ctx, req)
+	}
+
+	return ctrl.Result{}, nil
+}
+
+func (r *HpaReconciler) reconcileHpa(ctx context.Context, req ctrl.Request) {
+	hpa := autoscalingv2.HorizontalPodAutoscaler{}
+	err := r.Get(ctx, req.NamespacedName, &hpa)
+	if err == nil {
+		r.originalHpaChanged(ctx, hpa)
+	} else if apierrors.IsNotFound(err) {
+		r.originalHpaDeleted(ctx)
+	} else {
+		r.log(logs.OPERATION_RECONCILE).Errorf("Unable to get hpa upon reconciling %s", err)
+	}
+}
+
+func (r *HpaReconciler) originalHpaChanged(ctx context.Context, original autoscalingv2.HorizontalPodAutoscaler) error {
+	hpas, err := r.listDuplicatedHpas(ctx)
+	if err != nil {
+		return err
+	}
+
+	// Like vpas, hpas status is updated constantly, the generation changes only when the spec does.
+	//
+	originalGeneration := fmt.Sprintf("%d", original.Generation)
+	for _, hpa := range hpas {
+		if hpa.Annotations[ORIGINAL_HPA_GENERATION_ANNOTATION_NAME] == originalGeneration {
+			continue
+		}
+
+		nameSuffix, ok := hpa.Annotations[HPA_ID_ANNOTATION_NAME]
+		if !ok {
+			r.log(logs.OPERATION_UPDATE).Errorf("Unable to get name suffix annotation from hpa %v", hpa)
+			continue
+		}
+
+		r.tenantLog(logs.OPERATION_UPDATE, nameSuffix).Infof("Original hpa changed (generation %s), updating hpa %s", originalGeneration, hpa.Name)
+
+		updated := r.duplicateHpa(&original, nameSuffix, hpa.Namespace)
+		r.keepRowReplicas(updated, &hpa)
+		if err := applyObject(ctx, r.Client, updated, hpaGvk, nil, false); err != nil {
+			r.tenantLog(logs.OPERATION_UPDATE, nameSuffix).Errorf("Unable to update hpa %s %s", hpa.Name, err)
+			recordApplyError(r.recorder, &hpa, err,
+				"Unable to update from %s generation %s: %s", r.hpaName, originalGeneration, err)
+			continue
+		}
+
+		recordEvent(r.recorder, updated, corev1.EventTypeNormal, REASON_DUPLICATE_UPDATED,
+			"Updated from %s generation %s", r.hpaName, originalGeneration)
+	}
+
+	return nil
+}
+
+// keepRowReplicas preserves the replicas taken from the row when the hpa is rebuilt from the original.
+func (r *HpaReconciler) keepRowReplicas(expected *autoscalingv2.HorizontalPodAutoscaler, existing *autoscalingv2.HorizontalPodAutoscaler) {
+	if r.minReplicasColumn != "" {
+		expected.Spec.MinReplicas = existing.Spec.MinReplicas
+	}
+
+	if r.maxReplicasColumn != "" {
+		expected.Spec.MaxReplicas = existing.Spec.MaxReplicas
+	}
+}
+
+func (r *HpaReconciler) originalHpaDeleted(ctx context.Context) {
+	hpas, err := r.listDuplicatedHpas(ctx)
+	if err != nil {
+		return
+	}
+
+	r.log(logs.OPERATION_REMOVE).Infof("Original hpa deleted, removing %d duplicated hpas", len(hpas))
+
+	for _, hpa := range hpas {
+		if err := r.Delete(ctx, &hpa); err != nil {
+			r.tenantLog(logs.OPERATION_REMOVE, hpa.Annotations[HPA_ID_ANNOTATION_NAME]).Errorf("Error removing hpa %s", err)
+			recordEvent(r.recorder, &hpa, corev1.EventTypeWarning, REASON_DELETE_FAILED,
+				"Unable to remove duplicate after %s was deleted: %s", r.hpaName, err)
+			continue
+		}
+
+		recordEvent(r.recorder, &hpa, corev1.EventTypeNormal, REASON_DUPLICATE_DELETED,
+			"Removed since %s was deleted", r.hpaName)
+	}
+}
+
+// removeHpa removes the hpa of a tenant removed from the database, along with its deployment
+func (r *HpaReconciler) removeHpa(ctx context.Context, nameSuffix string) {
+	hpa, err := r.findDuplicatedHpa(ctx, nameSuffix)
+	if err != nil {
+		return
+	}
+
+	if hpa == nil {
+		r.tenantLog(logs.OPERATION_REMOVE, nameSuffix).Debugf("Hpa of %s not found, nothing to remove", nameSuffix)
+		return
+	}
+
+	if err := r.Delete(ctx, hpa); err != nil && !apierrors.IsNotFound(err) {
+		r.tenantLog(logs.OPERATION_REMOVE, nameSuffix).Errorf("Unable to remove hpa %s %s", hpa.Name, err)
+		recordEvent(r.recorder, hpa, corev1.EventTypeWarning, REASON_DELETE_FAILED,
+			"Unable to remove stale duplicate: %s", err)
+		return
+	}
+
+	r.tenantLog(logs.OPERATION_REMOVE, nameSuffix).Infof("Removed hpa %s, %s no longer found in the database", hpa.Name, nameSuffix)
+	recordEvent(r.recorder, hpa, corev1.EventTypeNormal, REASON_STALE_REMOVED,
+		"Removed, %s no longer found in the database", nameSuffix)
+}
+
+func (r *HpaReconciler) findDuplicatedHpa(ctx context.Context, nameSuffix string) (*autoscalingv2.HorizontalPodAutoscaler, error) {
+	hpas, err := r.listDuplicatedHpas(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, hpa := range hpas {
+		if hpa.Annotations[HPA_ID_ANNOTATION_NAME] == nameSuffix {
+			return &hpa, nil
+		}
+	}
+
+	return nil, nil
+}
+
+func (r *HpaReconciler) listDuplicatedHpas(ctx context.Context) ([]autoscalingv2.HorizontalPodAutoscaler, error) {
+	hpas := autoscalingv2.HorizontalPodAutoscalerList{}
+	err := r.List(ctx, &hpas, r.namespaces.ListOptions(r.hpaNamespace)...)
+	if err != nil {
+		r.log(logs.OPERATION_RECONCILE).Errorf("Error getting duplicated hpas %s", err)
+		return nil, err
+	}
+
+	result := make([]autoscalingv2.HorizontalPodAutoscaler, 0)
+	for _, hpa := range hpas.Items {
+		if nameSuffix, ok := hpa.Annotations[HPA_ID_ANNOTATION_NAME]; ok && hpa.Name == r.buildHpaName(nameSuffix) {
+			result = append(result, hpa)
+		}
+	}
+
+	return result, nil
+}
+
+// log is the logger of lines about the original autoscaler
+func (r *HpaReconciler) log(operation string) *logs.Logger {
+	return logger.WithDeployment(r.deploymentName).WithOperation(operation)
+}
+
+// tenantLog is the logger of lines about the autoscaler of a tenant, by the duplicate it scales
+func (r *HpaReconciler) tenantLog(operation string, nameSuffix string) *logs.Logger {
+	return logger.WithTenant(nameSuffix).
+		WithDeployment(buildDeploymentName(r.deploymentName, nameSuffix)).
+		WithOperation(operation)
+}
+
+func (r *HpaReconciler) buildHpaName(hpaSuffix string) string {
+	return fmt.Sprintf("%s-%s", r.hpaName, hpaSuffix)
+}
+
+func (r *HpaReconciler) getExistingHpa() (*autoscalingv2.HorizontalPodAutoscaler, error) {
+	key := types.NamespacedName{
+		Namespace: r.hpaNamespace,
+		Name:      r.hpaName,
+	}
+
+	hpa := autoscalingv2.HorizontalPodAutoscaler{}
+	if err := r.Get(context.Background(), key, &hpa); err != nil {
+		r.log(logs.OPERATION_RECONCILE).Errorf("Unable to get original hpa %v %s", key, err)
+		return nil, err
+	}
+
+	return &hpa, nil
+}
+
+func (r *HpaReconciler) duplicateHpa(orig *autoscalingv2.HorizontalPodAutoscaler,
+	nameSuffix string, namespace string) *autoscalingv2.HorizontalPodAutoscaler {
+	annotations := make(map[string]string)
+	for key, value := range orig.ObjectMeta.Annotations {
+		annotations[key] = value
+	}
+
+	new := orig.DeepCopy()
+	new.Status = autoscalingv2.HorizontalPodAutoscalerStatus{}
+	new.ObjectMeta = v1.ObjectMeta{
+		Name:                       r.buildHpaName(nameSuffix),
+		Namespace:                  namespace,
+		Annotations:                annotations,
+		Labels:                     orig.ObjectMeta.Labels,
+		DeletionGracePeriodSeconds: orig.ObjectMeta.DeletionGracePeriodSeconds,
+	}
+
+	new.ObjectMeta.Annotations[HPA_ID_ANNOTATION_NAME] = nameSuffix
+	new.ObjectMeta.Annotations[ORIGINAL_HPA_GENERATION_ANNOTATION_NAME] = fmt.Sprintf("%d", orig.Generation)
+	new.Spec.ScaleTargetRef.Name = buildDeploymentName(r.deploymentName, nameSuffix)
+	return new
+}
+
+func parseReplicas(row tablewatch.Row, columnName string) (*int32, error) {
+	if columnName == "" {
+		return nil, nil
+	}
+
+	value, ok := row[columnName]
+	if !ok {
+		return nil, fmt.Errorf("value of column %s not found in row %v", columnName, row)
+	}
+
+	replicas, err := strconv.ParseInt(value, 10, 32)
+	if err != nil {
+		return nil, fmt.Errorf("invalid replicas %s in column %s", value, columnName)
+	}
+
+	result := int32(replicas)
+	return &result, nil
+}
+
+// applyRowReplicas sets min and max replicas from the row, it returns true if any of them changed.
+func (r *HpaReconciler) applyRowReplicas(hpa *autoscalingv2.HorizontalPodAutoscaler, row tablewatch.Row) (bool, error) {
+	minReplicas, err := parseReplicas(row, r.minReplicasColumn)
+	if err != nil {
+		return false, err
+	}
+
+	maxReplicas, err := parseReplicas(row, r.maxReplicasColumn)
+	if err != nil {
+		return false, err
+	}
+
+	changed := false
+	if minReplicas != nil && (hpa.Spec.MinReplicas == nil || *hpa.Spec.MinReplicas != *minReplicas) {
+		hpa.Spec.MinReplicas = minReplicas
+		changed = true
+	}
+
+	if maxReplicas != nil && hpa.Spec.MaxReplicas != *maxReplicas {
+		hpa.Spec.MaxReplicas = *maxReplicas
+		changed = true
+	}
+
+	return changed, nil
+}
+
+func (r *HpaReconciler) createHpa(nameSuffix string, namespace string, row tablewatch.Row) error {
+	r.tenantLog(logs.OPERATION_CREATE, nameSuffix).Infof("Creating a new hpa with suffix %v in %s", nameSuffix, namespace)
+
+	orig, err := r.getExistingHpa()
+	if err != nil {
+		return err
+	}
+
+	if err := r.namespaces.Ensure(context.Background(), namespace, nameSuffix); err != nil {
+		return err
+	}
+
+	new := r.duplicateHpa(orig, nameSuffix, namespace)
+	if _, err := r.applyRowReplicas(new, row); err != nil {
+		r.tenantLog(logs.OPERATION_CREATE, nameSuffix).Errorf("Unable to get replicas of hpa %s %s", nameSuffix, err)
+		recordEvent(r.recorder, orig, corev1.EventTypeWarning, REASON_ROW_SKIPPED,
+			"Skipping %s: %s", nameSuffix, err)
+		return err
+	}
+
+	if err := applyObject(context.Background(), r.Client, new, hpaGvk, nil, false); err != nil {
+		r.tenantLog(logs.OPERATION_CREATE, nameSuffix).Errorf("Unable to create a new hpa for %s %s", nameSuffix, err)
+		recordEvent(r.recorder, orig, corev1.EventTypeWarning, REASON_CREATE_FAILED,
+			"Unable to create duplicate %s: %s", new.Name, err)
+		return err
+	}
+
+	recordEvent(r.recorder, orig, corev1.EventTypeNormal, REASON_DUPLICATE_CREATED,
+		"Created duplicate %s", new.Name)
+	recordEvent(r.recorder, new, corev1.EventTypeNormal, REASON_DUPLICATE_CREATED,
+		"Duplicated from %s", r.hpaName)
+	return nil
+}
+
+func (r *HpaReconciler) updateHpaReplicas(hpa *autoscalingv2.HorizontalPodAutoscaler, row tablewatch.Row) error {
+	changed, err := r.applyRowReplicas(hpa.DeepCopy(), row)
+	if err != nil || !changed {
+		return err
+	}
+
+	orig, err := r.getExistingHpa()
+	if err != nil {
+		return err
+	}
+
+	nameSuffix := hpa.Annotations[HPA_ID_ANNOTATION_NAME]
+	updated := r.duplicateHpa(orig, nameSuffix, hpa.Namespace)
+	if _, err := r.applyRowReplicas(updated, row); err != nil {
+		return err
+	}
+
+	// Keep the generation the hpa was rendered from, originalHpaChanged takes care of newer ones
+	//
+	updated.Annotations[ORIGINAL_HPA_GENERATION_ANNOTATION_NAME] = hpa.Annotations[ORIGINAL_HPA_GENERATION_ANNOTATION_NAME]
+
+	r.tenantLog(logs.OPERATION_UPDATE, nameSuffix).Infof("Replicas of hpa %s changed in the database, updating", hpa.Name)
+	if err := applyObject(context.Background(), r.Client, updated, hpaGvk, nil, false); err != nil {
+		r.tenantLog(logs.OPERATION_UPDATE, nameSuffix).Errorf("Unable to update replicas of hpa %s %s", hpa.Name, err)
+		recordApplyError(r.recorder, hpa, err, "Unable to update replicas: %s", err)
+		return err
+	}
+
+	return nil
+}
+
+func (r *HpaReconciler) getHpa(hpaSuffix string, namespace string) (*autoscalingv2.HorizontalPodAutoscaler, error) {
+	key := types.NamespacedName{
+		Namespace: namespace,
+		Name:      r.buildHpaName(hpaSuffix),
+	}
+
+	hpa := autoscalingv2.HorizontalPodAutoscaler{}
+	err := r.Get(context.Background(), key, &hpa)
+
+	if err == nil {
+		return &hpa, nil
+	}
+
+	if apierrors.IsNotFound(err) {
+		return nil, nil
+	}
+
+	return nil, err
+}
+
+func (r *HpaReconciler) OnRow(row tablewatch.Row) {
+	deploymentSuffix, ok := row[r.hpaColumnName]
+	if !ok {
+		r.log(logs.OPERATION_CREATE).Warningf("Column %s not found on row %v", r.hpaColumnName, row)
+		return
+	}
+
+	namespace, err := r.namespaces.Resolve(r.hpaNamespace, row)
+	if err != nil {
+		r.tenantLog(logs.OPERATION_NAMESPACE, deploymentSuffix).Errorf("Unable to resolve namespace of HPA %s %s", deploymentSuffix, err)
+		return
+	}
+
+	// The hpa waits with its deployment for a managed deployment to be removed
+	//
+	managedKey := buildManagedKey(r.hpaNamespace, r.deploymentName, deploymentSuffix)
+	if r.throttle.isQueued(managedKey) {
+		return
+	}
+
+	hpa, err := r.getHpa(deploymentSuffix, namespace)
+	if err != nil {
+		r.tenantLog(logs.OPERATION_CREATE, deploymentSuffix).Errorf("Unable to get HPA info for %s %s", deploymentSuffix, err)
+		return
+	}
+
+	if hpa != nil {
+		r.updateHpaReplicas(hpa, row)
+		return
+	}
+
+	r.throttle.submitCreation("hpa", managedKey, func() {
+		r.createHpa(deploymentSuffix, namespace, row)
+	})
+}
+
+func (r *HpaReconciler) SetNamespaceManager(namespaces *NamespaceManager) {
+	r.namespaces = namespaces
+}
+
+func (r *HpaReconciler) SetThrottle(throttle *Throttle) {
+	r.throttle = throttle
+}
+
+// SetRemoveChannel sets the channel of the tenants removed from the database, their hpas
+//
+//	are removed by Run.
+func (r *HpaReconciler) SetRemoveChannel(removeHpas <-chan string) {
+	r.removeHpas = removeHpas
+}
+
+// Run removes the hpas of the removed tenants until ctx is done
+func (r *HpaReconciler) Run(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case nameSuffix, ok := <-r.removeHpas:
+			if !ok {
+				return
+			}
+
+			managedKey := buildManagedKey(r.hpaNamespace, r.deploymentName, nameSuffix)
+			r.throttle.submitRemoval("hpa", managedKey, func() {
+				r.removeHpa(ctx, nameSuffix)
+			})
+		}
+	}
+}
+
+func (r *HpaReconciler) SetupWithManager(mgr ctrl.Manager) error {
+	r.recorder = mgr.GetEventRecorderFor(EVENT_RECORDER_NAME)
+
+	return ctrl.NewControllerManagedBy(mgr).
+		For(&autoscalingv2.HorizontalPodAutoscaler{}).
+		Complete(r)
+}
@@ -0,0 +1,67 @@
+package controller
+
+import (
+	"context"
+	"reflect"
+	"sort"
+	"testing"
+
+	autoscalingv2 "k8s.io/api/autoscaling/v2"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/scheme"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+func newTestHpa(name string, nameSuffix string) *autoscalingv2.HorizontalPodAutoscaler {
+	hpa := &autoscalingv2.HorizontalPodAutoscaler{ObjectMeta: v1.ObjectMeta{Name: name, Namespace: "default"}}
+	if nameSuffix != "" {
+		hpa.Annotations = map[string]string{HPA_ID_ANNOTATION_NAME: nameSuffix}
+	}
+
+	return hpa
+}
+
+func TestRemoveHpa(t *testing.T) {
+	tests := []struct {
+		name      string
+		removed   string
+		remaining []string
+	}{
+		{name: "removed tenant", removed: "a", remaining: []string{"api", "api-b", "other-a"}},
+		{name: "unknown tenant", removed: "c", remaining: []string{"api", "api-a", "api-b", "other-a"}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			c := fake.NewClientBuilder().WithScheme(scheme.Scheme).WithObjects(
+				newTestHpa("api", ""),
+				newTestHpa("api-a", "a"),
+				newTestHpa("api-b", "b"),
+				newTestHpa("other-a", "a"),
+			).Build()
+
+			r, err := NewHpaController(c, "default", "api", "tenant_id", "web", "", "")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			r.removeHpa(context.Background(), test.removed)
+
+			hpas := autoscalingv2.HorizontalPodAutoscalerList{}
+			if err := c.List(context.Background(), &hpas, client.InNamespace("default")); err != nil {
+				t.Fatal(err)
+			}
+
+			remaining := make([]string, 0)
+			for _, hpa := range hpas.Items {
+				remaining = append(remaining, hpa.Name)
+			}
+
+			sort.Strings(remaining)
+			if !reflect.DeepEqual(remaining, test.remaining) {
+				t.Fatalf("expected %v, got %v", test.remaining, remaining)
+			}
+		})
+	}
+}
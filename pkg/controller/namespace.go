@@ -0,0 +1,366 @@
+package controller
+
+import (
+	"bytes"
+	"context"
+	"dvdlevanon/kubernetes-database-scaler/pkg/logs"
+	"dvdlevanon/kubernetes-database-scaler/pkg/tablewatch"
+	"fmt"
+	"sort"
+	"strings"
+	"text/template"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/util/retry"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+const MANAGED_BY_LABEL_NAME = "app.kubernetes.io/managed-by"
+const MANAGED_BY_LABEL_VALUE = "kubernetes-database-scaler"
+const TENANTS_ANNOTATION_NAME = "kubernetes-database-scaler/tenants"
+
+// NamespaceManager decides in which namespace the duplicates of a row are placed,
+//
+//	by default it is the namespace of the original objects.
+type NamespaceManager struct {
+	client.Client
+	originalNamespace     string
+	namespaceColumn       string
+	namespaceTemplate     *template.Template
+	create                bool
+	remove                bool
+	labels                map[string]string
+	resourceQuotaTemplate string
+	limitRangeTemplate    string
+}
+
+func buildLabelsMap(labels []string) (map[string]string, error) {
+	result := make(map[string]string)
+	for _, label := range labels {
+		parts := strings.Split(label, "=")
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("invalid label format %s (e.g name=value)", label)
+		}
+
+		result[parts[0]] = parts[1]
+	}
+
+	return result, nil
+}
+
+func NewNamespaceManager(client client.Client, originalNamespace string, namespaceColumn string,
+	namespaceTemplate string, create bool, remove bool, labels []string,
+	resourceQuotaTemplate string, limitRangeTemplate string) (*NamespaceManager, error) {
+
+	if namespaceColumn != "" && namespaceTemplate != "" {
+		return nil, fmt.Errorf("namespace column and namespace template are mutually exclusive")
+	}
+
+	var tmpl *template.Template
+	if namespaceTemplate != "" {
+		var err error
+		tmpl, err = template.New("namespace").Option("missingkey=error").Parse(namespaceTemplate)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	labelsMap, err := buildLabelsMap(labels)
+	if err != nil {
+		return nil, err
+	}
+
+	return &NamespaceManager{
+		Client:                client,
+		originalNamespace:     originalNamespace,
+		namespaceColumn:       namespaceColumn,
+		namespaceTemplate:     tmpl,
+		create:                create,
+		remove:                remove,
+		labels:                labelsMap,
+		resourceQuotaTemplate: resourceQuotaTemplate,
+		limitRangeTemplate:    limitRangeTemplate,
+	}, nil
+}
+
+// IsPerTenant is true when duplicates may live outside of the original namespace.
+func (m *NamespaceManager) IsPerTenant() bool {
+	return m != nil && (m.namespaceColumn != "" || m.namespaceTemplate != nil)
+}
+
+func (m *NamespaceManager) Resolve(originalNamespace string, row tablewatch.Row) (string, error) {
+	if !m.IsPerTenant() {
+		return originalNamespace, nil
+	}
+
+	if m.namespaceColumn != "" {
+		namespace, ok := row[m.namespaceColumn]
+		if !ok || namespace == "" {
+			return "", fmt.Errorf("namespace column %s not found in row %v", m.namespaceColumn, row)
+		}
+
+		return namespace, nil
+	}
+
+	var buf bytes.Buffer
+	if err := m.namespaceTemplate.Execute(&buf, row); err != nil {
+		return "", err
+	}
+
+	return strings.ToLower(buf.String()), nil
+}
+
+func (m *NamespaceManager) Ensure(ctx context.Context, namespace string, deploymentId string) error {
+	if !m.IsPerTenant() || !m.create {
+		return nil
+	}
+
+	log := logger.WithTenant(deploymentId).WithOperation(logs.OPERATION_NAMESPACE)
+	existing := corev1.Namespace{}
+	err := m.Get(ctx, types.NamespacedName{Name: namespace}, &existing)
+	if err == nil {
+		return m.addTenant(ctx, &existing, deploymentId)
+	}
+
+	if !apierrors.IsNotFound(err) {
+		return err
+	}
+
+	log.Infof("Creating namespace %s for %s", namespace, deploymentId)
+
+	labels := map[string]string{MANAGED_BY_LABEL_NAME: MANAGED_BY_LABEL_VALUE}
+	for key, value := range m.labels {
+		labels[key] = value
+	}
+
+	new := corev1.Namespace{
+		ObjectMeta: v1.ObjectMeta{
+			Name:        namespace,
+			Labels:      labels,
+			Annotations: map[string]string{TENANTS_ANNOTATION_NAME: deploymentId},
+		},
+	}
+
+	if err := m.Create(ctx, &new); err != nil {
+		if !apierrors.IsAlreadyExists(err) {
+			log.Errorf("Unable to create namespace %s %s", namespace, err)
+			return err
+		}
+
+		// Created meanwhile for another tenant
+		//
+		if err := m.Get(ctx, types.NamespacedName{Name: namespace}, &existing); err != nil {
+			return err
+		}
+
+		if err := m.addTenant(ctx, &existing, deploymentId); err != nil {
+			return err
+		}
+	}
+
+	if err := m.duplicateResourceQuota(ctx, namespace); err != nil {
+		return err
+	}
+
+	return m.duplicateLimitRange(ctx, namespace)
+}
+
+func (m *NamespaceManager) duplicateResourceQuota(ctx context.Context, namespace string) error {
+	if m.resourceQuotaTemplate == "" {
+		return nil
+	}
+
+	key := types.NamespacedName{Namespace: m.originalNamespace, Name: m.resourceQuotaTemplate}
+	orig := corev1.ResourceQuota{}
+	if err := m.Get(ctx, key, &orig); err != nil {
+		logger.WithOperation(logs.OPERATION_NAMESPACE).Errorf("Unable to get resource quota template %v %s", key, err)
+		return err
+	}
+
+	new := corev1.ResourceQuota{
+		ObjectMeta: v1.ObjectMeta{
+			Name:        orig.Name,
+			Namespace:   namespace,
+			Labels:      orig.Labels,
+			Annotations: orig.Annotations,
+		},
+		Spec: orig.Spec,
+	}
+
+	if err := m.Create(ctx, &new); err != nil && !apierrors.IsAlreadyExists(err) {
+		logger.WithOperation(logs.OPERATION_NAMESPACE).Errorf("Unable to create resource quota in %s %s", namespace, err)
+		return err
+	}
+
+	return nil
+}
+
+func (m *NamespaceManager) duplicateLimitRange(ctx context.Context, namespace string) error {
+	if m.limitRangeTemplate == "" {
+		return nil
+	}
+
+	key := types.NamespacedName{Namespace: m.originalNamespace, Name: m.limitRangeTemplate}
+	orig := corev1.LimitRange{}
+	if err := m.Get(ctx, key, &orig); err != nil {
+		logger.WithOperation(logs.OPERATION_NAMESPACE).Errorf("Unable to get limit range template %v %s", key, err)
+		return err
+	}
+
+	new := corev1.LimitRange{
+		ObjectMeta: v1.ObjectMeta{
+			Name:        orig.Name,
+			Namespace:   namespace,
+			Labels:      orig.Labels,
+			Annotations: orig.Annotations,
+		},
+		Spec: orig.Spec,
+	}
+
+	if err := m.Create(ctx, &new); err != nil && !apierrors.IsAlreadyExists(err) {
+		logger.WithOperation(logs.OPERATION_NAMESPACE).Errorf("Unable to create limit range in %s %s", namespace, err)
+		return err
+	}
+
+	return nil
+}
+
+// getNamespaceTenants returns the ids of the tenants placed in a namespace created by the scaler,
+//
+//	namespaces created by older versions hold a single id.
+func getNamespaceTenants(namespace *corev1.Namespace) []string {
+	tenants, ok := namespace.Annotations[TENANTS_ANNOTATION_NAME]
+	if !ok {
+		tenants = namespace.Annotations[DEPLOYMENT_ID_ANNOTATION_NAME]
+	}
+
+	if tenants == "" {
+		return []string{}
+	}
+
+	return strings.Split(tenants, ",")
+}
+
+func containsTenant(tenants []string, deploymentId string) bool {
+	for _, tenant := range tenants {
+		if tenant == deploymentId {
+			return true
+		}
+	}
+
+	return false
+}
+
+// updateTenants stores the tenants of a namespace, retrying when the namespace changed meanwhile.
+//
+//	A namespace left without tenants is deleted, unless another tenant was added to it meanwhile.
+func (m *NamespaceManager) updateTenants(ctx context.Context, name string, update func(tenants []string) []string) error {
+	return retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		namespace := corev1.Namespace{}
+		if err := m.Get(ctx, types.NamespacedName{Name: name}, &namespace); err != nil {
+			return err
+		}
+
+		tenants := update(getNamespaceTenants(&namespace))
+		if len(tenants) == 0 {
+			return m.Delete(ctx, &namespace, client.Preconditions{ResourceVersion: &namespace.ResourceVersion})
+		}
+
+		sort.Strings(tenants)
+		if namespace.Annotations == nil {
+			namespace.Annotations = make(map[string]string)
+		}
+
+		namespace.Annotations[TENANTS_ANNOTATION_NAME] = strings.Join(tenants, ",")
+		delete(namespace.Annotations, DEPLOYMENT_ID_ANNOTATION_NAME)
+		return m.Update(ctx, &namespace)
+	})
+}
+
+// addTenant records deploymentId on a namespace created by the scaler, so the namespace is kept
+//
+//	as long as one of its tenants is still found in the database.
+func (m *NamespaceManager) addTenant(ctx context.Context, namespace *corev1.Namespace, deploymentId string) error {
+	if namespace.Labels[MANAGED_BY_LABEL_NAME] != MANAGED_BY_LABEL_VALUE {
+		return nil
+	}
+
+	if containsTenant(getNamespaceTenants(namespace), deploymentId) {
+		return nil
+	}
+
+	log := logger.WithTenant(deploymentId).WithOperation(logs.OPERATION_NAMESPACE)
+	log.Infof("Adding %s to the tenants of namespace %s", deploymentId, namespace.Name)
+	err := m.updateTenants(ctx, namespace.Name, func(tenants []string) []string {
+		if containsTenant(tenants, deploymentId) {
+			return tenants
+		}
+
+		return append(tenants, deploymentId)
+	})
+
+	if err != nil {
+		log.Errorf("Unable to add %s to the tenants of namespace %s %s", deploymentId, namespace.Name, err)
+	}
+
+	return err
+}
+
+// Remove removes deploymentId from the tenants of the namespaces created by the scaler, a namespace
+//
+//	is deleted with its last tenant. Namespaces that existed before the scaler touched them are never removed.
+func (m *NamespaceManager) Remove(ctx context.Context, deploymentId string) {
+	if !m.IsPerTenant() || !m.remove {
+		return
+	}
+
+	log := logger.WithTenant(deploymentId).WithOperation(logs.OPERATION_NAMESPACE)
+	namespaces := corev1.NamespaceList{}
+	err := m.List(ctx, &namespaces, client.MatchingLabels{MANAGED_BY_LABEL_NAME: MANAGED_BY_LABEL_VALUE})
+	if err != nil {
+		log.Errorf("Error getting managed namespaces %s", err)
+		return
+	}
+
+	for _, namespace := range namespaces.Items {
+		if !containsTenant(getNamespaceTenants(&namespace), deploymentId) {
+			continue
+		}
+
+		if namespace.Status.Phase == corev1.NamespaceTerminating {
+			continue
+		}
+
+		log.Infof("Removing %s from the tenants of namespace %s", deploymentId, namespace.Name)
+		err := m.updateTenants(ctx, namespace.Name, func(tenants []string) []string {
+			remaining := make([]string, 0, len(tenants))
+			for _, tenant := range tenants {
+				if tenant != deploymentId {
+					remaining = append(remaining, tenant)
+				}
+			}
+
+			if len(remaining) == 0 {
+				log.Infof("Removing namespace %s of %s", namespace.Name, deploymentId)
+			}
+
+			return remaining
+		})
+
+		if err != nil && !apierrors.IsNotFound(err) {
+			log.Errorf("Unable to remove %s from namespace %s %s", deploymentId, namespace.Name, err)
+		}
+	}
+}
+
+// ListOptions returns where to look for duplicates of objects from originalNamespace.
+func (m *NamespaceManager) ListOptions(originalNamespace string) []client.ListOption {
+	if m.IsPerTenant() {
+		return []client.ListOption{}
+	}
+
+	return []client.ListOption{client.InNamespace(originalNamespace)}
+}
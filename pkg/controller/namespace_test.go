@@ -0,0 +1,127 @@
+package controller
+
+import (
+	"context"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes/scheme"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+func newManagedNamespace(annotations map[string]string) *corev1.Namespace {
+	return &corev1.Namespace{ObjectMeta: v1.ObjectMeta{
+		Name:        "shared",
+		Labels:      map[string]string{MANAGED_BY_LABEL_NAME: MANAGED_BY_LABEL_VALUE},
+		Annotations: annotations,
+	}}
+}
+
+func TestNamespaceTenants(t *testing.T) {
+	tests := []struct {
+		name     string
+		existing *corev1.Namespace
+		ensure   []string
+		remove   []string
+		tenants  string
+		deleted  bool
+	}{
+		{
+			name:    "created for a tenant",
+			ensure:  []string{"a"},
+			tenants: "a",
+		},
+		{
+			name:    "shared by tenants",
+			ensure:  []string{"b", "a", "b"},
+			tenants: "a,b",
+		},
+		{
+			name:    "one of the tenants removed",
+			ensure:  []string{"a", "b"},
+			remove:  []string{"a"},
+			tenants: "b",
+		},
+		{
+			name:    "last tenant removed",
+			ensure:  []string{"a", "b"},
+			remove:  []string{"a", "b"},
+			deleted: true,
+		},
+		{
+			name:    "unknown tenant removed",
+			ensure:  []string{"a"},
+			remove:  []string{"c"},
+			tenants: "a",
+		},
+		{
+			name:     "created by an older version",
+			existing: newManagedNamespace(map[string]string{DEPLOYMENT_ID_ANNOTATION_NAME: "a"}),
+			ensure:   []string{"b"},
+			remove:   []string{"a"},
+			tenants:  "b",
+		},
+		{
+			name:     "last tenant of an older version removed",
+			existing: newManagedNamespace(map[string]string{DEPLOYMENT_ID_ANNOTATION_NAME: "a"}),
+			remove:   []string{"a"},
+			deleted:  true,
+		},
+		{
+			name:     "not created by the scaler",
+			existing: &corev1.Namespace{ObjectMeta: v1.ObjectMeta{Name: "shared"}},
+			ensure:   []string{"a"},
+			remove:   []string{"a"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			builder := fake.NewClientBuilder().WithScheme(scheme.Scheme)
+			if test.existing != nil {
+				builder = builder.WithObjects(test.existing)
+			}
+
+			c := builder.Build()
+			m, err := NewNamespaceManager(c, "default", "", "shared", true, true, nil, "", "")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			for _, deploymentId := range test.ensure {
+				if err := m.Ensure(context.Background(), "shared", deploymentId); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			for _, deploymentId := range test.remove {
+				m.Remove(context.Background(), deploymentId)
+			}
+
+			namespace := corev1.Namespace{}
+			err = c.Get(context.Background(), types.NamespacedName{Name: "shared"}, &namespace)
+			if test.deleted != apierrors.IsNotFound(err) {
+				t.Fatalf("expected deleted %v, got %v", test.deleted, err)
+			}
+
+			if test.deleted {
+				return
+			}
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if tenants := namespace.Annotations[TENANTS_ANNOTATION_NAME]; tenants != test.tenants {
+				t.Fatalf("expected tenants %q, got %q", test.tenants, tenants)
+			}
+
+			if _, ok := namespace.Annotations[DEPLOYMENT_ID_ANNOTATION_NAME]; ok && test.tenants != "" {
+				t.Fatalf("expected the older annotation to be replaced, got %v", namespace.Annotations)
+			}
+		})
+	}
+}
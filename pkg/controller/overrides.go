@@ -0,0 +1,300 @@
+package controller
+
+import (
+	"context"
+	"crypto/sha256"
+	"dvdlevanon/kubernetes-database-scaler/pkg/logs"
+	"dvdlevanon/kubernetes-database-scaler/pkg/tablewatch"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+
+	jsonpatch "github.com/evanphx/json-patch"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/util/strategicpatch"
+)
+
+const OVERRIDES_ANNOTATION_NAME = "kubernetes-database-scaler/overrides"
+
+const OVERRIDE_TYPE_STRATEGIC = "strategic"
+const OVERRIDE_TYPE_JSON = "json"
+
+const (
+	REASON_OVERRIDE_APPLIED  = "OverrideApplied"
+	REASON_OVERRIDE_REJECTED = "OverrideRejected"
+)
+
+type OverridesSource interface {
+	ReadOverrides(ctx context.Context) ([]tablewatch.Override, error)
+}
+
+// OverridesListener is notified with the tenants whose overrides changed
+type OverridesListener interface {
+	OnOverridesChanged(tenants []string)
+}
+
+// Overrides keeps the valid overrides of every tenant, read periodically from the overrides table.
+//
+//	A strategic merge patch or a json patch (RFC 6902) is applied on top of the duplicated deployment,
+//	overrides that aren't valid json, or that fail to apply, are skipped and reported.
+type Overrides struct {
+	source    OverridesSource
+	lock      sync.Mutex
+	patches   map[string][]tablewatch.Override
+	listeners []OverridesListener
+}
+
+func NewOverrides(source OverridesSource) (*Overrides, error) {
+	if source == nil {
+		return nil, fmt.Errorf("overrides source is nil")
+	}
+
+	return &Overrides{
+		source:  source,
+		patches: make(map[string][]tablewatch.Override),
+	}, nil
+}
+
+func (o *Overrides) AddListener(listener OverridesListener) {
+	o.listeners = append(o.listeners, listener)
+}
+
+// Run refreshes the overrides every interval until ctx is done
+func (o *Overrides) Run(ctx context.Context, interval time.Duration) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(interval):
+		}
+
+		if err := o.Refresh(ctx); err != nil {
+			logger.WithOperation(logs.OPERATION_OVERRIDE).Errorf("Unable to read overrides %s", err)
+		}
+	}
+}
+
+// Refresh reads the overrides and notifies the listeners of the tenants whose overrides changed
+func (o *Overrides) Refresh(ctx context.Context) error {
+	overrides, err := o.source.ReadOverrides(ctx)
+	if err != nil {
+		return err
+	}
+
+	patches := make(map[string][]tablewatch.Override)
+	for _, override := range overrides {
+		if err := validateOverride(override); err != nil {
+			logger.WithTenant(override.Tenant).WithOperation(logs.OPERATION_OVERRIDE).Warningf("Skipping override of %s %s", override.Tenant, err)
+			continue
+		}
+
+		patches[override.Tenant] = append(patches[override.Tenant], override)
+	}
+
+	o.lock.Lock()
+	changed := make([]string, 0)
+	for tenant := range patches {
+		if !reflect.DeepEqual(patches[tenant], o.patches[tenant]) {
+			changed = append(changed, tenant)
+		}
+	}
+
+	for tenant := range o.patches {
+		if _, ok := patches[tenant]; !ok {
+			changed = append(changed, tenant)
+		}
+	}
+
+	o.patches = patches
+	o.lock.Unlock()
+
+	if len(changed) == 0 {
+		return nil
+	}
+
+	logger.WithOperation(logs.OPERATION_OVERRIDE).Infof("Overrides of %d tenants changed", len(changed))
+	for _, listener := range o.listeners {
+		listener.OnOverridesChanged(changed)
+	}
+
+	return nil
+}
+
+func validateOverride(override tablewatch.Override) error {
+	switch getOverrideType(override) {
+	case OVERRIDE_TYPE_STRATEGIC:
+		patch := make(map[string]interface{})
+		if err := json.Unmarshal([]byte(override.Patch), &patch); err != nil {
+			return fmt.Errorf("invalid strategic merge patch %s", err)
+		}
+	case OVERRIDE_TYPE_JSON:
+		if _, err := jsonpatch.DecodePatch([]byte(override.Patch)); err != nil {
+			return fmt.Errorf("invalid json patch %s", err)
+		}
+	default:
+		return fmt.Errorf("invalid override type %s (strategic, json)", override.Type)
+	}
+
+	return nil
+}
+
+func getOverrideType(override tablewatch.Override) string {
+	if override.Type == "" {
+		return OVERRIDE_TYPE_STRATEGIC
+	}
+
+	return strings.ToLower(override.Type)
+}
+
+func (o *Overrides) get(tenant string) []tablewatch.Override {
+	if o == nil {
+		return nil
+	}
+
+	o.lock.Lock()
+	defer o.lock.Unlock()
+
+	return o.patches[tenant]
+}
+
+func buildOverrideDigest(override tablewatch.Override) string {
+	digest := sha256.Sum256([]byte(override.Patch))
+	return fmt.Sprintf("%s:%s", getOverrideType(override), hex.EncodeToString(digest[:])[:12])
+}
+
+func applyOverride(data []byte, override tablewatch.Override) ([]byte, error) {
+	if getOverrideType(override) == OVERRIDE_TYPE_JSON {
+		patch, err := jsonpatch.DecodePatch([]byte(override.Patch))
+		if err != nil {
+			return nil, err
+		}
+
+		return patch.Apply(data)
+	}
+
+	return strategicpatch.StrategicMergePatch(data, []byte(override.Patch), appsv1.Deployment{})
+}
+
+// applyOverrides patches a rendered duplicate with the overrides of its tenant, the identity of
+//
+//	the duplicate can't be overridden. The applied overrides are listed in an annotation by type
+//	and digest of their patch.
+func (r *DeploymentReconciler) applyOverrides(new *appsv1.Deployment, nameSuffix string) *appsv1.Deployment {
+	overrides := r.overrides.get(nameSuffix)
+	if len(overrides) == 0 {
+		return new
+	}
+
+	data, err := json.Marshal(new)
+	if err != nil {
+		r.tenantLog(logs.OPERATION_OVERRIDE, nameSuffix).Errorf("Unable to serialize deployment %s %s", new.Name, err)
+		return new
+	}
+
+	applied := make([]string, 0, len(overrides))
+	for _, override := range overrides {
+		patched, err := applyOverride(data, override)
+		if err != nil {
+			r.tenantLog(logs.OPERATION_OVERRIDE, nameSuffix).Warningf("Unable to apply override %s of %s %s", buildOverrideDigest(override), nameSuffix, err)
+			recordEvent(r.recorder, r.originalReference(), corev1.EventTypeWarning, REASON_OVERRIDE_REJECTED,
+				"Skipping override %s of %s: %s", buildOverrideDigest(override), nameSuffix, err)
+			continue
+		}
+
+		data = patched
+		applied = append(applied, buildOverrideDigest(override))
+	}
+
+	result := appsv1.Deployment{}
+	if err := json.Unmarshal(data, &result); err != nil {
+		r.tenantLog(logs.OPERATION_OVERRIDE, nameSuffix).Warningf("Unable to apply the overrides of %s %s", nameSuffix, err)
+		return new
+	}
+
+	result.ObjectMeta.Namespace = new.Namespace
+	result.ObjectMeta.Name = new.Name
+	result.Spec.Selector = new.Spec.Selector
+	if result.ObjectMeta.Annotations == nil {
+		result.ObjectMeta.Annotations = make(map[string]string)
+	}
+
+	for _, key := range []string{DEPLOYMENT_ID_ANNOTATION_NAME, ORIGINAL_DEPLOYMENT_ANNOTATION_NAME,
+		ORIGINAL_OBSERVED_GENERATION_ANNOTATION_NAME, TEMPLATE_VERSION_ANNOTATION_NAME} {
+		result.ObjectMeta.Annotations[key] = new.ObjectMeta.Annotations[key]
+	}
+
+	if len(applied) > 0 {
+		result.ObjectMeta.Annotations[OVERRIDES_ANNOTATION_NAME] = strings.Join(applied, ",")
+	}
+
+	return &result
+}
+
+func (r *DeploymentReconciler) SetOverrides(overrides *Overrides) {
+	r.overrides = overrides
+	overrides.AddListener(r)
+}
+
+// OnOverridesChanged renders the duplicates of the tenants again, from the version each of them runs
+func (r *DeploymentReconciler) OnOverridesChanged(tenants []string) {
+	ctx := context.Background()
+	original, err := r.getExistingDeployment()
+	if err != nil {
+		return
+	}
+
+	for _, tenant := range tenants {
+		deployment, err := r.findDuplicatedDeployment(ctx, tenant)
+		if err != nil || deployment == nil {
+			continue
+		}
+
+		template := original
+		version := deployment.Annotations[TEMPLATE_VERSION_ANNOTATION_NAME]
+		if version != "" && version != getTemplateVersion(original) {
+			if r.templates == nil {
+				continue
+			}
+
+			template, err = r.templates.Load(ctx, r.deploymentNamespace, r.deploymentName, version)
+			if err != nil {
+				r.tenantLog(logs.OPERATION_OVERRIDE, tenant).Errorf("Unable to load version %s of %s %s", version, r.deploymentName, err)
+				continue
+			}
+		}
+
+		environmentMap, err := r.getEnvironmentMap(*deployment)
+		if err != nil {
+			r.tenantLog(logs.OPERATION_OVERRIDE, tenant).Errorf("Unable to build envrionment map of %s %s", deployment.Name, err)
+			continue
+		}
+
+		new := r.duplicateDeployment(template, tenant, environmentMap, deployment.Namespace)
+		new.Annotations[ORIGINAL_OBSERVED_GENERATION_ANNOTATION_NAME] = deployment.Annotations[ORIGINAL_OBSERVED_GENERATION_ANNOTATION_NAME]
+		if version, ok := deployment.Annotations[ROW_PINNED_VERSION_ANNOTATION_NAME]; ok {
+			new.Annotations[ROW_PINNED_VERSION_ANNOTATION_NAME] = version
+		}
+
+		if err := r.applyDuplicate(ctx, new, deployment, false); err != nil {
+			r.tenantLog(logs.OPERATION_OVERRIDE, tenant).Errorf("Unable to apply the overrides of %s %s", deployment.Name, err)
+			recordApplyError(r.recorder, deployment, err, "Unable to apply overrides: %s", err)
+			continue
+		}
+
+		recordEvent(r.recorder, new, corev1.EventTypeNormal, REASON_OVERRIDE_APPLIED,
+			"Overrides changed: %s", withDefaultValue(new.Annotations[OVERRIDES_ANNOTATION_NAME], "none"))
+	}
+}
+
+func withDefaultValue(value string, defaultValue string) string {
+	if value == "" {
+		return defaultValue
+	}
+
+	return value
+}
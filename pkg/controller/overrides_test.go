@@ -0,0 +1,319 @@
+package controller
+
+import (
+	"context"
+	"dvdlevanon/kubernetes-database-scaler/pkg/tablewatch"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/scheme"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+type testOverridesSource struct {
+	overrides []tablewatch.Override
+}
+
+func (s *testOverridesSource) ReadOverrides(ctx context.Context) ([]tablewatch.Override, error) {
+	return s.overrides, nil
+}
+
+type testOverridesListener struct {
+	changed []string
+}
+
+func (l *testOverridesListener) OnOverridesChanged(tenants []string) {
+	l.changed = append(l.changed, tenants...)
+	sort.Strings(l.changed)
+}
+
+func TestValidateOverride(t *testing.T) {
+	tests := []struct {
+		name     string
+		override tablewatch.Override
+		valid    bool
+	}{
+		{name: "strategic by default", override: tablewatch.Override{Patch: `{"spec": {"replicas": 3}}`}, valid: true},
+		{name: "strategic", override: tablewatch.Override{Type: "Strategic", Patch: `{"spec": {"replicas": 3}}`}, valid: true},
+		{name: "json", override: tablewatch.Override{Type: "json", Patch: `[{"op": "replace", "path": "/spec/replicas", "value": 3}]`}, valid: true},
+		{name: "invalid strategic", override: tablewatch.Override{Patch: `{"spec": `}},
+		{name: "strategic list", override: tablewatch.Override{Patch: `[{"op": "replace"}]`}},
+		{name: "invalid json", override: tablewatch.Override{Type: "json", Patch: `{"spec": {"replicas": 3}}`}},
+		{name: "invalid type", override: tablewatch.Override{Type: "merge", Patch: `{"spec": {"replicas": 3}}`}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if err := validateOverride(test.override); test.valid != (err == nil) {
+				t.Fatalf("expected valid %v, got %v", test.valid, err)
+			}
+		})
+	}
+}
+
+func TestOverridesRefresh(t *testing.T) {
+	source := &testOverridesSource{}
+	overrides, err := NewOverrides(source)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	steps := []struct {
+		name      string
+		overrides []tablewatch.Override
+		changed   []string
+	}{
+		{
+			name: "added",
+			overrides: []tablewatch.Override{
+				{Tenant: "a", Patch: `{"spec": {"replicas": 3}}`},
+				{Tenant: "b", Patch: `{"spec": {"replicas": 2}}`},
+				{Tenant: "c", Patch: `{"spec": `},
+			},
+			changed: []string{"a", "b"},
+		},
+		{
+			name: "unchanged",
+			overrides: []tablewatch.Override{
+				{Tenant: "a", Patch: `{"spec": {"replicas": 3}}`},
+				{Tenant: "b", Patch: `{"spec": {"replicas": 2}}`},
+				{Tenant: "c", Patch: `{"spec": `},
+			},
+		},
+		{
+			name: "changed and removed",
+			overrides: []tablewatch.Override{
+				{Tenant: "a", Patch: `{"spec": {"replicas": 4}}`},
+				{Tenant: "c", Patch: `{"spec": {"replicas": 1}}`},
+			},
+			changed: []string{"a", "b", "c"},
+		},
+		{
+			name: "another override of a tenant",
+			overrides: []tablewatch.Override{
+				{Tenant: "a", Patch: `{"spec": {"replicas": 4}}`},
+				{Tenant: "a", Type: "json", Patch: `[{"op": "add", "path": "/metadata/labels/plan", "value": "pro"}]`},
+				{Tenant: "c", Patch: `{"spec": {"replicas": 1}}`},
+			},
+			changed: []string{"a"},
+		},
+	}
+
+	for _, step := range steps {
+		listener := &testOverridesListener{}
+		overrides.listeners = []OverridesListener{listener}
+		source.overrides = step.overrides
+		if err := overrides.Refresh(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+
+		if !reflect.DeepEqual(listener.changed, step.changed) {
+			t.Fatalf("%s: expected changed %v, got %v", step.name, step.changed, listener.changed)
+		}
+	}
+
+	if patches := overrides.get("a"); len(patches) != 2 {
+		t.Fatalf("expected 2 overrides of a, got %v", patches)
+	}
+
+	if patches := overrides.get("b"); len(patches) != 0 {
+		t.Fatalf("expected no overrides of b, got %v", patches)
+	}
+}
+
+func newTestDuplicate() *appsv1.Deployment {
+	replicas := int32(1)
+	return &appsv1.Deployment{
+		ObjectMeta: v1.ObjectMeta{
+			Name:      "web-a",
+			Namespace: "default",
+			Annotations: map[string]string{
+				DEPLOYMENT_ID_ANNOTATION_NAME:                "a",
+				ORIGINAL_DEPLOYMENT_ANNOTATION_NAME:          "web",
+				ORIGINAL_OBSERVED_GENERATION_ANNOTATION_NAME: "3",
+				TEMPLATE_VERSION_ANNOTATION_NAME:             "3",
+			},
+		},
+		Spec: appsv1.DeploymentSpec{
+			Replicas: &replicas,
+			Selector: &v1.LabelSelector{MatchLabels: map[string]string{"name": "web-a"}},
+			Template: corev1.PodTemplateSpec{
+				Spec: corev1.PodSpec{Containers: []corev1.Container{{Name: "web", Image: "web:1"}}},
+			},
+		},
+	}
+}
+
+func TestApplyOverrides(t *testing.T) {
+	tests := []struct {
+		name      string
+		overrides []tablewatch.Override
+		replicas  int32
+		image     string
+		applied   []int
+	}{
+		{
+			name:     "no overrides",
+			replicas: 1,
+			image:    "web:1",
+		},
+		{
+			name:      "strategic",
+			overrides: []tablewatch.Override{{Tenant: "a", Patch: `{"spec": {"replicas": 3}}`}},
+			replicas:  3,
+			image:     "web:1",
+			applied:   []int{0},
+		},
+		{
+			name: "strategic and json in order",
+			overrides: []tablewatch.Override{
+				{Tenant: "a", Patch: `{"spec": {"template": {"spec": {"containers": [{"name": "web", "image": "web:2"}]}}}}`},
+				{Tenant: "a", Type: "json", Patch: `[{"op": "replace", "path": "/spec/template/spec/containers/0/image", "value": "web:3"}]`},
+			},
+			replicas: 1,
+			image:    "web:3",
+			applied:  []int{0, 1},
+		},
+		{
+			name: "failing override skipped",
+			overrides: []tablewatch.Override{
+				{Tenant: "a", Type: "json", Patch: `[{"op": "replace", "path": "/spec/missing/field", "value": 1}]`},
+				{Tenant: "a", Patch: `{"spec": {"replicas": 2}}`},
+			},
+			replicas: 2,
+			image:    "web:1",
+			applied:  []int{1},
+		},
+		{
+			name: "identity restored",
+			overrides: []tablewatch.Override{{Tenant: "a", Patch: `{"metadata": {"name": "other", "namespace": "kube-system",
+				"annotations": {"kubernetes-database-scaler/deployment-id": "b", "kubernetes-database-scaler/template-version": "1"}},
+				"spec": {"selector": {"matchLabels": {"name": "other"}}}}`}},
+			replicas: 1,
+			image:    "web:1",
+			applied:  []int{0},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			overrides, err := NewOverrides(&testOverridesSource{overrides: test.overrides})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			r := newTestDeploymentReconciler(t)
+			r.SetOverrides(overrides)
+			overrides.listeners = nil
+			if err := overrides.Refresh(context.Background()); err != nil {
+				t.Fatal(err)
+			}
+
+			duplicate := newTestDuplicate()
+			result := r.applyOverrides(duplicate.DeepCopy(), "a")
+			if *result.Spec.Replicas != test.replicas {
+				t.Fatalf("expected %d replicas, got %d", test.replicas, *result.Spec.Replicas)
+			}
+
+			if image := result.Spec.Template.Spec.Containers[0].Image; image != test.image {
+				t.Fatalf("expected image %s, got %s", test.image, image)
+			}
+
+			digests := make([]string, 0)
+			for _, i := range test.applied {
+				digests = append(digests, buildOverrideDigest(test.overrides[i]))
+			}
+
+			if applied := result.Annotations[OVERRIDES_ANNOTATION_NAME]; applied != strings.Join(digests, ",") {
+				t.Fatalf("expected applied overrides %v, got %q", digests, applied)
+			}
+
+			if result.Name != duplicate.Name || result.Namespace != duplicate.Namespace ||
+				!reflect.DeepEqual(result.Spec.Selector, duplicate.Spec.Selector) {
+				t.Fatalf("expected the identity of the duplicate to be kept, got %v", result.ObjectMeta)
+			}
+
+			for key, value := range duplicate.Annotations {
+				if result.Annotations[key] != value {
+					t.Fatalf("expected annotation %s to be %s, got %s", key, value, result.Annotations[key])
+				}
+			}
+		})
+	}
+}
+
+func TestRollbackKeepsOverrides(t *testing.T) {
+	original := &appsv1.Deployment{
+		ObjectMeta: v1.ObjectMeta{Name: "web", Namespace: "default", Generation: 3},
+		Spec: appsv1.DeploymentSpec{
+			Selector: &v1.LabelSelector{MatchLabels: map[string]string{"name": "web"}},
+			Template: corev1.PodTemplateSpec{
+				ObjectMeta: v1.ObjectMeta{Labels: map[string]string{"name": "web"}},
+				Spec:       corev1.PodSpec{Containers: []corev1.Container{{Name: "web", Image: "web:3"}}},
+			},
+		},
+		Status: appsv1.DeploymentStatus{ObservedGeneration: 3},
+	}
+
+	stored := original.DeepCopy()
+	stored.Generation = 2
+	stored.Status.ObservedGeneration = 2
+	stored.Spec.Template.Spec.Containers[0].Image = "web:2"
+
+	duplicate := newTestDuplicate()
+	duplicate.Spec.Selector.MatchLabels = map[string]string{"name": "web-a", TENANT_LABEL_NAME: "a"}
+
+	c := &applyClient{Client: fake.NewClientBuilder().WithScheme(scheme.Scheme).WithObjects(original, duplicate).Build()}
+	templates, err := NewTemplateStore(c, c, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := templates.Save(context.Background(), stored); err != nil {
+		t.Fatal(err)
+	}
+
+	override := tablewatch.Override{Tenant: "a", Patch: `{"spec": {"replicas": 3}}`}
+	overrides, err := NewOverrides(&testOverridesSource{overrides: []tablewatch.Override{override}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := overrides.Refresh(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := New(c, "default", "web", "tenant_id", nil, nil, []string{"name"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r.SetTemplateStore(templates)
+	r.SetOverrides(overrides)
+	if err := r.Rollback(context.Background(), "2", nil); err != nil {
+		t.Fatal(err)
+	}
+
+	rolledBack := appsv1.Deployment{}
+	if err := runtime.DefaultUnstructuredConverter.FromUnstructured(c.applied.Object, &rolledBack); err != nil {
+		t.Fatal(err)
+	}
+
+	if image := rolledBack.Spec.Template.Spec.Containers[0].Image; image != "web:2" {
+		t.Fatalf("expected image web:2, got %s", image)
+	}
+
+	if rolledBack.Spec.Replicas == nil || *rolledBack.Spec.Replicas != 3 {
+		t.Fatalf("expected the override of 3 replicas to be kept, got %v", rolledBack.Spec.Replicas)
+	}
+
+	if applied := rolledBack.Annotations[OVERRIDES_ANNOTATION_NAME]; applied != buildOverrideDigest(override) {
+		t.Fatalf("expected applied overrides %s, got %q", buildOverrideDigest(override), applied)
+	}
+}
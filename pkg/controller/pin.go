@@ -0,0 +1,126 @@
+package controller
+
+import (
+	"context"
+	"dvdlevanon/kubernetes-database-scaler/pkg/logs"
+	"dvdlevanon/kubernetes-database-scaler/pkg/tablewatch"
+	"fmt"
+	"reflect"
+
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+)
+
+const PINNED_VERSION_ANNOTATION_NAME = "kubernetes-database-scaler/pinned-version"
+const ROW_PINNED_VERSION_ANNOTATION_NAME = "kubernetes-database-scaler/row-pinned-version"
+
+// SetPinnedVersionColumn takes a row column holding the template version a tenant is pinned to,
+//
+//	an empty value follows the original deployment.
+func (r *DeploymentReconciler) SetPinnedVersionColumn(column string) {
+	r.pinnedVersionColumn = column
+}
+
+func (r *DeploymentReconciler) getRowPinnedVersion(row tablewatch.Row) string {
+	if r.pinnedVersionColumn == "" {
+		return ""
+	}
+
+	return row[r.pinnedVersionColumn]
+}
+
+// getPinnedVersion prefers the row of the duplicate, and falls back to its pinned version annotation.
+//
+//	Until the row is seen after startup, the version it pinned the duplicate to is recorded on the
+//	duplicate, so it isn't updated to the original in the meantime.
+func (r *DeploymentReconciler) getPinnedVersion(deployment appsv1.Deployment) string {
+	row, ok := r.getRow(deployment.Annotations[DEPLOYMENT_ID_ANNOTATION_NAME])
+	if version := r.getRowPinnedVersion(row); version != "" {
+		return version
+	}
+
+	if version := deployment.Annotations[PINNED_VERSION_ANNOTATION_NAME]; version != "" {
+		return version
+	}
+
+	if !ok && r.pinnedVersionColumn != "" {
+		return deployment.Annotations[ROW_PINNED_VERSION_ANNOTATION_NAME]
+	}
+
+	return ""
+}
+
+// splitPinnedDeployments separates the duplicates pinned to a template version from those following the original
+func (r *DeploymentReconciler) splitPinnedDeployments(deployments []appsv1.Deployment) ([]appsv1.Deployment, []appsv1.Deployment) {
+	following := make([]appsv1.Deployment, 0, len(deployments))
+	pinned := make([]appsv1.Deployment, 0)
+	for _, deployment := range deployments {
+		if r.getPinnedVersion(deployment) != "" {
+			pinned = append(pinned, deployment)
+		} else {
+			following = append(following, deployment)
+		}
+	}
+
+	return following, pinned
+}
+
+// renderPinnedDeployment renders a duplicate from a stored version, it keeps the generation of the
+//
+//	version so it's updated like any outdated duplicate once it's no longer pinned.
+func (r *DeploymentReconciler) renderPinnedDeployment(ctx context.Context, nameSuffix string,
+	environmentsMap map[string]string, namespace string, version string) (*appsv1.Deployment, error) {
+
+	if r.templates == nil {
+		return nil, fmt.Errorf("template history is disabled, unable to pin %s to version %s", nameSuffix, version)
+	}
+
+	template, err := r.templates.Load(ctx, r.deploymentNamespace, r.deploymentName, version)
+	if err != nil {
+		return nil, fmt.Errorf("unable to load version %s of %s %s", version, r.deploymentName, err)
+	}
+
+	new := r.duplicateDeployment(template, nameSuffix, environmentsMap, namespace)
+	if row, _ := r.getRow(nameSuffix); version == r.getRowPinnedVersion(row) {
+		new.Annotations[ROW_PINNED_VERSION_ANNOTATION_NAME] = version
+	}
+
+	return new, nil
+}
+
+// updatePinnedDeployment keeps a pinned duplicate on its version, only its environment follows
+//
+//	the row. Nothing is applied when both are up to date.
+func (r *DeploymentReconciler) updatePinnedDeployment(ctx context.Context, deployment appsv1.Deployment, version string) {
+	environmentMap, err := r.getEnvironmentMap(deployment)
+	if err != nil {
+		r.duplicateLog(logs.OPERATION_PIN, deployment).Errorf("Unable to build envrionment map of pinned %s %s", deployment.Name, err)
+		return
+	}
+
+	if deployment.Annotations[TEMPLATE_VERSION_ANNOTATION_NAME] == version {
+		current, err := r.buildEnvironmentMapFromDeployment(deployment)
+		if err == nil && reflect.DeepEqual(current, environmentMap) {
+			return
+		}
+	}
+
+	nameSuffix := deployment.Annotations[DEPLOYMENT_ID_ANNOTATION_NAME]
+	new, err := r.renderPinnedDeployment(ctx, nameSuffix, environmentMap, deployment.Namespace, version)
+	if err != nil {
+		r.duplicateLog(logs.OPERATION_PIN, deployment).Errorf("Unable to render pinned %s %s", deployment.Name, err)
+		recordEvent(r.recorder, &deployment, corev1.EventTypeWarning, REASON_UPDATE_FAILED,
+			"Unable to render pinned version: %s", err)
+		return
+	}
+
+	r.duplicateLog(logs.OPERATION_PIN, deployment).Infof("Updating %s pinned to version %s of %s", deployment.Name, version, r.deploymentName)
+	if err := r.applyDuplicate(ctx, new, &deployment, false); err != nil {
+		r.duplicateLog(logs.OPERATION_PIN, deployment).Errorf("Unable to update pinned deployment %s %s", deployment.Name, err)
+		recordApplyError(r.recorder, &deployment, err, "Unable to update pinned version %s: %s", version, err)
+		return
+	}
+
+	recordEvent(r.recorder, new, corev1.EventTypeNormal, REASON_DUPLICATE_UPDATED,
+		"Updated on pinned version %s of %s", version, r.deploymentName)
+}
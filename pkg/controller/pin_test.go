@@ -0,0 +1,106 @@
+package controller
+
+import (
+	"dvdlevanon/kubernetes-database-scaler/pkg/tablewatch"
+	"testing"
+
+	appsv1 "k8s.io/api/apps/v1"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestGetPinnedVersion(t *testing.T) {
+	tests := []struct {
+		name      string
+		column    string
+		row       tablewatch.Row
+		pinned    string
+		rowPinned string
+		expected  string
+	}{
+		{
+			name:     "not pinned",
+			column:   "version",
+			row:      tablewatch.Row{"tenant_id": "a"},
+			expected: "",
+		},
+		{
+			name:     "row column",
+			column:   "version",
+			row:      tablewatch.Row{"tenant_id": "a", "version": "12"},
+			expected: "12",
+		},
+		{
+			name:     "row column over the annotation",
+			column:   "version",
+			row:      tablewatch.Row{"tenant_id": "a", "version": "12"},
+			pinned:   "11",
+			expected: "12",
+		},
+		{
+			name:     "annotation when the row column is empty",
+			column:   "version",
+			row:      tablewatch.Row{"tenant_id": "a", "version": ""},
+			pinned:   "11",
+			expected: "11",
+		},
+		{
+			name:     "annotation without a column",
+			pinned:   "11",
+			expected: "11",
+		},
+		{
+			name:      "annotation over the recorded row version",
+			column:    "version",
+			pinned:    "11",
+			rowPinned: "10",
+			expected:  "11",
+		},
+		{
+			name:      "recorded row version until the row is seen",
+			column:    "version",
+			rowPinned: "10",
+			expected:  "10",
+		},
+		{
+			name:      "recorded row version ignored once the row is seen",
+			column:    "version",
+			row:       tablewatch.Row{"tenant_id": "a"},
+			rowPinned: "10",
+			expected:  "",
+		},
+		{
+			name:      "recorded row version ignored without a column",
+			rowPinned: "10",
+			expected:  "",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			r := newTestDeploymentReconciler(t)
+			r.SetPinnedVersionColumn(test.column)
+			if test.row != nil {
+				r.setRow("a", test.row)
+			}
+
+			annotations := map[string]string{DEPLOYMENT_ID_ANNOTATION_NAME: "a"}
+			if test.pinned != "" {
+				annotations[PINNED_VERSION_ANNOTATION_NAME] = test.pinned
+			}
+
+			if test.rowPinned != "" {
+				annotations[ROW_PINNED_VERSION_ANNOTATION_NAME] = test.rowPinned
+			}
+
+			deployment := appsv1.Deployment{ObjectMeta: v1.ObjectMeta{Name: "web-a", Annotations: annotations}}
+			if version := r.getPinnedVersion(deployment); version != test.expected {
+				t.Fatalf("expected version %q, got %q", test.expected, version)
+			}
+
+			following, pinned := r.splitPinnedDeployments([]appsv1.Deployment{deployment})
+			if (len(pinned) == 1) != (test.expected != "") || len(following)+len(pinned) != 1 {
+				t.Fatalf("expected pinned %v, got %d following and %d pinned", test.expected != "", len(following), len(pinned))
+			}
+		})
+	}
+}
@@ -0,0 +1,103 @@
+package controller
+
+import (
+	"dvdlevanon/kubernetes-database-scaler/pkg/tablewatch"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const PRIORITY_ORDER_ASCENDING = "asc"
+const PRIORITY_ORDER_DESCENDING = "desc"
+
+// Priority orders the rows of a batch by a column, so the duplicates of some tenants are
+//
+//	created and updated before the others. Values listed in ranks come first in their listed
+//	order, otherwise numbers are compared as numbers and anything else as strings. Rows
+//	without the column always come last.
+type Priority struct {
+	column     string
+	descending bool
+	ranks      map[string]int
+}
+
+func NewPriority(column string, order string, values []string) (*Priority, error) {
+	if column == "" {
+		return nil, fmt.Errorf("priority column is empty")
+	}
+
+	if order != PRIORITY_ORDER_ASCENDING && order != PRIORITY_ORDER_DESCENDING {
+		return nil, fmt.Errorf("invalid priority order %s (asc, desc)", order)
+	}
+
+	ranks := make(map[string]int)
+	for i, value := range values {
+		ranks[value] = i
+	}
+
+	return &Priority{
+		column:     column,
+		descending: order == PRIORITY_ORDER_DESCENDING,
+		ranks:      ranks,
+	}, nil
+}
+
+// Sort returns the rows in the order they should be processed, a nil priority keeps their order.
+func (p *Priority) Sort(rows []tablewatch.Row) []tablewatch.Row {
+	sorted := append(make([]tablewatch.Row, 0, len(rows)), rows...)
+	if p == nil {
+		return sorted
+	}
+
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return p.less(sorted[i], sorted[j])
+	})
+
+	return sorted
+}
+
+func (p *Priority) less(a tablewatch.Row, b tablewatch.Row) bool {
+	aValue, aOk := a[p.column]
+	bValue, bOk := b[p.column]
+	if !aOk || !bOk {
+		return aOk && !bOk
+	}
+
+	result := p.compare(aValue, bValue)
+	if p.descending {
+		return result > 0
+	}
+
+	return result < 0
+}
+
+func (p *Priority) compare(a string, b string) int {
+	if len(p.ranks) > 0 {
+		return p.rank(a) - p.rank(b)
+	}
+
+	aNumber, aErr := strconv.ParseFloat(a, 64)
+	bNumber, bErr := strconv.ParseFloat(b, 64)
+	if aErr == nil && bErr == nil {
+		switch {
+		case aNumber < bNumber:
+			return -1
+		case aNumber > bNumber:
+			return 1
+		default:
+			return 0
+		}
+	}
+
+	return strings.Compare(a, b)
+}
+
+// rank places values which weren't listed after the listed ones
+func (p *Priority) rank(value string) int {
+	if rank, ok := p.ranks[value]; ok {
+		return rank
+	}
+
+	return len(p.ranks)
+}
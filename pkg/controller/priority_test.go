@@ -0,0 +1,184 @@
+package controller
+
+import (
+	"context"
+	"dvdlevanon/kubernetes-database-scaler/pkg/tablewatch"
+	"reflect"
+	"testing"
+
+	appsv1 "k8s.io/api/apps/v1"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestNewPriority(t *testing.T) {
+	tests := []struct {
+		name   string
+		column string
+		order  string
+		valid  bool
+	}{
+		{name: "ascending", column: "tier", order: PRIORITY_ORDER_ASCENDING, valid: true},
+		{name: "descending", column: "tier", order: PRIORITY_ORDER_DESCENDING, valid: true},
+		{name: "no column", order: PRIORITY_ORDER_ASCENDING},
+		{name: "invalid order", column: "tier", order: "random"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := NewPriority(test.column, test.order, nil)
+			if test.valid != (err == nil) {
+				t.Fatalf("expected valid %v, got %v", test.valid, err)
+			}
+		})
+	}
+}
+
+func getTenants(rows []tablewatch.Row) []string {
+	tenants := make([]string, 0, len(rows))
+	for _, row := range rows {
+		tenants = append(tenants, row["tenant_id"])
+	}
+
+	return tenants
+}
+
+func TestPrioritySort(t *testing.T) {
+	rows := []tablewatch.Row{
+		{"tenant_id": "a", "tier": "pro"},
+		{"tenant_id": "b"},
+		{"tenant_id": "c", "tier": "10"},
+		{"tenant_id": "d", "tier": "enterprise"},
+		{"tenant_id": "e", "tier": "9"},
+		{"tenant_id": "f", "tier": "free"},
+		{"tenant_id": "g", "tier": "enterprise"},
+	}
+
+	tests := []struct {
+		name     string
+		order    string
+		values   []string
+		expected []string
+	}{
+		{
+			name:     "numbers before strings, missing last",
+			order:    PRIORITY_ORDER_ASCENDING,
+			expected: []string{"e", "c", "d", "g", "f", "a", "b"},
+		},
+		{
+			name:     "descending, missing still last",
+			order:    PRIORITY_ORDER_DESCENDING,
+			expected: []string{"a", "f", "d", "g", "c", "e", "b"},
+		},
+		{
+			name:     "listed values first, in their order",
+			order:    PRIORITY_ORDER_ASCENDING,
+			values:   []string{"enterprise", "pro"},
+			expected: []string{"d", "g", "a", "c", "e", "f", "b"},
+		},
+		{
+			name:     "listed values reversed",
+			order:    PRIORITY_ORDER_DESCENDING,
+			values:   []string{"enterprise", "pro"},
+			expected: []string{"c", "e", "f", "a", "d", "g", "b"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			priority, err := NewPriority("tier", test.order, test.values)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			sorted := getTenants(priority.Sort(rows))
+			if !reflect.DeepEqual(sorted, test.expected) {
+				t.Fatalf("expected %v, got %v", test.expected, sorted)
+			}
+		})
+	}
+
+	var priority *Priority
+	if sorted := getTenants(priority.Sort(rows)); !reflect.DeepEqual(sorted, getTenants(rows)) {
+		t.Fatalf("expected a nil priority to keep the order, got %v", sorted)
+	}
+}
+
+func TestPriorityCompare(t *testing.T) {
+	tests := []struct {
+		a        string
+		b        string
+		values   []string
+		expected int
+	}{
+		{a: "2", b: "10", expected: -1},
+		{a: "10", b: "2", expected: 1},
+		{a: "1.5", b: "1.50", expected: 0},
+		{a: "-1", b: "0", expected: -1},
+		{a: "10", b: "2x", expected: -1},
+		{a: "b", b: "a", expected: 1},
+		{a: "pro", b: "enterprise", values: []string{"enterprise", "pro"}, expected: 1},
+		{a: "free", b: "pro", values: []string{"enterprise", "pro"}, expected: 1},
+		{a: "free", b: "basic", values: []string{"enterprise", "pro"}, expected: 0},
+	}
+
+	for _, test := range tests {
+		t.Run(test.a+"-"+test.b, func(t *testing.T) {
+			priority, err := NewPriority("tier", PRIORITY_ORDER_ASCENDING, test.values)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			result := priority.compare(test.a, test.b)
+			if result > 0 {
+				result = 1
+			} else if result < 0 {
+				result = -1
+			}
+
+			if result != test.expected {
+				t.Fatalf("expected %d, got %d", test.expected, result)
+			}
+		})
+	}
+}
+
+func TestSortDeployments(t *testing.T) {
+	r := newTestDeploymentReconciler(t)
+	priority, err := NewPriority("tier", PRIORITY_ORDER_ASCENDING, []string{"enterprise", "pro"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r.SetPriority(priority)
+	r.setRow("a", tablewatch.Row{"tenant_id": "a", "tier": "pro"})
+	r.setRow("b", tablewatch.Row{"tenant_id": "b", "tier": "enterprise"})
+
+	deployments := make([]appsv1.Deployment, 0)
+	for _, nameSuffix := range []string{"unknown", "a", "b"} {
+		deployments = append(deployments, appsv1.Deployment{ObjectMeta: v1.ObjectMeta{
+			Name:        buildDeploymentName("web", nameSuffix),
+			Annotations: map[string]string{DEPLOYMENT_ID_ANNOTATION_NAME: nameSuffix},
+		}})
+	}
+
+	sorted := make([]string, 0)
+	for _, deployment := range r.sortDeployments(deployments) {
+		sorted = append(sorted, deployment.Annotations[DEPLOYMENT_ID_ANNOTATION_NAME])
+	}
+
+	if expected := []string{"b", "a", "unknown"}; !reflect.DeepEqual(sorted, expected) {
+		t.Fatalf("expected %v, got %v", expected, sorted)
+	}
+
+	// The order isn't known before the rows of every source were seen
+	//
+	original := appsv1.Deployment{ObjectMeta: v1.ObjectMeta{Name: "web", Namespace: "default"}}
+	if result := r.originalDeploymentChanged(context.Background(), original); result.RequeueAfter != ROWS_READY_CHECK_INTERVAL {
+		t.Fatalf("expected to wait for the rows, got %v", result)
+	}
+
+	r.OnRowsReady()
+	if result := r.originalDeploymentChanged(context.Background(), original); result.RequeueAfter != 0 {
+		t.Fatalf("expected not to wait once the rows are ready, got %v", result)
+	}
+}
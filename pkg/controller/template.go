@@ -0,0 +1,260 @@
+package controller
+
+import (
+	"context"
+	"dvdlevanon/kubernetes-database-scaler/pkg/logs"
+	"fmt"
+	"sort"
+	"strconv"
+
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/yaml"
+)
+
+const TEMPLATE_VERSION_ANNOTATION_NAME = "kubernetes-database-scaler/template-version"
+const TEMPLATE_VERSION_LABEL_NAME = "kubernetes-database-scaler/template-version"
+const TEMPLATE_ORIGINAL_LABEL_NAME = "kubernetes-database-scaler/template-of"
+const TEMPLATE_DATA_KEY = "deployment.yaml"
+
+// TemplateStore keeps every version of an original deployment in a ConfigMap next to it,
+//
+//	the version is the observed generation of the original, the one recorded on its duplicates.
+//	Only the last maxVersions versions are kept. ConfigMaps are read directly from the api server
+//	so they aren't cached.
+type TemplateStore struct {
+	client      client.Client
+	reader      client.Reader
+	maxVersions int
+}
+
+func NewTemplateStore(client client.Client, reader client.Reader, maxVersions int) (*TemplateStore, error) {
+	if maxVersions <= 0 {
+		return nil, fmt.Errorf("max template versions must be positive")
+	}
+
+	return &TemplateStore{
+		client:      client,
+		reader:      reader,
+		maxVersions: maxVersions,
+	}, nil
+}
+
+func buildTemplateName(originalName string, version string) string {
+	return fmt.Sprintf("%s-template-%s", originalName, version)
+}
+
+func getTemplateVersion(original *appsv1.Deployment) string {
+	return fmt.Sprintf("%d", original.Status.ObservedGeneration)
+}
+
+// Save stores the version of original unless it's already stored, a spec that wasn't observed
+//
+//	yet by the deployment controller is skipped since it doesn't match its version.
+func (s *TemplateStore) Save(ctx context.Context, original *appsv1.Deployment) error {
+	if original.Status.ObservedGeneration != original.Generation {
+		return nil
+	}
+
+	version := getTemplateVersion(original)
+	snapshot := original.DeepCopy()
+	snapshot.TypeMeta = v1.TypeMeta{APIVersion: "apps/v1", Kind: "Deployment"}
+	snapshot.ObjectMeta = v1.ObjectMeta{
+		Namespace:   original.Namespace,
+		Name:        original.Name,
+		Labels:      original.Labels,
+		Annotations: original.Annotations,
+		Generation:  original.Generation,
+	}
+	snapshot.Status = appsv1.DeploymentStatus{ObservedGeneration: original.Status.ObservedGeneration}
+
+	data, err := yaml.Marshal(snapshot)
+	if err != nil {
+		return err
+	}
+
+	configMap := corev1.ConfigMap{
+		ObjectMeta: v1.ObjectMeta{
+			Namespace: original.Namespace,
+			Name:      buildTemplateName(original.Name, version),
+			Labels: map[string]string{
+				MANAGED_BY_LABEL_NAME:        MANAGED_BY_LABEL_VALUE,
+				TEMPLATE_ORIGINAL_LABEL_NAME: original.Name,
+				TEMPLATE_VERSION_LABEL_NAME:  version,
+			},
+		},
+		Data: map[string]string{TEMPLATE_DATA_KEY: string(data)},
+	}
+
+	err = s.client.Create(ctx, &configMap)
+	if apierrors.IsAlreadyExists(err) {
+		return nil
+	}
+
+	if err != nil {
+		return err
+	}
+
+	logger.WithDeployment(original.Name).WithOperation(logs.OPERATION_TEMPLATE).Infof("Stored version %s of %s", version, original.Name)
+	return s.prune(ctx, original.Namespace, original.Name)
+}
+
+func (s *TemplateStore) Load(ctx context.Context, namespace string, originalName string, version string) (*appsv1.Deployment, error) {
+	configMap := corev1.ConfigMap{}
+	key := types.NamespacedName{Namespace: namespace, Name: buildTemplateName(originalName, version)}
+	if err := s.reader.Get(ctx, key, &configMap); err != nil {
+		return nil, err
+	}
+
+	deployment := appsv1.Deployment{}
+	if err := yaml.Unmarshal([]byte(configMap.Data[TEMPLATE_DATA_KEY]), &deployment); err != nil {
+		return nil, fmt.Errorf("invalid template %s %s", key, err)
+	}
+
+	return &deployment, nil
+}
+
+// Versions returns the stored versions of an original deployment from the oldest to the newest
+func (s *TemplateStore) Versions(ctx context.Context, namespace string, originalName string) ([]string, error) {
+	configMaps := corev1.ConfigMapList{}
+	err := s.reader.List(ctx, &configMaps, client.InNamespace(namespace),
+		client.MatchingLabels{TEMPLATE_ORIGINAL_LABEL_NAME: originalName})
+	if err != nil {
+		return nil, err
+	}
+
+	versions := make([]int64, 0, len(configMaps.Items))
+	for _, configMap := range configMaps.Items {
+		version, err := strconv.ParseInt(configMap.Labels[TEMPLATE_VERSION_LABEL_NAME], 10, 64)
+		if err != nil {
+			logger.WithDeployment(originalName).WithOperation(logs.OPERATION_TEMPLATE).Warningf("Ignoring template %s with an invalid version", configMap.Name)
+			continue
+		}
+
+		versions = append(versions, version)
+	}
+
+	sort.Slice(versions, func(i, j int) bool { return versions[i] < versions[j] })
+	result := make([]string, 0, len(versions))
+	for _, version := range versions {
+		result = append(result, fmt.Sprintf("%d", version))
+	}
+
+	return result, nil
+}
+
+// Previous loads the newest stored version older than version, nil when there isn't one
+func (s *TemplateStore) Previous(ctx context.Context, namespace string, originalName string, version string) (*appsv1.Deployment, error) {
+	current, err := strconv.ParseInt(version, 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid template version %s", version)
+	}
+
+	versions, err := s.Versions(ctx, namespace, originalName)
+	if err != nil {
+		return nil, err
+	}
+
+	for i := len(versions) - 1; i >= 0; i-- {
+		if candidate, _ := strconv.ParseInt(versions[i], 10, 64); candidate < current {
+			return s.Load(ctx, namespace, originalName, versions[i])
+		}
+	}
+
+	return nil, nil
+}
+
+func (s *TemplateStore) prune(ctx context.Context, namespace string, originalName string) error {
+	versions, err := s.Versions(ctx, namespace, originalName)
+	if err != nil {
+		return err
+	}
+
+	for len(versions) > s.maxVersions {
+		configMap := corev1.ConfigMap{
+			ObjectMeta: v1.ObjectMeta{Namespace: namespace, Name: buildTemplateName(originalName, versions[0])},
+		}
+
+		if err := s.client.Delete(ctx, &configMap); err != nil && !apierrors.IsNotFound(err) {
+			return err
+		}
+
+		logger.WithDeployment(originalName).WithOperation(logs.OPERATION_TEMPLATE).Infof("Removed version %s of %s", versions[0], originalName)
+		versions = versions[1:]
+	}
+
+	return nil
+}
+
+// Rollback renders the duplicates, or only those of tenants, again from a stored version of the
+//
+//	original. They keep the generation of the current original, so they stay on version until
+//	the original changes again.
+func (r *DeploymentReconciler) Rollback(ctx context.Context, version string, tenants []string) error {
+	if r.templates == nil {
+		return fmt.Errorf("template store is not set")
+	}
+
+	template, err := r.templates.Load(ctx, r.deploymentNamespace, r.deploymentName, version)
+	if err != nil {
+		return fmt.Errorf("unable to load version %s of %s %s", version, r.deploymentName, err)
+	}
+
+	original, err := r.getExistingDeployment()
+	if err != nil {
+		return err
+	}
+
+	deployments, err := r.listDuplicatedDeployments(ctx)
+	if err != nil {
+		return err
+	}
+
+	selected := make(map[string]bool, len(tenants))
+	for _, tenant := range tenants {
+		selected[tenant] = true
+	}
+
+	failed := 0
+	for _, deployment := range deployments {
+		nameSuffix := deployment.Annotations[DEPLOYMENT_ID_ANNOTATION_NAME]
+		if len(selected) > 0 && !selected[nameSuffix] {
+			continue
+		}
+
+		if version := r.getPinnedVersion(deployment); version != "" {
+			r.tenantLog(logs.OPERATION_ROLLBACK, nameSuffix).Infof("Skipping %s pinned to version %s", deployment.Name, version)
+			continue
+		}
+
+		environmentMap, err := r.getEnvironmentMap(deployment)
+		if err != nil {
+			r.tenantLog(logs.OPERATION_ROLLBACK, nameSuffix).Errorf("Unable to build envrionment map of %s %s", deployment.Name, err)
+			failed++
+			continue
+		}
+
+		rolledBack := r.duplicateDeployment(template, nameSuffix, environmentMap, deployment.Namespace)
+		rolledBack.Annotations[ORIGINAL_OBSERVED_GENERATION_ANNOTATION_NAME] = getTemplateVersion(original)
+		if err := r.applyDuplicate(ctx, rolledBack, &deployment, false); err != nil {
+			r.tenantLog(logs.OPERATION_ROLLBACK, nameSuffix).Errorf("Unable to roll back %s %s", deployment.Name, err)
+			recordApplyError(r.recorder, &deployment, err, "Unable to roll back to version %s: %s", version, err)
+			failed++
+			continue
+		}
+
+		r.tenantLog(logs.OPERATION_ROLLBACK, nameSuffix).Infof("Rolled back %s to version %s of %s", deployment.Name, version, r.deploymentName)
+		recordEvent(r.recorder, &deployment, corev1.EventTypeNormal, REASON_ROLLED_BACK,
+			"Rolled back to version %s of %s", version, r.deploymentName)
+	}
+
+	if failed > 0 {
+		return fmt.Errorf("unable to roll back %d duplicates of %s", failed, r.deploymentName)
+	}
+
+	return nil
+}
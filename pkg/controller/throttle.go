@@ -0,0 +1,234 @@
+package controller
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"k8s.io/client-go/util/flowcontrol"
+	"k8s.io/client-go/util/workqueue"
+)
+
+// Throttle paces the creations and removals of duplicates across all the reconcilers,
+//
+//	operations are queued and run by at most maxInFlight workers, each waiting for a token
+//	of its rate limiter, so a burst of new rows doesn't overload the api server, the scheduler
+//	or the image registry. It also caps the number of managed deployments, rows beyond
+//	the cap are queued until others are removed.
+type Throttle struct {
+	createLimiter flowcontrol.RateLimiter
+	removeLimiter flowcontrol.RateLimiter
+	maxInFlight   int
+	maxManaged    int
+	queue         workqueue.Interface
+	lock          sync.Mutex
+	operations    map[string]throttledOperation
+	managed       map[string]bool
+	queued        map[string]bool
+}
+
+type throttledOperation struct {
+	limiter flowcontrol.RateLimiter
+	run     func()
+}
+
+// NewThrottle takes the allowed creations and removals per second and the max managed
+//
+//	deployments, 0 means unlimited.
+func NewThrottle(creationsPerSecond float64, removalsPerSecond float64,
+	maxInFlight int, maxManaged int) (*Throttle, error) {
+
+	if creationsPerSecond < 0 {
+		return nil, fmt.Errorf("creations per second is negative")
+	}
+
+	if removalsPerSecond < 0 {
+		return nil, fmt.Errorf("removals per second is negative")
+	}
+
+	if maxInFlight <= 0 {
+		return nil, fmt.Errorf("max in flight must be positive")
+	}
+
+	if maxManaged < 0 {
+		return nil, fmt.Errorf("max managed deployments is negative")
+	}
+
+	return &Throttle{
+		createLimiter: newRateLimiter(creationsPerSecond),
+		removeLimiter: newRateLimiter(removalsPerSecond),
+		maxInFlight:   maxInFlight,
+		maxManaged:    maxManaged,
+		queue:         workqueue.New(),
+		operations:    make(map[string]throttledOperation),
+		managed:       make(map[string]bool),
+		queued:        make(map[string]bool),
+	}, nil
+}
+
+func newRateLimiter(perSecond float64) flowcontrol.RateLimiter {
+	if perSecond == 0 {
+		return nil
+	}
+
+	burst := int(perSecond)
+	if burst < 1 {
+		burst = 1
+	}
+
+	return flowcontrol.NewTokenBucketRateLimiter(float32(perSecond), burst)
+}
+
+func buildManagedKey(namespace string, name string, suffix string) string {
+	return fmt.Sprintf("%s/%s/%s", namespace, name, suffix)
+}
+
+// Run starts the workers and blocks until ctx is done, operations in progress are completed
+//
+//	before returning, queued ones are dropped and submitted again by the next snapshot.
+func (t *Throttle) Run(ctx context.Context) {
+	var workers sync.WaitGroup
+	for i := 0; i < t.maxInFlight; i++ {
+		workers.Add(1)
+		go func() {
+			defer workers.Done()
+			t.work(ctx)
+		}()
+	}
+
+	<-ctx.Done()
+	logger.Infof("Stopping throttle, %d operations queued", t.queue.Len())
+	t.queue.ShutDown()
+	workers.Wait()
+}
+
+func (t *Throttle) work(ctx context.Context) {
+	for {
+		item, shutdown := t.queue.Get()
+		if shutdown {
+			return
+		}
+
+		key := item.(string)
+		operation := t.takeOperation(key)
+		if ctx.Err() == nil && (operation.limiter == nil || operation.limiter.Wait(ctx) == nil) {
+			operation.run()
+		}
+
+		t.finishOperation(key)
+		t.queue.Done(item)
+	}
+}
+
+func (t *Throttle) takeOperation(key string) throttledOperation {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	return t.operations[key]
+}
+
+func (t *Throttle) finishOperation(key string) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	delete(t.operations, key)
+}
+
+// submit queues run unless an operation with the same key is queued or in progress,
+//
+//	without a throttle run is called right away.
+func (t *Throttle) submit(key string, limiter flowcontrol.RateLimiter, run func()) {
+	if t == nil {
+		run()
+		return
+	}
+
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	if _, ok := t.operations[key]; ok {
+		return
+	}
+
+	t.operations[key] = throttledOperation{limiter: limiter, run: run}
+	t.queue.Add(key)
+}
+
+func (t *Throttle) submitCreation(kind string, key string, run func()) {
+	if t == nil {
+		run()
+		return
+	}
+
+	t.submit(fmt.Sprintf("create/%s/%s", kind, key), t.createLimiter, run)
+}
+
+func (t *Throttle) submitRemoval(kind string, key string, run func()) {
+	if t == nil {
+		run()
+		return
+	}
+
+	t.submit(fmt.Sprintf("remove/%s/%s", kind, key), t.removeLimiter, run)
+}
+
+// reserve counts key as a managed deployment, it fails once the max managed deployments
+//
+//	is reached and key is marked as queued.
+func (t *Throttle) reserve(key string) bool {
+	if t == nil {
+		return true
+	}
+
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	if t.managed[key] {
+		return true
+	}
+
+	if t.maxManaged > 0 && len(t.managed) >= t.maxManaged {
+		t.queued[key] = true
+		return false
+	}
+
+	t.managed[key] = true
+	delete(t.queued, key)
+	return true
+}
+
+// addManaged counts a deployment that already exists, even beyond the max managed deployments
+func (t *Throttle) addManaged(key string) {
+	if t == nil {
+		return
+	}
+
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	t.managed[key] = true
+	delete(t.queued, key)
+}
+
+func (t *Throttle) release(key string) {
+	if t == nil {
+		return
+	}
+
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	delete(t.managed, key)
+	delete(t.queued, key)
+}
+
+func (t *Throttle) isQueued(key string) bool {
+	if t == nil {
+		return false
+	}
+
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	return t.queued[key]
+}
@@ -0,0 +1,247 @@
+package controller
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	autoscalingv2 "k8s.io/api/autoscaling/v2"
+	"k8s.io/client-go/kubernetes/scheme"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+func TestNewThrottle(t *testing.T) {
+	tests := []struct {
+		name               string
+		creationsPerSecond float64
+		removalsPerSecond  float64
+		maxInFlight        int
+		maxManaged         int
+		valid              bool
+	}{
+		{name: "unlimited", maxInFlight: 1, valid: true},
+		{name: "limited", creationsPerSecond: 0.5, removalsPerSecond: 2, maxInFlight: 4, maxManaged: 100, valid: true},
+		{name: "negative creations", creationsPerSecond: -1, maxInFlight: 1},
+		{name: "negative removals", removalsPerSecond: -1, maxInFlight: 1},
+		{name: "no workers", maxInFlight: 0},
+		{name: "negative max managed", maxInFlight: 1, maxManaged: -1},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := NewThrottle(test.creationsPerSecond, test.removalsPerSecond, test.maxInFlight, test.maxManaged)
+			if test.valid != (err == nil) {
+				t.Fatalf("expected valid %v, got %v", test.valid, err)
+			}
+		})
+	}
+}
+
+func TestThrottleReserve(t *testing.T) {
+	throttle, err := NewThrottle(0, 0, 1, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	steps := []struct {
+		name     string
+		action   func(key string) bool
+		key      string
+		reserved bool
+		queued   bool
+	}{
+		{name: "first", action: throttle.reserve, key: "a", reserved: true},
+		{name: "again", action: throttle.reserve, key: "a", reserved: true},
+		{name: "second", action: throttle.reserve, key: "b", reserved: true},
+		{name: "beyond the max", action: throttle.reserve, key: "c", queued: true},
+		{name: "existing beyond the max", action: func(key string) bool { throttle.addManaged(key); return true }, key: "d", reserved: true},
+		{name: "still beyond the max", action: throttle.reserve, key: "c", queued: true},
+		{name: "released", action: func(key string) bool { throttle.release(key); return false }, key: "a"},
+		{name: "released another", action: func(key string) bool { throttle.release(key); return false }, key: "b"},
+		{name: "below the max", action: throttle.reserve, key: "c", reserved: true},
+	}
+
+	for _, step := range steps {
+		if reserved := step.action(step.key); reserved != step.reserved {
+			t.Fatalf("%s: expected reserved %v, got %v", step.name, step.reserved, reserved)
+		}
+
+		if queued := throttle.isQueued(step.key); queued != step.queued {
+			t.Fatalf("%s: expected queued %v, got %v", step.name, step.queued, queued)
+		}
+	}
+}
+
+func TestNilThrottle(t *testing.T) {
+	var throttle *Throttle
+	runs := 0
+	throttle.submitCreation("deployment", "a", func() { runs++ })
+	throttle.submitRemoval("deployment", "a", func() { runs++ })
+	if runs != 2 {
+		t.Fatalf("expected the operations to run right away, got %d runs", runs)
+	}
+
+	if !throttle.reserve("a") || throttle.isQueued("a") {
+		t.Fatalf("expected a nil throttle to reserve everything")
+	}
+}
+
+func TestThrottleRun(t *testing.T) {
+	tests := []struct {
+		name               string
+		creationsPerSecond float64
+		maxInFlight        int
+		keys               []string
+		runs               int32
+		minDuration        time.Duration
+	}{
+		{name: "one worker", maxInFlight: 1, keys: []string{"a", "b", "c"}, runs: 3},
+		{name: "several workers", maxInFlight: 3, keys: []string{"a", "b", "c", "d", "e", "f"}, runs: 6},
+		{name: "same key", maxInFlight: 2, keys: []string{"a", "a", "b", "a"}, runs: 2},
+		{
+			name:               "rate limited",
+			creationsPerSecond: 4,
+			maxInFlight:        2,
+			keys:               []string{"a", "b", "c", "d", "e", "f"},
+			runs:               6,
+			minDuration:        400 * time.Millisecond,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			throttle, err := NewThrottle(test.creationsPerSecond, 0, test.maxInFlight, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var runs, inFlight, maxInFlight int32
+			var done sync.WaitGroup
+			done.Add(int(test.runs))
+			started := time.Now()
+			for _, key := range test.keys {
+				throttle.submitCreation("deployment", key, func() {
+					current := atomic.AddInt32(&inFlight, 1)
+					for {
+						max := atomic.LoadInt32(&maxInFlight)
+						if current <= max || atomic.CompareAndSwapInt32(&maxInFlight, max, current) {
+							break
+						}
+					}
+
+					time.Sleep(10 * time.Millisecond)
+					atomic.AddInt32(&inFlight, -1)
+					atomic.AddInt32(&runs, 1)
+					done.Done()
+				})
+			}
+
+			ctx, cancel := context.WithCancel(context.Background())
+			stopped := make(chan struct{})
+			go func() {
+				throttle.Run(ctx)
+				close(stopped)
+			}()
+
+			done.Wait()
+			elapsed := time.Since(started)
+			cancel()
+			<-stopped
+
+			if runs != test.runs {
+				t.Fatalf("expected %d runs, got %d", test.runs, runs)
+			}
+
+			if maxInFlight > int32(test.maxInFlight) {
+				t.Fatalf("expected at most %d operations in flight, got %d", test.maxInFlight, maxInFlight)
+			}
+
+			if elapsed < test.minDuration {
+				t.Fatalf("expected the operations to take at least %s, took %s", test.minDuration, elapsed)
+			}
+		})
+	}
+}
+
+func TestThrottleHpaRemovals(t *testing.T) {
+	tenants := []string{"a", "b", "c", "d", "e", "f"}
+	objects := make([]client.Object, 0)
+	for _, tenant := range tenants {
+		objects = append(objects, newTestHpa("api-"+tenant, tenant))
+	}
+
+	c := fake.NewClientBuilder().WithScheme(scheme.Scheme).WithObjects(objects...).Build()
+	r, err := NewHpaController(c, "default", "api", "tenant_id", "web", "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	throttle, err := NewThrottle(0, 4, 1, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	removeHpas := make(chan string, len(tenants))
+	r.SetThrottle(throttle)
+	r.SetRemoveChannel(removeHpas)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go r.Run(ctx)
+
+	for _, tenant := range append(tenants, "a") {
+		removeHpas <- tenant
+	}
+
+	var deploymentRemoved int32
+	throttle.submitRemoval("deployment", buildManagedKey("default", "web", "a"), func() {
+		atomic.StoreInt32(&deploymentRemoved, 1)
+	})
+
+	countHpas := func() int {
+		hpas := autoscalingv2.HorizontalPodAutoscalerList{}
+		if err := c.List(context.Background(), &hpas, client.InNamespace("default")); err != nil {
+			t.Fatal(err)
+		}
+
+		return len(hpas.Items)
+	}
+
+	for deadline := time.Now().Add(time.Second); ; time.Sleep(10 * time.Millisecond) {
+		throttle.lock.Lock()
+		queued := len(throttle.operations)
+		throttle.lock.Unlock()
+		if queued == len(tenants)+1 {
+			break
+		}
+
+		if time.Now().After(deadline) {
+			t.Fatalf("expected %d queued removals, got %d", len(tenants)+1, queued)
+		}
+	}
+
+	if remaining := countHpas(); remaining != len(tenants) {
+		t.Fatalf("expected the hpas to be kept until the throttle runs, got %d", remaining)
+	}
+
+	started := time.Now()
+	go throttle.Run(ctx)
+	for deadline := time.Now().Add(5 * time.Second); countHpas() > 0; time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected the hpas to be removed, %d remaining", countHpas())
+		}
+	}
+
+	if elapsed := time.Since(started); elapsed < 250*time.Millisecond {
+		t.Fatalf("expected the removals to be rate limited, took %s", elapsed)
+	}
+
+	for deadline := time.Now().Add(time.Second); atomic.LoadInt32(&deploymentRemoved) == 0; time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected the deployment removal of the same tenant to run")
+		}
+	}
+}
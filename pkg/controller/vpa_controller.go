@@ -2,19 +2,23 @@ package controller
 
 import (
 	"context"
+	"dvdlevanon/kubernetes-database-scaler/pkg/logs"
 	"dvdlevanon/kubernetes-database-scaler/pkg/tablewatch"
 	"fmt"
 
+	corev1 "k8s.io/api/core/v1"
 	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/types"
 	vpa_types "k8s.io/autoscaler/vertical-pod-autoscaler/pkg/apis/autoscaling.k8s.io/v1"
+	"k8s.io/client-go/tools/record"
 	ctrl "sigs.k8s.io/controller-runtime"
 	"sigs.k8s.io/controller-runtime/pkg/client"
 	"sigs.k8s.io/controller-runtime/pkg/log"
 )
 
 const VPA_ID_ANNOTATION_NAME = "kubernetes-database-scaler/vpa-id"
+const ORIGINAL_VPA_GENERATION_ANNOTATION_NAME = "kubernetes-database-scaler/original-vpa-generation"
 
 type VpaReconciler struct {
 	client.Client
@@ -22,6 +26,9 @@ type VpaReconciler struct {
 	vpaName        string
 	vpaColumnName  string
 	deploymentName string
+	recorder       record.EventRecorder
+	namespaces     *NamespaceManager
+	throttle       *Throttle
 }
 
 func NewVpaController(client client.Client, vpaNamespace string,
@@ -66,14 +73,11 @@ func (r *VpaReconciler) reconcileVpa(ctx context.Context, req ctrl.Request) {
 	vpa := vpa_types.VerticalPodAutoscaler{}
 	err := r.Get(ctx, req.NamespacedName, &vpa)
 	if err == nil {
-		// Commenting this becaues we contantly get reconcile even if VPA isn't changed.
-		//	No easy way to detect it, and its not that important this time.
-		//
-		// r.originalVpaChanged(ctx, vpa)
+		r.originalVpaChanged(ctx, vpa)
 	} else if apierrors.IsNotFound(err) {
 		r.originalVpaDeleted(ctx)
 	} else {
-		logger.Errorf("Unable to get vpa upon reconciling %s", err)
+		r.log(logs.OPERATION_RECONCILE).Errorf("Unable to get vpa upon reconciling %s", err)
 	}
 }
 
@@ -83,19 +87,33 @@ func (r *VpaReconciler) originalVpaChanged(ctx context.Context, original vpa_typ
 		return err
 	}
 
+	// Reconciles are triggered on every status update of the vpa, the generation
+	//	changes only when its spec does.
+	//
+	originalGeneration := fmt.Sprintf("%d", original.Generation)
 	for _, vpa := range vpas {
-		if err := r.Delete(ctx, &vpa); err != nil {
-			logger.Errorf("Unable to remove vpa %s", err)
+		if vpa.Annotations[ORIGINAL_VPA_GENERATION_ANNOTATION_NAME] == originalGeneration {
 			continue
 		}
 
 		nameSuffix, ok := vpa.Annotations[VPA_ID_ANNOTATION_NAME]
 		if !ok {
-			logger.Errorf("Unable to get name suffix annotation from vpa %v", vpa)
+			r.log(logs.OPERATION_UPDATE).Errorf("Unable to get name suffix annotation from vpa %v", vpa)
 			continue
 		}
 
-		r.createVpa(nameSuffix)
+		r.tenantLog(logs.OPERATION_UPDATE, nameSuffix).Infof("Original vpa changed (generation %s), updating vpa %s", originalGeneration, vpa.Name)
+
+		updated := r.duplicateVpa(&original, nameSuffix, vpa.Namespace)
+		if err := applyObject(ctx, r.Client, updated, vpaGvk, nil, false); err != nil {
+			r.tenantLog(logs.OPERATION_UPDATE, nameSuffix).Errorf("Unable to update vpa %s %s", vpa.Name, err)
+			recordApplyError(r.recorder, &vpa, err,
+				"Unable to update from %s generation %s: %s", r.vpaName, originalGeneration, err)
+			continue
+		}
+
+		recordEvent(r.recorder, updated, corev1.EventTypeNormal, REASON_DUPLICATE_UPDATED,
+			"Updated from %s generation %s", r.vpaName, originalGeneration)
 	}
 
 	return nil
@@ -107,27 +125,32 @@ func (r *VpaReconciler) originalVpaDeleted(ctx context.Context) {
 		return
 	}
 
-	logger.Infof("Original vpa deleted, removing %d duplicated vpas", len(vpas))
+	r.log(logs.OPERATION_REMOVE).Infof("Original vpa deleted, removing %d duplicated vpas", len(vpas))
 
 	for _, vpa := range vpas {
 		if err := r.Delete(ctx, &vpa); err != nil {
-			logger.Errorf("Error removing vpa %s", err)
+			r.tenantLog(logs.OPERATION_REMOVE, vpa.Annotations[VPA_ID_ANNOTATION_NAME]).Errorf("Error removing vpa %s", err)
+			recordEvent(r.recorder, &vpa, corev1.EventTypeWarning, REASON_DELETE_FAILED,
+				"Unable to remove duplicate after %s was deleted: %s", r.vpaName, err)
 			continue
 		}
+
+		recordEvent(r.recorder, &vpa, corev1.EventTypeNormal, REASON_DUPLICATE_DELETED,
+			"Removed since %s was deleted", r.vpaName)
 	}
 }
 
 func (r *VpaReconciler) listDuplicatedVpas(ctx context.Context) ([]vpa_types.VerticalPodAutoscaler, error) {
 	vpas := vpa_types.VerticalPodAutoscalerList{}
-	err := r.List(ctx, &vpas, client.InNamespace(r.vpaNamespace))
+	err := r.List(ctx, &vpas, r.namespaces.ListOptions(r.vpaNamespace)...)
 	if err != nil {
-		logger.Errorf("Error getting duplicated vpas %s", err)
+		r.log(logs.OPERATION_RECONCILE).Errorf("Error getting duplicated vpas %s", err)
 		return nil, err
 	}
 
 	result := make([]vpa_types.VerticalPodAutoscaler, 0)
 	for _, vpa := range vpas.Items {
-		if _, ok := vpa.Annotations[VPA_ID_ANNOTATION_NAME]; ok {
+		if nameSuffix, ok := vpa.Annotations[VPA_ID_ANNOTATION_NAME]; ok && vpa.Name == r.buildVpaName(nameSuffix) {
 			result = append(result, vpa)
 		}
 	}
@@ -135,6 +158,18 @@ func (r *VpaReconciler) listDuplicatedVpas(ctx context.Context) ([]vpa_types.Ver
 	return result, nil
 }
 
+// log is the logger of lines about the original autoscaler
+func (r *VpaReconciler) log(operation string) *logs.Logger {
+	return logger.WithDeployment(r.deploymentName).WithOperation(operation)
+}
+
+// tenantLog is the logger of lines about the autoscaler of a tenant, by the duplicate it scales
+func (r *VpaReconciler) tenantLog(operation string, nameSuffix string) *logs.Logger {
+	return logger.WithTenant(nameSuffix).
+		WithDeployment(buildDeploymentName(r.deploymentName, nameSuffix)).
+		WithOperation(operation)
+}
+
 func (r *VpaReconciler) buildVpaName(vpaSuffix string) string {
 	return fmt.Sprintf("%s-%s", r.vpaName, vpaSuffix)
 }
@@ -147,52 +182,69 @@ func (r *VpaReconciler) getExistingVpa() (*vpa_types.VerticalPodAutoscaler, erro
 
 	vpa := vpa_types.VerticalPodAutoscaler{}
 	if err := r.Get(context.Background(), key, &vpa); err != nil {
-		logger.Errorf("Unable to get original vpa %v %s", key, err)
+		r.log(logs.OPERATION_RECONCILE).Errorf("Unable to get original vpa %v %s", key, err)
 		return nil, err
 	}
 
 	return &vpa, nil
 }
 
-func (r *VpaReconciler) duplicateVpa(orig *vpa_types.VerticalPodAutoscaler, nameSuffix string) *vpa_types.VerticalPodAutoscaler {
+func (r *VpaReconciler) duplicateVpa(orig *vpa_types.VerticalPodAutoscaler,
+	nameSuffix string, namespace string) *vpa_types.VerticalPodAutoscaler {
+	annotations := make(map[string]string)
+	for key, value := range orig.ObjectMeta.Annotations {
+		annotations[key] = value
+	}
+
 	new := orig.DeepCopy()
 	new.ObjectMeta = v1.ObjectMeta{
 		Name:                       r.buildVpaName(nameSuffix),
-		Namespace:                  orig.ObjectMeta.Namespace,
-		Annotations:                orig.ObjectMeta.Annotations,
+		Namespace:                  namespace,
+		Annotations:                annotations,
 		Labels:                     orig.ObjectMeta.Labels,
 		DeletionGracePeriodSeconds: orig.ObjectMeta.DeletionGracePeriodSeconds,
 	}
 
 	new.ObjectMeta.Annotations[VPA_ID_ANNOTATION_NAME] = nameSuffix
+	new.ObjectMeta.Annotations[ORIGINAL_VPA_GENERATION_ANNOTATION_NAME] = fmt.Sprintf("%d", orig.Generation)
 	new.Spec.TargetRef.Name = buildDeploymentName(r.deploymentName, nameSuffix)
 	return new
 }
 
-func (r *VpaReconciler) createVpa(nameSuffix string) error {
+func (r *VpaReconciler) createVpa(nameSuffix string, namespace string) error {
 	if r.vpaName == "" {
 		return nil
 	}
 
-	logger.Infof("Creating a new vpa with suffix %v", nameSuffix)
+	r.tenantLog(logs.OPERATION_CREATE, nameSuffix).Infof("Creating a new vpa with suffix %v in %s", nameSuffix, namespace)
 
 	orig, err := r.getExistingVpa()
 	if err != nil {
 		return err
 	}
 
-	new := r.duplicateVpa(orig, nameSuffix)
-	if err := r.Create(context.Background(), new); err != nil {
-		logger.Errorf("Unable to create a new vpa for %s %s", nameSuffix, err)
+	if err := r.namespaces.Ensure(context.Background(), namespace, nameSuffix); err != nil {
+		return err
+	}
+
+	new := r.duplicateVpa(orig, nameSuffix, namespace)
+	if err := applyObject(context.Background(), r.Client, new, vpaGvk, nil, false); err != nil {
+		r.tenantLog(logs.OPERATION_CREATE, nameSuffix).Errorf("Unable to create a new vpa for %s %s", nameSuffix, err)
+		recordEvent(r.recorder, orig, corev1.EventTypeWarning, REASON_CREATE_FAILED,
+			"Unable to create duplicate %s: %s", new.Name, err)
 		return err
 	}
 
+	recordEvent(r.recorder, orig, corev1.EventTypeNormal, REASON_DUPLICATE_CREATED,
+		"Created duplicate %s", new.Name)
+	recordEvent(r.recorder, new, corev1.EventTypeNormal, REASON_DUPLICATE_CREATED,
+		"Duplicated from %s", r.vpaName)
 	return nil
 }
 
-func (r *VpaReconciler) isVpaExists(vpaSuffix string) (bool, error) {
+func (r *VpaReconciler) isVpaExists(vpaSuffix string, namespace string) (bool, error) {
 	key := types.NamespacedName{
-		Namespace: r.vpaNamespace,
+		Namespace: namespace,
 		Name:      r.buildVpaName(vpaSuffix),
 	}
 
@@ -213,24 +265,49 @@ func (r *VpaReconciler) isVpaExists(vpaSuffix string) (bool, error) {
 func (r *VpaReconciler) OnRow(row tablewatch.Row) {
 	deploymentSuffix, ok := row[r.vpaColumnName]
 	if !ok {
-		logger.Warningf("Column %s not found on row %v", r.vpaColumnName, row)
+		r.log(logs.OPERATION_CREATE).Warningf("Column %s not found on row %v", r.vpaColumnName, row)
+		return
+	}
+
+	namespace, err := r.namespaces.Resolve(r.vpaNamespace, row)
+	if err != nil {
+		r.tenantLog(logs.OPERATION_NAMESPACE, deploymentSuffix).Errorf("Unable to resolve namespace of VPA %s %s", deploymentSuffix, err)
+		return
+	}
+
+	// The vpa waits with its deployment for a managed deployment to be removed
+	//
+	managedKey := buildManagedKey(r.vpaNamespace, r.deploymentName, deploymentSuffix)
+	if r.throttle.isQueued(managedKey) {
 		return
 	}
 
-	exists, err := r.isVpaExists(deploymentSuffix)
+	exists, err := r.isVpaExists(deploymentSuffix, namespace)
 	if exists {
 		return
 	}
 
 	if err != nil {
-		logger.Errorf("Unable to get VPA info for %s %s", deploymentSuffix, err)
+		r.tenantLog(logs.OPERATION_CREATE, deploymentSuffix).Errorf("Unable to get VPA info for %s %s", deploymentSuffix, err)
 		return
 	}
 
-	r.createVpa(deploymentSuffix)
+	r.throttle.submitCreation("vpa", managedKey, func() {
+		r.createVpa(deploymentSuffix, namespace)
+	})
+}
+
+func (r *VpaReconciler) SetNamespaceManager(namespaces *NamespaceManager) {
+	r.namespaces = namespaces
+}
+
+func (r *VpaReconciler) SetThrottle(throttle *Throttle) {
+	r.throttle = throttle
 }
 
 func (r *VpaReconciler) SetupWithManager(mgr ctrl.Manager) error {
+	r.recorder = mgr.GetEventRecorderFor(EVENT_RECORDER_NAME)
+
 	return ctrl.NewControllerManagedBy(mgr).
 		For(&vpa_types.VerticalPodAutoscaler{}).
 		Complete(r)
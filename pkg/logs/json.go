@@ -0,0 +1,76 @@
+package logs
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/op/go-logging"
+)
+
+// jsonBackend writes every record as a single line json object, the fields of records logged
+//
+//	through a Logger are written as keys next to the message.
+type jsonBackend struct {
+	lock   sync.Mutex
+	writer io.Writer
+}
+
+func newJsonBackend(writer io.Writer) *jsonBackend {
+	return &jsonBackend{writer: writer}
+}
+
+func (b *jsonBackend) Log(level logging.Level, calldepth int, record *logging.Record) error {
+	message, fields := splitRecord(record)
+	entry := make(map[string]interface{}, len(fields)+5)
+	for _, field := range fields {
+		entry[field.Key] = field.Value
+	}
+
+	entry["time"] = record.Time.Format(time.RFC3339Nano)
+	entry["level"] = strings.ToLower(level.String())
+	entry["module"] = record.Module
+	entry["message"] = message
+	if _, file, line, ok := runtime.Caller(calldepth + 1); ok {
+		entry["caller"] = fmt.Sprintf("%s:%d", filepath.Base(file), line)
+	}
+
+	// A field that can't be marshaled, e.g. a value passed through logr, shouldn't drop the line
+	//
+	data, err := json.Marshal(entry)
+	if err != nil {
+		for _, field := range fields {
+			entry[field.Key] = fmt.Sprintf("%v", field.Value)
+		}
+
+		if data, err = json.Marshal(entry); err != nil {
+			return err
+		}
+	}
+
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	_, err = b.writer.Write(append(data, '\n'))
+	return err
+}
+
+// splitRecord separates the message from the fields of records logged through a Logger,
+//
+//	other records have no fields.
+func splitRecord(record *logging.Record) (string, Fields) {
+	if len(record.Args) == 2 {
+		message, isMessage := record.Args[0].(string)
+		fields, isFields := record.Args[1].(Fields)
+		if isMessage && isFields {
+			return message, fields
+		}
+	}
+
+	return record.Message(), nil
+}
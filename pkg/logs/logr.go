@@ -0,0 +1,81 @@
+package logs
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/go-logr/logr"
+	"github.com/op/go-logging"
+)
+
+const LOGR_MODULE = "controller-runtime"
+
+// logrSink bridges logr, used by controller-runtime and client-go, into the go-logging backend,
+//
+//	logr levels above 0 are logged as debug and the key value pairs as fields.
+type logrSink struct {
+	logger *Logger
+	names  []string
+}
+
+func NewLogr() logr.Logger {
+	return logr.New(&logrSink{logger: MustGetLogger(LOGR_MODULE)})
+}
+
+func (s *logrSink) Init(info logr.RuntimeInfo) {
+	s.logger = s.withCallDepth(LOGGER_CALL_DEPTH + info.CallDepth)
+}
+
+// WithCallDepth skips the frames of loggers wrapping this one, e.g. the delegating logger of controller-runtime
+func (s *logrSink) WithCallDepth(depth int) logr.LogSink {
+	return &logrSink{logger: s.withCallDepth(s.logger.logger.ExtraCalldepth + depth), names: s.names}
+}
+
+func (s *logrSink) withCallDepth(depth int) *Logger {
+	logger := logging.MustGetLogger(LOGR_MODULE)
+	logger.ExtraCalldepth = depth
+	return &Logger{logger: logger, fields: s.logger.fields}
+}
+
+func (s *logrSink) Enabled(level int) bool {
+	return s.logger.IsEnabledFor(logrLevel(level))
+}
+
+func (s *logrSink) Info(level int, msg string, keysAndValues ...interface{}) {
+	s.withValues(keysAndValues).log(logrLevel(level), "%s", msg)
+}
+
+func (s *logrSink) Error(err error, msg string, keysAndValues ...interface{}) {
+	logger := s.withValues(keysAndValues)
+	if err != nil {
+		logger = logger.WithError(err)
+	}
+
+	logger.log(logging.ERROR, "%s", msg)
+}
+
+func (s *logrSink) WithValues(keysAndValues ...interface{}) logr.LogSink {
+	return &logrSink{logger: s.withValues(keysAndValues), names: s.names}
+}
+
+func (s *logrSink) WithName(name string) logr.LogSink {
+	names := append(append(make([]string, 0, len(s.names)+1), s.names...), name)
+	return &logrSink{logger: s.logger.With(FIELD_LOGGER, strings.Join(names, ".")), names: names}
+}
+
+func (s *logrSink) withValues(keysAndValues []interface{}) *Logger {
+	logger := s.logger
+	for i := 0; i+1 < len(keysAndValues); i += 2 {
+		logger = logger.With(fmt.Sprintf("%v", keysAndValues[i]), keysAndValues[i+1])
+	}
+
+	return logger
+}
+
+func logrLevel(level int) logging.Level {
+	if level > 0 {
+		return logging.DEBUG
+	}
+
+	return logging.INFO
+}
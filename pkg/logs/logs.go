@@ -0,0 +1,216 @@
+package logs
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/op/go-logging"
+)
+
+const (
+	FIELD_TENANT     = "tenant"
+	FIELD_DEPLOYMENT = "deployment"
+	FIELD_OPERATION  = "operation"
+	FIELD_QUERY_ID   = "query_id"
+	FIELD_DURATION   = "duration_ms"
+	FIELD_ERROR      = "error"
+	FIELD_SOURCE     = "source"
+	FIELD_LOGGER     = "logger"
+)
+
+const (
+	OPERATION_RECONCILE   = "reconcile"
+	OPERATION_CREATE      = "create"
+	OPERATION_UPDATE      = "update"
+	OPERATION_REMOVE      = "remove"
+	OPERATION_CANARY      = "canary"
+	OPERATION_ROLLBACK    = "rollback"
+	OPERATION_PIN         = "pin"
+	OPERATION_DRIFT       = "drift"
+	OPERATION_OVERRIDE    = "override"
+	OPERATION_TEMPLATE    = "template"
+	OPERATION_NAMESPACE   = "namespace"
+	OPERATION_STATUS      = "status"
+	OPERATION_QUERY       = "query"
+	OPERATION_REPLICATION = "replication"
+	OPERATION_CREDENTIALS = "credentials"
+	OPERATION_CLEAN       = "clean"
+)
+
+const LOG_FORMAT_TEXT = "text"
+const LOG_FORMAT_JSON = "json"
+
+const TEXT_LOG_FORMAT = `[%{time:2006-01-02 15:04:05.000}] %{color}%{level:-7s}%{color:reset} %{message} [%{module} - %{shortfile}]`
+
+// The go-logging logger is called from Logger.log, which is called from the Logger methods
+const LOGGER_CALL_DEPTH = 2
+
+type Field struct {
+	Key   string
+	Value interface{}
+}
+
+// Fields are passed to go-logging as the last argument of every record, the text format
+//
+//	appends them to the message as key=value pairs, the json format writes them as keys.
+type Fields []Field
+
+func (f Fields) String() string {
+	var builder strings.Builder
+	for _, field := range f {
+		fmt.Fprintf(&builder, " %s=%v", field.Key, field.Value)
+	}
+
+	return builder.String()
+}
+
+// Logger wraps a go-logging logger with structured fields, a logger with more fields is
+//
+//	derived with With, the fields of the parent are kept.
+type Logger struct {
+	logger *logging.Logger
+	fields Fields
+}
+
+func MustGetLogger(module string) *Logger {
+	logger := logging.MustGetLogger(module)
+	logger.ExtraCalldepth = LOGGER_CALL_DEPTH
+	return &Logger{logger: logger}
+}
+
+// With returns a logger adding key to every line, a key that's already set is replaced
+func (l *Logger) With(key string, value interface{}) *Logger {
+	fields := make(Fields, 0, len(l.fields)+1)
+	for _, field := range l.fields {
+		if field.Key != key {
+			fields = append(fields, field)
+		}
+	}
+
+	return &Logger{logger: l.logger, fields: append(fields, Field{Key: key, Value: fieldValue(value)})}
+}
+
+func (l *Logger) WithTenant(tenant string) *Logger {
+	return l.With(FIELD_TENANT, tenant)
+}
+
+func (l *Logger) WithDeployment(deployment string) *Logger {
+	return l.With(FIELD_DEPLOYMENT, deployment)
+}
+
+func (l *Logger) WithOperation(operation string) *Logger {
+	return l.With(FIELD_OPERATION, operation)
+}
+
+func (l *Logger) WithDuration(duration time.Duration) *Logger {
+	return l.With(FIELD_DURATION, duration)
+}
+
+func (l *Logger) WithError(err error) *Logger {
+	return l.With(FIELD_ERROR, err)
+}
+
+func fieldValue(value interface{}) interface{} {
+	switch value := value.(type) {
+	case time.Duration:
+		return value.Milliseconds()
+	case error:
+		return value.Error()
+	case fmt.Stringer:
+		return value.String()
+	default:
+		return value
+	}
+}
+
+func (l *Logger) Debugf(format string, args ...interface{}) {
+	l.log(logging.DEBUG, format, args...)
+}
+
+func (l *Logger) Infof(format string, args ...interface{}) {
+	l.log(logging.INFO, format, args...)
+}
+
+func (l *Logger) Warningf(format string, args ...interface{}) {
+	l.log(logging.WARNING, format, args...)
+}
+
+func (l *Logger) Errorf(format string, args ...interface{}) {
+	l.log(logging.ERROR, format, args...)
+}
+
+func (l *Logger) IsEnabledFor(level logging.Level) bool {
+	return l.logger.IsEnabledFor(level)
+}
+
+// log formats the message before passing it to go-logging, so the fields aren't mixed with
+//
+//	its arguments. An error argument is added as the error field unless it's already set.
+func (l *Logger) log(level logging.Level, format string, args ...interface{}) {
+	if !l.logger.IsEnabledFor(level) {
+		return
+	}
+
+	logger := l
+	if !l.hasField(FIELD_ERROR) {
+		for _, arg := range args {
+			if err, ok := arg.(error); ok && err != nil {
+				logger = l.WithError(err)
+				break
+			}
+		}
+	}
+
+	message := fmt.Sprintf(format, args...)
+	switch level {
+	case logging.DEBUG:
+		l.logger.Debugf("%s%s", message, logger.fields)
+	case logging.INFO:
+		l.logger.Infof("%s%s", message, logger.fields)
+	case logging.WARNING:
+		l.logger.Warningf("%s%s", message, logger.fields)
+	default:
+		l.logger.Errorf("%s%s", message, logger.fields)
+	}
+}
+
+func (l *Logger) hasField(key string) bool {
+	for _, field := range l.fields {
+		if field.Key == key {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Configure sets the format and level of every module, it may be called again once the
+//
+//	flags are parsed.
+func Configure(format string, level string) error {
+	logLevel, err := logging.LogLevel(level)
+	if err != nil {
+		return fmt.Errorf("invalid log level %s (debug, info, warning, error)", level)
+	}
+
+	var backend logging.Backend
+	switch format {
+	case LOG_FORMAT_TEXT:
+		formatter, err := logging.NewStringFormatter(TEXT_LOG_FORMAT)
+		if err != nil {
+			return err
+		}
+
+		backend = logging.NewBackendFormatter(logging.NewLogBackend(os.Stdout, "", 0), formatter)
+	case LOG_FORMAT_JSON:
+		backend = newJsonBackend(os.Stdout)
+	default:
+		return fmt.Errorf("invalid log format %s (text, json)", format)
+	}
+
+	leveled := logging.SetBackend(backend)
+	leveled.SetLevel(logLevel, "")
+	return nil
+}
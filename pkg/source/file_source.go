@@ -0,0 +1,134 @@
+package source
+
+import (
+	"bytes"
+	"context"
+	"dvdlevanon/kubernetes-database-scaler/pkg/tablewatch"
+	"encoding/csv"
+	"fmt"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/fsnotify/fsnotify"
+	"sigs.k8s.io/yaml"
+)
+
+// FileSource reads the rows from a local csv file, whose first line holds the column names,
+//
+//	or from a yaml or json file holding a list of objects. The directory of the file is watched
+//	so a change is seen right away, including an atomic replace of a mounted ConfigMap.
+type FileSource struct {
+	*poller
+	path string
+}
+
+func NewFileSource(name string, filePath string, sourceColumn string) (*FileSource, error) {
+	if name == "" {
+		return nil, fmt.Errorf("source name is empty")
+	}
+
+	if filePath == "" {
+		return nil, fmt.Errorf("source path is empty")
+	}
+
+	switch strings.ToLower(path.Ext(filePath)) {
+	case ".csv", ".yaml", ".yml", ".json":
+	default:
+		return nil, fmt.Errorf("unsupported file format %s (e.g. csv, yaml, json)", filePath)
+	}
+
+	return &FileSource{
+		poller: newPoller(name, sourceColumn),
+		path:   filePath,
+	}, nil
+}
+
+func (s *FileSource) Watch(ctx context.Context, checkInterval int, output chan<- tablewatch.Snapshot) {
+	logger.Infof("Reading %s from %s", s.name, s.path)
+	go s.watchFile(ctx)
+	s.run(ctx, checkInterval, output, s.fetch)
+}
+
+func (s *FileSource) watchFile(ctx context.Context) {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		logger.Errorf("Error initializing watcher %s", err)
+		return
+	}
+	defer watcher.Close()
+
+	dir := path.Dir(s.path)
+	if err := watcher.Add(dir); err != nil {
+		logger.Errorf("Unable to watch directory %s: %s", dir, err)
+		return
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+
+		case event, ok := <-watcher.Events:
+			if !ok {
+				return
+			}
+
+			logger.Debugf("File Changed on the Filesystem [name: %s] [operation: %s]", event.Name, event.Op)
+			s.notify()
+
+		case err, ok := <-watcher.Errors:
+			if !ok {
+				return
+			}
+			logger.Errorf("Error reading from watcher: %s", err)
+		}
+	}
+}
+
+func (s *FileSource) fetch(_ context.Context) ([]tablewatch.Row, error) {
+	content, err := os.ReadFile(s.path)
+	if err != nil {
+		return nil, err
+	}
+
+	if strings.ToLower(path.Ext(s.path)) == ".csv" {
+		return parseCsv(content)
+	}
+
+	return parseYaml(content)
+}
+
+func parseCsv(content []byte) ([]tablewatch.Row, error) {
+	records, err := csv.NewReader(bytes.NewReader(content)).ReadAll()
+	if err != nil {
+		return nil, err
+	}
+
+	rows := make([]tablewatch.Row, 0)
+	if len(records) == 0 {
+		return rows, nil
+	}
+
+	columns := records[0]
+	for _, record := range records[1:] {
+		row := make(tablewatch.Row, len(columns))
+		for i, column := range columns {
+			row[strings.TrimSpace(column)] = record[i]
+		}
+
+		rows = append(rows, row)
+	}
+
+	return rows, nil
+}
+
+// Yaml is a superset of json, both are parsed the same way
+func parseYaml(content []byte) ([]tablewatch.Row, error) {
+	items := make([]interface{}, 0)
+	if err := yaml.Unmarshal(content, &items); err != nil {
+		return nil, err
+	}
+
+	return buildRows(items)
+}
@@ -0,0 +1,170 @@
+package source
+
+import (
+	"context"
+	"dvdlevanon/kubernetes-database-scaler/pkg/tablewatch"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// HttpSource polls a json endpoint returning a list of objects, either at the top level
+//
+//	or under rowsField. The ETag of the last response is sent back with If-None-Match,
+//	a 304 response reuses the rows of the last snapshot. A request taking longer than the
+//	timeout fails, zero disables the timeout.
+type HttpSource struct {
+	*poller
+	url             string
+	headers         map[string]string
+	bearerTokenFile string
+	rowsField       string
+	client          *http.Client
+	etag            string
+	lastRows        []tablewatch.Row
+}
+
+func NewHttpSource(name string, url string, headers map[string]string, bearerTokenFile string,
+	rowsField string, timeout time.Duration, sourceColumn string) (*HttpSource, error) {
+
+	if name == "" {
+		return nil, fmt.Errorf("source name is empty")
+	}
+
+	if url == "" {
+		return nil, fmt.Errorf("source url is empty")
+	}
+
+	return &HttpSource{
+		poller:          newPoller(name, sourceColumn),
+		url:             url,
+		headers:         headers,
+		bearerTokenFile: bearerTokenFile,
+		rowsField:       rowsField,
+		client:          &http.Client{Timeout: timeout},
+	}, nil
+}
+
+func (s *HttpSource) Watch(ctx context.Context, checkInterval int, output chan<- tablewatch.Snapshot) {
+	logger.Infof("Polling %s from %s", s.name, s.url)
+	s.run(ctx, checkInterval, output, s.fetch)
+}
+
+// The token is read on every request, so it can be rotated
+func (s *HttpSource) getBearerToken() (string, error) {
+	if s.bearerTokenFile == "" {
+		return "", nil
+	}
+
+	tokenBytes, err := os.ReadFile(s.bearerTokenFile)
+	if err != nil {
+		return "", err
+	}
+
+	return strings.Trim(string(tokenBytes), " \n"), nil
+}
+
+func (s *HttpSource) buildRequest(ctx context.Context) (*http.Request, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, s.url, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	req.Header.Set("Accept", "application/json")
+	for name, value := range s.headers {
+		req.Header.Set(name, value)
+	}
+
+	token, err := s.getBearerToken()
+	if err != nil {
+		return nil, err
+	}
+
+	if token != "" {
+		req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", token))
+	}
+
+	if s.etag != "" && s.lastRows != nil {
+		req.Header.Set("If-None-Match", s.etag)
+	}
+
+	return req, nil
+}
+
+func (s *HttpSource) fetch(ctx context.Context) ([]tablewatch.Row, error) {
+	req, err := s.buildRequest(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotModified {
+		logger.Debugf("Rows of %s were not modified", s.name)
+		return copyRows(s.lastRows), nil
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return nil, fmt.Errorf("unexpected status %s from %s: %s", resp.Status, s.url, body)
+	}
+
+	rows, err := s.decodeRows(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	s.etag = resp.Header.Get("ETag")
+	s.lastRows = rows
+	return copyRows(rows), nil
+}
+
+func (s *HttpSource) decodeRows(body io.Reader) ([]tablewatch.Row, error) {
+	decoder := json.NewDecoder(body)
+	decoder.UseNumber()
+
+	var document interface{}
+	if err := decoder.Decode(&document); err != nil {
+		return nil, err
+	}
+
+	if s.rowsField != "" {
+		object, ok := document.(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("response of %s is not an object", s.url)
+		}
+
+		document = object[s.rowsField]
+	}
+
+	items, ok := document.([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("rows of %s are not a list", s.url)
+	}
+
+	return buildRows(items)
+}
+
+// The consumers may add columns to the rows, the cached rows are never handed out
+func copyRows(rows []tablewatch.Row) []tablewatch.Row {
+	result := make([]tablewatch.Row, 0, len(rows))
+	for _, row := range rows {
+		copied := make(tablewatch.Row, len(row))
+		for column, value := range row {
+			copied[column] = value
+		}
+
+		result = append(result, copied)
+	}
+
+	return result
+}
@@ -0,0 +1,51 @@
+package source
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestHttpSourceTimeout(t *testing.T) {
+	tests := []struct {
+		name    string
+		delay   time.Duration
+		timeout time.Duration
+		fails   bool
+	}{
+		{name: "fast response", delay: 0, timeout: time.Second},
+		{name: "no timeout", delay: 50 * time.Millisecond, timeout: 0},
+		{name: "slow response", delay: time.Second, timeout: 50 * time.Millisecond, fails: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				select {
+				case <-time.After(test.delay):
+				case <-r.Context().Done():
+					return
+				}
+
+				w.Write([]byte(`[{"tenant_id": "a"}]`))
+			}))
+			defer server.Close()
+
+			source, err := NewHttpSource("test", server.URL, nil, "", "", test.timeout, "")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			rows, err := source.fetch(context.Background())
+			if test.fails != (err != nil) {
+				t.Fatalf("expected failure %v, got %v", test.fails, err)
+			}
+
+			if !test.fails && (len(rows) != 1 || rows[0]["tenant_id"] != "a") {
+				t.Fatalf("unexpected rows %v", rows)
+			}
+		})
+	}
+}
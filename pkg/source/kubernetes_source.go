@@ -0,0 +1,110 @@
+package source
+
+import (
+	"context"
+	"dvdlevanon/kubernetes-database-scaler/pkg/tablewatch"
+	"fmt"
+
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+const NAME_COLUMN = "metadata.name"
+const NAMESPACE_COLUMN = "metadata.namespace"
+
+// KubernetesSource lists objects of any kind, every object is a row. The row of a ConfigMap
+//
+//	is its data, for other kinds (e.g. a custom resource) it is the top level fields of the spec.
+//	The name and namespace of the object are added as the metadata.name and metadata.namespace columns.
+type KubernetesSource struct {
+	*poller
+	reader        client.Reader
+	gvk           schema.GroupVersionKind
+	namespace     string
+	labelSelector labels.Selector
+}
+
+func NewKubernetesSource(name string, reader client.Reader, apiVersion string, kind string,
+	namespace string, labelSelector string, sourceColumn string) (*KubernetesSource, error) {
+
+	if name == "" {
+		return nil, fmt.Errorf("source name is empty")
+	}
+
+	if kind == "" {
+		return nil, fmt.Errorf("source kind is empty")
+	}
+
+	groupVersion, err := schema.ParseGroupVersion(apiVersion)
+	if err != nil {
+		return nil, err
+	}
+
+	selector, err := labels.Parse(labelSelector)
+	if err != nil {
+		return nil, err
+	}
+
+	return &KubernetesSource{
+		poller:        newPoller(name, sourceColumn),
+		reader:        reader,
+		gvk:           groupVersion.WithKind(kind),
+		namespace:     namespace,
+		labelSelector: selector,
+	}, nil
+}
+
+func (s *KubernetesSource) Watch(ctx context.Context, checkInterval int, output chan<- tablewatch.Snapshot) {
+	logger.Infof("Listing %s of %s in namespace %s (%s)", s.gvk.Kind, s.name, s.namespace, s.labelSelector)
+	s.run(ctx, checkInterval, output, s.fetch)
+}
+
+func (s *KubernetesSource) fetch(ctx context.Context) ([]tablewatch.Row, error) {
+	list := unstructured.UnstructuredList{}
+	list.SetGroupVersionKind(s.gvk.GroupVersion().WithKind(s.gvk.Kind + "List"))
+
+	options := []client.ListOption{client.MatchingLabelsSelector{Selector: s.labelSelector}}
+	if s.namespace != "" {
+		options = append(options, client.InNamespace(s.namespace))
+	}
+
+	if err := s.reader.List(ctx, &list, options...); err != nil {
+		return nil, err
+	}
+
+	rows := make([]tablewatch.Row, 0, len(list.Items))
+	for _, item := range list.Items {
+		if item.GetDeletionTimestamp() != nil {
+			continue
+		}
+
+		row, err := s.buildObjectRow(item)
+		if err != nil {
+			logger.Errorf("Unable to build row of %s %s", item.GetName(), err)
+			continue
+		}
+
+		rows = append(rows, row)
+	}
+
+	return rows, nil
+}
+
+func (s *KubernetesSource) buildObjectRow(item unstructured.Unstructured) (tablewatch.Row, error) {
+	field := "spec"
+	if s.gvk.Group == "" && s.gvk.Kind == "ConfigMap" {
+		field = "data"
+	}
+
+	values, _, err := unstructured.NestedMap(item.Object, field)
+	if err != nil {
+		return nil, err
+	}
+
+	row := buildRow(values)
+	row[NAME_COLUMN] = item.GetName()
+	row[NAMESPACE_COLUMN] = item.GetNamespace()
+	return row, nil
+}
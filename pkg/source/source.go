@@ -0,0 +1,171 @@
+package source
+
+import (
+	"context"
+	"dvdlevanon/kubernetes-database-scaler/pkg/logs"
+	"dvdlevanon/kubernetes-database-scaler/pkg/tablewatch"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+var logger = logs.MustGetLogger("source")
+
+// Source produces snapshots of all the rows it holds, every checkInterval seconds or
+//
+//	whenever it learns about a change, until ctx is done.
+type Source interface {
+	Name() string
+	Watch(ctx context.Context, checkInterval int, output chan<- tablewatch.Snapshot)
+	ReadyCheck(req *http.Request) error
+}
+
+// The database watcher is the original source
+var _ Source = (*tablewatch.Tablewatch)(nil)
+
+type fetchFunc func(ctx context.Context) ([]tablewatch.Row, error)
+
+// poller implements the periodic part of a Source, the implementations provide the fetch
+//
+//	and may trigger an immediate fetch when they are notified about a change.
+type poller struct {
+	name          string
+	sourceColumn  string
+	trigger       chan struct{}
+	lock          sync.Mutex
+	checkInterval time.Duration
+	lastSuccess   time.Time
+}
+
+func newPoller(name string, sourceColumn string) *poller {
+	return &poller{
+		name:         name,
+		sourceColumn: sourceColumn,
+		trigger:      make(chan struct{}, 1),
+	}
+}
+
+func (p *poller) Name() string {
+	return p.name
+}
+
+// notify asks for a fetch as soon as possible, notifications during a fetch are merged.
+func (p *poller) notify() {
+	select {
+	case p.trigger <- struct{}{}:
+	default:
+	}
+}
+
+func (p *poller) run(ctx context.Context, checkInterval int, output chan<- tablewatch.Snapshot, fetch fetchFunc) {
+	p.lock.Lock()
+	p.checkInterval = time.Duration(checkInterval) * time.Second
+	p.lock.Unlock()
+
+	for {
+		if err := p.check(ctx, output, fetch); err == nil {
+			p.lock.Lock()
+			p.lastSuccess = time.Now()
+			p.lock.Unlock()
+		} else if ctx.Err() == nil {
+			logger.Errorf("Periodic check of %s failed with %s", p.name, err)
+		}
+
+		select {
+		case <-ctx.Done():
+			logger.Infof("Stopped watching %s", p.name)
+			return
+		case <-p.trigger:
+		case <-time.After(time.Duration(checkInterval) * time.Second):
+		}
+	}
+}
+
+func (p *poller) check(ctx context.Context, output chan<- tablewatch.Snapshot, fetch fetchFunc) error {
+	logger.Debugf("Periodic check of %s", p.name)
+
+	rows, err := fetch(ctx)
+	if err != nil {
+		return err
+	}
+
+	if p.sourceColumn != "" {
+		for _, row := range rows {
+			row[p.sourceColumn] = p.name
+		}
+	}
+
+	select {
+	case output <- tablewatch.Snapshot{Source: p.name, Rows: rows}:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// ReadyCheck fails when the source wasn't fetched successfully during the last few
+//
+//	check intervals, it matches healthz.Checker.
+func (p *poller) ReadyCheck(_ *http.Request) error {
+	p.lock.Lock()
+	lastSuccess := p.lastSuccess
+	threshold := p.checkInterval * 3
+	p.lock.Unlock()
+
+	if lastSuccess.IsZero() {
+		return fmt.Errorf("%s was not fetched successfully yet", p.name)
+	}
+
+	if time.Since(lastSuccess) > threshold {
+		return fmt.Errorf("last successful fetch of %s was at %s", p.name, lastSuccess.Format(time.RFC3339))
+	}
+
+	return nil
+}
+
+// formatValue converts a decoded json or yaml value to the string representation of a column.
+func formatValue(value interface{}) string {
+	switch v := value.(type) {
+	case nil:
+		return ""
+	case string:
+		return v
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	case bool, int, int64, json.Number:
+		return fmt.Sprintf("%v", v)
+	default:
+		encoded, err := json.Marshal(v)
+		if err != nil {
+			return fmt.Sprintf("%v", v)
+		}
+
+		return string(encoded)
+	}
+}
+
+func buildRow(values map[string]interface{}) tablewatch.Row {
+	row := make(tablewatch.Row, len(values))
+	for column, value := range values {
+		row[column] = formatValue(value)
+	}
+
+	return row
+}
+
+func buildRows(items []interface{}) ([]tablewatch.Row, error) {
+	rows := make([]tablewatch.Row, 0, len(items))
+	for i, item := range items {
+		values, ok := item.(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("item %d is not an object", i)
+		}
+
+		rows = append(rows, buildRow(values))
+	}
+
+	return rows, nil
+}
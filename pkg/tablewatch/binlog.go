@@ -0,0 +1,438 @@
+package tablewatch
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Binlog events and column types, only the ones used by BinlogReplication.
+//
+//	https://dev.mysql.com/doc/dev/mysql-server/latest/page_protocol_replication_binlog_event.html
+const (
+	queryEvent        = 2
+	rotateEvent       = 4
+	xidEvent          = 16
+	tableMapEvent     = 19
+	writeRowsEventV1  = 23
+	updateRowsEventV1 = 24
+	deleteRowsEventV1 = 25
+	writeRowsEventV2  = 30
+	updateRowsEventV2 = 31
+	deleteRowsEventV2 = 32
+
+	binlogEventHeaderSize = 19
+)
+
+const (
+	typeTiny       = 1
+	typeShort      = 2
+	typeLong       = 3
+	typeFloat      = 4
+	typeDouble     = 5
+	typeTimestamp  = 7
+	typeLongLong   = 8
+	typeInt24      = 9
+	typeDate       = 10
+	typeTime       = 11
+	typeDatetime   = 12
+	typeYear       = 13
+	typeNewDate    = 14
+	typeVarchar    = 15
+	typeBit        = 16
+	typeTimestamp2 = 17
+	typeDatetime2  = 18
+	typeTime2      = 19
+	typeJson       = 245
+	typeNewDecimal = 246
+	typeEnum       = 247
+	typeSet        = 248
+	typeTinyBlob   = 249
+	typeMediumBlob = 250
+	typeLongBlob   = 251
+	typeBlob       = 252
+	typeVarString  = 253
+	typeString     = 254
+	typeGeometry   = 255
+)
+
+// binlogPosition is where the next event starts, it's checkpointed as file:offset.
+type binlogPosition struct {
+	file   string
+	offset uint32
+}
+
+func (p binlogPosition) String() string {
+	return fmt.Sprintf("%s:%d", p.file, p.offset)
+}
+
+func parseBinlogPosition(checkpoint string) (binlogPosition, error) {
+	separator := strings.LastIndex(checkpoint, ":")
+	if separator <= 0 {
+		return binlogPosition{}, fmt.Errorf("invalid binlog position %s", checkpoint)
+	}
+
+	offset, err := strconv.ParseUint(checkpoint[separator+1:], 10, 32)
+	if err != nil {
+		return binlogPosition{}, fmt.Errorf("invalid binlog position %s", checkpoint)
+	}
+
+	return binlogPosition{file: checkpoint[:separator], offset: uint32(offset)}, nil
+}
+
+type littleEndianReader struct {
+	data []byte
+	err  error
+}
+
+func (r *littleEndianReader) next(n int) []byte {
+	if n < 0 {
+		r.err = fmt.Errorf("negative length")
+		n = 0
+	}
+
+	if r.err != nil {
+		return make([]byte, n)
+	}
+
+	if len(r.data) < n {
+		r.err = fmt.Errorf("message is too short")
+		return make([]byte, n)
+	}
+
+	result := r.data[:n]
+	r.data = r.data[n:]
+	return result
+}
+
+func (r *littleEndianReader) uint(n int) uint64 {
+	var value uint64
+	for i, b := range r.next(n) {
+		value |= uint64(b) << (8 * i)
+	}
+
+	return value
+}
+
+func (r *littleEndianReader) uint8() uint8 {
+	return uint8(r.uint(1))
+}
+
+func (r *littleEndianReader) uint16() uint16 {
+	return uint16(r.uint(2))
+}
+
+func (r *littleEndianReader) uint32() uint32 {
+	return uint32(r.uint(4))
+}
+
+func (r *littleEndianReader) lengthEncodedInt() uint64 {
+	first := r.uint8()
+	switch first {
+	case 0xfc:
+		return r.uint(2)
+	case 0xfd:
+		return r.uint(3)
+	case 0xfe:
+		return r.uint(8)
+	default:
+		return uint64(first)
+	}
+}
+
+// nulString reads up to a NUL byte, or to the end of the message when there is none
+func (r *littleEndianReader) nulString() string {
+	end := bytes.IndexByte(r.data, 0)
+	if end < 0 {
+		value := string(r.data)
+		r.data = r.data[len(r.data):]
+		return value
+	}
+
+	value := string(r.data[:end])
+	r.data = r.data[end+1:]
+	return value
+}
+
+type binlogEventHeader struct {
+	eventType byte
+	logPos    uint32
+}
+
+func parseBinlogEvent(data []byte, checksumSize int) (binlogEventHeader, []byte, error) {
+	if len(data) < binlogEventHeaderSize+checksumSize {
+		return binlogEventHeader{}, nil, fmt.Errorf("binlog event is too short")
+	}
+
+	header := binlogEventHeader{
+		eventType: data[4],
+		logPos:    binary.LittleEndian.Uint32(data[13:17]),
+	}
+
+	return header, data[binlogEventHeaderSize : len(data)-checksumSize], nil
+}
+
+func parseRotateEvent(body []byte) binlogPosition {
+	reader := &littleEndianReader{data: body}
+	offset := reader.uint(8)
+	return binlogPosition{file: string(reader.data), offset: uint32(offset)}
+}
+
+// parseQueryEvent returns the statement, BEGIN and COMMIT mark the transactions of non row events.
+func parseQueryEvent(body []byte) (string, error) {
+	reader := &littleEndianReader{data: body}
+	reader.uint32()
+	reader.uint32()
+	schemaLength := int(reader.uint8())
+	reader.uint16()
+	statusLength := int(reader.uint16())
+	reader.next(statusLength)
+	reader.next(schemaLength + 1)
+	if reader.err != nil {
+		return "", fmt.Errorf("invalid query event %s", reader.err)
+	}
+
+	return string(reader.data), nil
+}
+
+// tableMap describes the columns of the rows events that follow it, the names are not part
+//
+//	of the binlog by default, they are taken from the information schema.
+type tableMap struct {
+	schema  string
+	name    string
+	types   []byte
+	meta    []uint16
+	columns []tableColumn
+}
+
+type tableColumn struct {
+	name     string
+	unsigned bool
+}
+
+func parseTableMapEvent(body []byte) (uint64, *tableMap, error) {
+	reader := &littleEndianReader{data: body}
+	tableId := reader.uint(6)
+	reader.uint16()
+
+	table := &tableMap{}
+	table.schema = string(reader.next(int(reader.uint8())))
+	reader.next(1)
+	table.name = string(reader.next(int(reader.uint8())))
+	reader.next(1)
+
+	count := int(reader.lengthEncodedInt())
+	table.types = append(make([]byte, 0, count), reader.next(count)...)
+
+	metaReader := &littleEndianReader{data: reader.next(int(reader.lengthEncodedInt()))}
+	table.meta = make([]uint16, count)
+	for i, columnType := range table.types {
+		switch columnType {
+		case typeFloat, typeDouble, typeBlob, typeTinyBlob, typeMediumBlob, typeLongBlob,
+			typeJson, typeGeometry, typeTimestamp2, typeDatetime2, typeTime2:
+			table.meta[i] = uint16(metaReader.uint8())
+		case typeVarchar, typeVarString, typeBit:
+			table.meta[i] = metaReader.uint16()
+		case typeNewDecimal, typeString, typeEnum, typeSet:
+			table.meta[i] = uint16(metaReader.uint8())<<8 | uint16(metaReader.uint8())
+		}
+	}
+
+	if reader.err != nil || metaReader.err != nil {
+		return 0, nil, fmt.Errorf("invalid table map event")
+	}
+
+	return tableId, table, nil
+}
+
+func isRowsEvent(eventType byte) bool {
+	return eventType >= writeRowsEventV1 && eventType <= deleteRowsEventV1 ||
+		eventType >= writeRowsEventV2 && eventType <= deleteRowsEventV2
+}
+
+// parseRowsEvent returns the table and the rows of the event, an update has both the
+//
+//	before and after image of each row. A value that can't be formatted (e.g. a date) is left out.
+//	The events of tables missing from tables are skipped, the table returned is nil.
+func parseRowsEvent(eventType byte, body []byte, tables map[uint64]*tableMap) (*tableMap, []Row, error) {
+	reader := &littleEndianReader{data: body}
+	tableId := reader.uint(6)
+	reader.uint16()
+	if eventType >= writeRowsEventV2 {
+		reader.next(int(reader.uint16()) - 2)
+	}
+
+	table, ok := tables[tableId]
+	if !ok {
+		return nil, nil, nil
+	}
+
+	count := int(reader.lengthEncodedInt())
+	if count != len(table.types) {
+		return nil, nil, fmt.Errorf("rows event of %s.%s has %d columns instead of %d", table.schema, table.name, count, len(table.types))
+	}
+
+	images := [][]byte{reader.next((count + 7) / 8)}
+	if eventType == updateRowsEventV1 || eventType == updateRowsEventV2 {
+		images = append(images, reader.next((count+7)/8))
+	}
+
+	rows := make([]Row, 0)
+	for len(reader.data) > 0 && reader.err == nil {
+		for _, present := range images {
+			row, err := table.parseRow(reader, present)
+			if err != nil {
+				return nil, nil, err
+			}
+
+			rows = append(rows, row)
+		}
+	}
+
+	if reader.err != nil {
+		return nil, nil, fmt.Errorf("invalid rows event %s", reader.err)
+	}
+
+	return table, rows, nil
+}
+
+func isBitSet(bitmap []byte, index int) bool {
+	return bitmap[index/8]&(1<<(index%8)) != 0
+}
+
+func (t *tableMap) parseRow(reader *littleEndianReader, present []byte) (Row, error) {
+	presentCount := 0
+	for i := range t.types {
+		if isBitSet(present, i) {
+			presentCount++
+		}
+	}
+
+	nulls := reader.next((presentCount + 7) / 8)
+	row := make(Row)
+	index := 0
+	for i, columnType := range t.types {
+		if !isBitSet(present, i) {
+			continue
+		}
+
+		isNull := isBitSet(nulls, index)
+		index++
+		if isNull {
+			continue
+		}
+
+		unsigned := i < len(t.columns) && t.columns[i].unsigned
+		value, ok, err := parseValue(reader, columnType, t.meta[i], unsigned)
+		if err != nil {
+			return nil, fmt.Errorf("column %d of %s.%s %s", i, t.schema, t.name, err)
+		}
+
+		if ok && i < len(t.columns) {
+			row[t.columns[i].name] = value
+		}
+	}
+
+	return row, reader.err
+}
+
+var decimalDigitsToBytes = []int{0, 1, 1, 2, 2, 3, 3, 4, 4, 4}
+
+func decimalSize(meta uint16) int {
+	precision := int(meta >> 8)
+	scale := int(meta & 0xff)
+	integral := precision - scale
+	return integral/9*4 + decimalDigitsToBytes[integral%9] + scale/9*4 + decimalDigitsToBytes[scale%9]
+}
+
+func formatInt(value uint64, size int, unsigned bool) string {
+	if unsigned {
+		return strconv.FormatUint(value, 10)
+	}
+
+	shift := 64 - 8*size
+	return strconv.FormatInt(int64(value<<shift)>>shift, 10)
+}
+
+func readString(reader *littleEndianReader, lengthSize int) string {
+	return string(reader.next(int(reader.uint(lengthSize))))
+}
+
+// parseValue formats integers and strings the way CAST(column AS CHAR) does, the other
+//
+//	types are skipped and reported as not ok.
+func parseValue(reader *littleEndianReader, columnType byte, meta uint16, unsigned bool) (string, bool, error) {
+	switch columnType {
+	case typeTiny:
+		return formatInt(reader.uint(1), 1, unsigned), true, nil
+	case typeShort:
+		return formatInt(reader.uint(2), 2, unsigned), true, nil
+	case typeInt24:
+		return formatInt(reader.uint(3), 3, unsigned), true, nil
+	case typeLong:
+		return formatInt(reader.uint(4), 4, unsigned), true, nil
+	case typeLongLong:
+		return formatInt(reader.uint(8), 8, unsigned), true, nil
+	case typeYear:
+		year := reader.uint(1)
+		if year == 0 {
+			return "0000", true, nil
+		}
+
+		return strconv.FormatUint(1900+year, 10), true, nil
+	case typeVarchar, typeVarString:
+		if meta < 256 {
+			return readString(reader, 1), true, nil
+		}
+
+		return readString(reader, 2), true, nil
+	case typeString:
+		realType := byte(meta >> 8)
+		length := int(meta & 0xff)
+		if realType == typeEnum || realType == typeSet {
+			reader.next(length)
+			return "", false, nil
+		}
+
+		if realType&0x30 != 0x30 {
+			length |= int((realType&0x30)^0x30) << 4
+		}
+
+		if length < 256 {
+			return readString(reader, 1), true, nil
+		}
+
+		return readString(reader, 2), true, nil
+	case typeBlob, typeTinyBlob, typeMediumBlob, typeLongBlob:
+		return readString(reader, int(meta)), true, nil
+	case typeJson, typeGeometry:
+		readString(reader, int(meta))
+	case typeFloat:
+		reader.next(4)
+	case typeDouble, typeDatetime:
+		reader.next(8)
+	case typeDate, typeNewDate, typeTime:
+		reader.next(3)
+	case typeTimestamp:
+		reader.next(4)
+	case typeTimestamp2:
+		reader.next(4 + int(meta+1)/2)
+	case typeDatetime2:
+		reader.next(5 + int(meta+1)/2)
+	case typeTime2:
+		reader.next(3 + int(meta+1)/2)
+	case typeNewDecimal:
+		reader.next(decimalSize(meta))
+	case typeBit:
+		reader.next(int(meta>>8) + (int(meta&0xff)+7)/8)
+	case typeEnum, typeSet:
+		reader.next(int(meta & 0xff))
+	default:
+		return "", false, fmt.Errorf("unsupported column type %d", columnType)
+	}
+
+	return "", false, nil
+}
@@ -0,0 +1,479 @@
+package tablewatch
+
+import (
+	"context"
+	"dvdlevanon/kubernetes-database-scaler/pkg/logs"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+)
+
+const CHECKPOINT_INTERVAL = 10 * time.Second
+
+// The binlog file of the position was purged, or the position is invalid
+const binlogPositionErrorCode = 1236
+
+// CheckpointStore keeps the position of a replication across restarts.
+type CheckpointStore interface {
+	Load(ctx context.Context, name string) (string, error)
+	Save(ctx context.Context, name string, checkpoint string) error
+}
+
+// BinlogReplication tails the MySQL binlog (row based) instead of querying the whole table every
+//
+//	check interval. The full table is queried on start and every snapshot interval to reconcile
+//	missed changes. The position after the last delivered transaction is saved to the checkpoint
+//	store, so a restart resumes from it. Without a store, or a checkpoint, it starts from the
+//	current position of the server.
+type BinlogReplication struct {
+	*changeTracker
+	checkpointName string
+	serverId       uint32
+	checkpoints    CheckpointStore
+	position       binlogPosition
+	savedPosition  binlogPosition
+	tables         map[uint64]*tableMap
+	columns        map[string][]tableColumn
+	inTransaction  bool
+	rejected       bool
+}
+
+func (w *Tablewatch) NewBinlogReplication(tableName string, keyColumn string, checkpointName string,
+	serverId uint32, snapshotInterval time.Duration) (*BinlogReplication, error) {
+
+	if w.dbConn.driver != "mysql" {
+		return nil, fmt.Errorf("binlog replication is supported only by mysql, not %s", w.dbConn.driver)
+	}
+
+	tracker, err := newChangeTracker(w, tableName, keyColumn, snapshotInterval)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := isValidIdentifier(checkpointName); err != nil {
+		return nil, err
+	}
+
+	// Every replica of a server needs a unique id, derived from the checkpoint name by default
+	//
+	if serverId == 0 {
+		hash := fnv.New32a()
+		hash.Write([]byte(checkpointName))
+		serverId = hash.Sum32() | 1
+	}
+
+	return &BinlogReplication{
+		changeTracker:  tracker,
+		checkpointName: checkpointName,
+		serverId:       serverId,
+		tables:         make(map[uint64]*tableMap),
+		columns:        make(map[string][]tableColumn),
+	}, nil
+}
+
+func (r *BinlogReplication) SetCheckpointStore(checkpoints CheckpointStore) {
+	r.checkpoints = checkpoints
+}
+
+// Watch streams the changes until ctx is done, the whole table is sent every checkInterval
+//
+//	seconds from memory, so the cleaner and the readiness check see the source as healthy.
+func (r *BinlogReplication) Watch(ctx context.Context, checkInterval int, output chan<- Snapshot) {
+	r.log(logs.OPERATION_REPLICATION).Infof("Replicating %s from the binlog as server %d", r.name, r.serverId)
+
+	r.lock.Lock()
+	r.checkInterval = time.Duration(checkInterval) * time.Second
+	r.lock.Unlock()
+
+	go r.dbConn.watchDbCredentials(ctx)
+
+	for {
+		if err := r.replicate(ctx, time.Duration(checkInterval)*time.Second, output); err != nil && ctx.Err() == nil {
+			r.log(logs.OPERATION_REPLICATION).Errorf("Binlog replication of %s failed with %s", r.name, err)
+		}
+
+		select {
+		case <-ctx.Done():
+			r.saveCheckpoint()
+			r.log(logs.OPERATION_REPLICATION).Infof("Stopped replicating %s", r.name)
+			return
+		case <-time.After(time.Duration(checkInterval) * time.Second):
+		}
+	}
+}
+
+func (r *BinlogReplication) getChecksumSize(ctx context.Context) (int, error) {
+	ctx, cancel := r.dbConn.withQueryTimeout(ctx)
+	defer cancel()
+
+	var checksum string
+	if err := r.dbConn.getConn().QueryRowContext(ctx, "SELECT @@global.binlog_checksum").Scan(&checksum); err != nil {
+		return 0, err
+	}
+
+	if strings.EqualFold(checksum, "NONE") {
+		return 0, nil
+	}
+
+	return 4, nil
+}
+
+// getCurrentPosition asks the server for its current position, SHOW MASTER STATUS was renamed in 8.4
+func (r *BinlogReplication) getCurrentPosition(ctx context.Context) (binlogPosition, error) {
+	ctx, cancel := r.dbConn.withQueryTimeout(ctx)
+	defer cancel()
+
+	var lastErr error
+	for _, query := range []string{"SHOW BINARY LOG STATUS", "SHOW MASTER STATUS"} {
+		result, err := r.dbConn.getConn().QueryContext(ctx, query)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+
+		rows, err := r.handleRows(result)
+		result.Close()
+		if err != nil {
+			return binlogPosition{}, err
+		}
+
+		if len(rows) == 0 {
+			return binlogPosition{}, fmt.Errorf("binary logging is disabled")
+		}
+
+		offset, err := strconv.ParseUint(rows[0]["Position"], 10, 32)
+		if err != nil {
+			return binlogPosition{}, fmt.Errorf("invalid binlog position %s", rows[0]["Position"])
+		}
+
+		return binlogPosition{file: rows[0]["File"], offset: uint32(offset)}, nil
+	}
+
+	return binlogPosition{}, lastErr
+}
+
+// getStartPosition resumes from the checkpoint, unless the server rejected it (e.g. its binlog was
+//
+//	purged), the current position is checkpointed then so a restart doesn't try it again.
+func (r *BinlogReplication) getStartPosition(ctx context.Context) (binlogPosition, error) {
+	if r.rejected {
+		position, err := r.getCurrentPosition(ctx)
+		if err != nil {
+			return binlogPosition{}, err
+		}
+
+		r.rejected = false
+		r.position = position
+		r.saveCheckpoint()
+		return position, nil
+	}
+
+	if r.checkpoints != nil {
+		checkpoint, err := r.checkpoints.Load(ctx, r.checkpointName)
+		if err != nil {
+			return binlogPosition{}, err
+		}
+
+		if checkpoint != "" {
+			r.log(logs.OPERATION_REPLICATION).Infof("Resuming %s from checkpoint %s", r.name, checkpoint)
+			return parseBinlogPosition(checkpoint)
+		}
+	}
+
+	return r.getCurrentPosition(ctx)
+}
+
+// saveCheckpoint runs on shutdown as well, so it doesn't depend on the context of the watch
+func (r *BinlogReplication) saveCheckpoint() {
+	if r.checkpoints == nil || r.position.file == "" || r.position == r.savedPosition {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), CHECKPOINT_INTERVAL)
+	defer cancel()
+
+	if err := r.checkpoints.Save(ctx, r.checkpointName, r.position.String()); err != nil {
+		r.log(logs.OPERATION_REPLICATION).Errorf("Unable to save checkpoint %s of %s %s", r.position, r.name, err)
+		return
+	}
+
+	r.log(logs.OPERATION_REPLICATION).Debugf("Saved checkpoint %s of %s", r.position, r.name)
+	r.savedPosition = r.position
+}
+
+func (r *BinlogReplication) getColumns(ctx context.Context, table *tableMap) ([]tableColumn, error) {
+	key := fmt.Sprintf("%s.%s", table.schema, table.name)
+	if columns, ok := r.columns[key]; ok && len(columns) == len(table.types) {
+		return columns, nil
+	}
+
+	ctx, cancel := r.dbConn.withQueryTimeout(ctx)
+	defer cancel()
+
+	result, err := r.dbConn.getConn().QueryContext(ctx, "SELECT COLUMN_NAME, COLUMN_TYPE FROM information_schema.COLUMNS "+
+		"WHERE TABLE_SCHEMA = ? AND TABLE_NAME = ? ORDER BY ORDINAL_POSITION", table.schema, table.name)
+	if err != nil {
+		return nil, err
+	}
+
+	defer result.Close()
+
+	columns := make([]tableColumn, 0)
+	for result.Next() {
+		var name, columnType string
+		if err := result.Scan(&name, &columnType); err != nil {
+			return nil, err
+		}
+
+		columns = append(columns, tableColumn{name: name, unsigned: strings.Contains(columnType, "unsigned")})
+	}
+
+	if err := result.Err(); err != nil {
+		return nil, err
+	}
+
+	r.columns[key] = columns
+	return columns, nil
+}
+
+func (r *BinlogReplication) replicate(ctx context.Context, heartbeatInterval time.Duration, output chan<- Snapshot) error {
+	checksumSize, err := r.getChecksumSize(ctx)
+	if err != nil {
+		return err
+	}
+
+	if r.position.file == "" {
+		if r.position, err = r.getStartPosition(ctx); err != nil {
+			return err
+		}
+	}
+
+	// The changes replayed from the binlog are applied on top of this snapshot,
+	//	they are queried again so the rows end up as they are now.
+	//
+	if err := r.resync(ctx, output); err != nil {
+		return err
+	}
+
+	config, tlsConfig, err := r.dbConn.buildMysqlConfig()
+	if err != nil {
+		return err
+	}
+
+	conn, err := dialMysql(ctx, config, tlsConfig)
+	if err != nil {
+		return err
+	}
+
+	defer conn.close()
+
+	if err := conn.exec("SET @master_binlog_checksum = @@global.binlog_checksum"); err != nil {
+		return err
+	}
+
+	if err := conn.binlogDump(r.position, r.serverId); err != nil {
+		return err
+	}
+
+	r.log(logs.OPERATION_REPLICATION).Infof("Streaming binlog of %s from %s", r.name, r.position)
+
+	r.tables = make(map[uint64]*tableMap)
+	r.changedKeys = make(map[string]bool)
+	r.needsResync = false
+	r.inTransaction = false
+
+	done := make(chan struct{})
+	defer close(done)
+
+	packets := make(chan []byte)
+	errs := make(chan error, 1)
+	go func() {
+		for {
+			data, err := conn.readPacket()
+			if err != nil {
+				errs <- err
+				return
+			}
+
+			select {
+			case packets <- data:
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	heartbeat := time.NewTicker(heartbeatInterval)
+	defer heartbeat.Stop()
+	resync := time.NewTicker(r.snapshotInterval)
+	defer resync.Stop()
+	checkpoint := time.NewTicker(CHECKPOINT_INTERVAL)
+	defer checkpoint.Stop()
+
+	stream := r.position
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case err := <-errs:
+			return err
+		case <-heartbeat.C:
+			if err := r.emit(ctx, output, r.getRows(), nil, false); err != nil {
+				return err
+			}
+		case <-resync.C:
+			if err := r.resync(ctx, output); err != nil {
+				return err
+			}
+		case <-checkpoint.C:
+			r.saveCheckpoint()
+		case data := <-packets:
+			if err := r.handlePacket(ctx, output, data, checksumSize, &stream); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+func (r *BinlogReplication) handlePacket(ctx context.Context, output chan<- Snapshot, data []byte,
+	checksumSize int, stream *binlogPosition) error {
+
+	switch data[0] {
+	case 0x00:
+		return r.handleEvent(ctx, output, data[1:], checksumSize, stream)
+	case 0xff:
+		err := parseMysqlError(data)
+
+		// The binlog moved on without us, start over from the current position, the rows changed
+		//	in between are picked up by the full snapshot taken before streaming.
+		//
+		var mysqlErr *mysql.MySQLError
+		if errors.As(err, &mysqlErr) && mysqlErr.Number == binlogPositionErrorCode {
+			r.log(logs.OPERATION_REPLICATION).Warningf("Binlog position %s of %s is gone, resyncing from the current position", r.position, r.name)
+			r.position = binlogPosition{}
+			r.rejected = true
+		}
+
+		return err
+	default:
+		return fmt.Errorf("binlog stream of %s ended", r.name)
+	}
+}
+
+func (r *BinlogReplication) handleEvent(ctx context.Context, output chan<- Snapshot, data []byte,
+	checksumSize int, stream *binlogPosition) error {
+
+	header, body, err := parseBinlogEvent(data, checksumSize)
+	if err != nil {
+		return err
+	}
+
+	if header.logPos > 0 {
+		stream.offset = header.logPos
+	}
+
+	switch header.eventType {
+	case rotateEvent:
+		*stream = parseRotateEvent(body)
+		if !r.inTransaction {
+			r.position = *stream
+		}
+	case tableMapEvent:
+		return r.handleTableMap(ctx, body)
+	case queryEvent:
+		query, err := parseQueryEvent(body)
+		if err != nil {
+			return err
+		}
+
+		switch strings.ToUpper(strings.TrimSpace(query)) {
+		case "BEGIN":
+			r.inTransaction = true
+		case "COMMIT":
+			return r.commit(ctx, output, *stream)
+		default:
+			// A schema change, the columns are read again on the next table map
+			//
+			r.columns = make(map[string][]tableColumn)
+			if !r.inTransaction {
+				r.position = *stream
+			}
+		}
+	case xidEvent:
+		return r.commit(ctx, output, *stream)
+	default:
+		if isRowsEvent(header.eventType) {
+			r.handleRowsEvent(header.eventType, body)
+		}
+	}
+
+	return nil
+}
+
+func (r *BinlogReplication) handleTableMap(ctx context.Context, body []byte) error {
+	tableId, table, err := parseTableMapEvent(body)
+	if err != nil {
+		return err
+	}
+
+	if !r.isWatchedTable(table.schema, table.name) {
+		delete(r.tables, tableId)
+		return nil
+	}
+
+	columns, err := r.getColumns(ctx, table)
+	if err != nil {
+		return err
+	}
+
+	// The binlog is older than the current schema, the columns can't be matched
+	//
+	if len(columns) != len(table.types) {
+		r.log(logs.OPERATION_REPLICATION).Warningf("Columns of %s.%s changed, resyncing %s", table.schema, table.name, r.name)
+		delete(r.tables, tableId)
+		r.needsResync = true
+		return nil
+	}
+
+	table.columns = columns
+	r.tables[tableId] = table
+	return nil
+}
+
+func (r *BinlogReplication) handleRowsEvent(eventType byte, body []byte) {
+	table, rows, err := parseRowsEvent(eventType, body, r.tables)
+	if err != nil {
+		r.log(logs.OPERATION_REPLICATION).Warningf("Unable to parse rows event, resyncing %s %s", r.name, err)
+		r.needsResync = true
+		return
+	}
+
+	if table == nil {
+		return
+	}
+
+	for _, row := range rows {
+		r.addChangedKeys(row)
+	}
+}
+
+// commit delivers the changes of the transaction, the checkpoint is saved right away when it had any
+func (r *BinlogReplication) commit(ctx context.Context, output chan<- Snapshot, stream binlogPosition) error {
+	changed := r.needsResync || len(r.changedKeys) > 0
+	if err := r.handleCommit(ctx, output); err != nil {
+		return err
+	}
+
+	r.inTransaction = false
+	r.position = stream
+	if changed {
+		r.saveCheckpoint()
+	}
+
+	return nil
+}
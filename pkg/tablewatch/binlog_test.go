@@ -0,0 +1,347 @@
+package tablewatch
+
+import (
+	"context"
+	"encoding/hex"
+	"reflect"
+	"testing"
+)
+
+// Row based events of the table app.tenants (id INT, name VARCHAR(64), replicas TINYINT UNSIGNED),
+//
+//	in the format streamed by a server with binlog_checksum=CRC32, without the leading OK byte of the packet.
+var binlogEvents = map[string]string{
+	"begin":      "00f1536502010000002d0000003100000000000b00000000000000030000000061707000424547494e2e625bdd",
+	"tableMap":   "00f153651301000000350000006600000000006a0000000000010003617070000774656e616e74730003030f0102000106be57ddb1",
+	"writeRows":  "00f153651e01000000360000009c00000000006a000000000001000200030700010000000500616c706861c802feffffff0345db0851",
+	"updateRows": "00f153651f010000003d000000d900000000006a00000000000100020003070700010000000500616c706861c80001000000040062657461c94ff22183",
+	"deleteRows": "00f1536520010000002f0000000801000000006a00000000000100020003070001000000040062657461c971d32ccf",
+	"xid":        "00f1536510010000001f0000002701000000002a00000000000000452a0e7b",
+	"rotate":     "00f1536504010000002c000000000000000000040000000000000062696e6c6f672e303030303032e30f335d",
+	"alter":      "00f15365020100000057000000aa01000000000b00000000000000030000000061707000414c544552205441424c452074656e616e74732041444420434f4c554d4e20706c616e205641524348415228313629c614ce6d",
+}
+
+var tenantsColumns = []tableColumn{{name: "id"}, {name: "name"}, {name: "replicas", unsigned: true}}
+
+func getBinlogEvent(t *testing.T, name string) []byte {
+	data, err := hex.DecodeString(binlogEvents[name])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return data
+}
+
+func parseTenantsTableMap(t *testing.T) map[uint64]*tableMap {
+	_, body, err := parseBinlogEvent(getBinlogEvent(t, "tableMap"), 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tableId, table, err := parseTableMapEvent(body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	table.columns = tenantsColumns
+	return map[uint64]*tableMap{tableId: table}
+}
+
+func TestParseBinlogPosition(t *testing.T) {
+	tests := []struct {
+		checkpoint string
+		position   binlogPosition
+		valid      bool
+	}{
+		{checkpoint: "binlog.000001:157", position: binlogPosition{file: "binlog.000001", offset: 157}, valid: true},
+		{checkpoint: "host:3306-bin.000002:4", position: binlogPosition{file: "host:3306-bin.000002", offset: 4}, valid: true},
+		{checkpoint: "binlog.000001"},
+		{checkpoint: ":4"},
+		{checkpoint: "binlog.000001:-1"},
+		{checkpoint: "binlog.000001:4294967296"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.checkpoint, func(t *testing.T) {
+			position, err := parseBinlogPosition(test.checkpoint)
+			if test.valid != (err == nil) {
+				t.Fatalf("expected valid %v, got %v", test.valid, err)
+			}
+
+			if position != test.position {
+				t.Fatalf("expected %s, got %s", test.position, position)
+			}
+
+			if test.valid && position.String() != test.checkpoint {
+				t.Fatalf("expected %s, got %s", test.checkpoint, position.String())
+			}
+		})
+	}
+}
+
+func TestParseBinlogEvent(t *testing.T) {
+	tests := []struct {
+		name      string
+		eventType byte
+		logPos    uint32
+		bodySize  int
+	}{
+		{name: "begin", eventType: queryEvent, logPos: 49, bodySize: 22},
+		{name: "tableMap", eventType: tableMapEvent, logPos: 102, bodySize: 30},
+		{name: "writeRows", eventType: writeRowsEventV2, logPos: 156, bodySize: 31},
+		{name: "xid", eventType: xidEvent, logPos: 295, bodySize: 8},
+		{name: "rotate", eventType: rotateEvent, logPos: 0, bodySize: 21},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			header, body, err := parseBinlogEvent(getBinlogEvent(t, test.name), 4)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if header.eventType != test.eventType || header.logPos != test.logPos {
+				t.Fatalf("expected type %d at %d, got type %d at %d", test.eventType, test.logPos, header.eventType, header.logPos)
+			}
+
+			if len(body) != test.bodySize {
+				t.Fatalf("expected a body of %d bytes, got %d", test.bodySize, len(body))
+			}
+		})
+	}
+
+	if _, _, err := parseBinlogEvent(make([]byte, binlogEventHeaderSize+3), 4); err == nil {
+		t.Fatalf("expected a truncated event to fail")
+	}
+}
+
+func TestParseQueryEvent(t *testing.T) {
+	tests := []struct {
+		name  string
+		query string
+	}{
+		{name: "begin", query: "BEGIN"},
+		{name: "alter", query: "ALTER TABLE tenants ADD COLUMN plan VARCHAR(16)"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, body, err := parseBinlogEvent(getBinlogEvent(t, test.name), 4)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			query, err := parseQueryEvent(body)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if query != test.query {
+				t.Fatalf("expected %s, got %s", test.query, query)
+			}
+		})
+	}
+}
+
+func TestParseRotateEvent(t *testing.T) {
+	_, body, err := parseBinlogEvent(getBinlogEvent(t, "rotate"), 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	position := parseRotateEvent(body)
+	if position != (binlogPosition{file: "binlog.000002", offset: 4}) {
+		t.Fatalf("unexpected rotate position %s", position)
+	}
+}
+
+func TestParseTableMapEvent(t *testing.T) {
+	_, body, err := parseBinlogEvent(getBinlogEvent(t, "tableMap"), 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tableId, table, err := parseTableMapEvent(body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if tableId != 106 || table.schema != "app" || table.name != "tenants" {
+		t.Fatalf("unexpected table %d %s.%s", tableId, table.schema, table.name)
+	}
+
+	if !reflect.DeepEqual(table.types, []byte{typeLong, typeVarchar, typeTiny}) {
+		t.Fatalf("unexpected column types %v", table.types)
+	}
+
+	if !reflect.DeepEqual(table.meta, []uint16{0, 256, 0}) {
+		t.Fatalf("unexpected column meta %v", table.meta)
+	}
+
+	if _, _, err := parseTableMapEvent(body[:12]); err == nil {
+		t.Fatalf("expected a truncated table map to fail")
+	}
+}
+
+func TestParseRowsEvent(t *testing.T) {
+	tests := []struct {
+		name string
+		rows []Row
+	}{
+		{
+			name: "writeRows",
+			rows: []Row{
+				{"id": "1", "name": "alpha", "replicas": "200"},
+				{"id": "-2", "replicas": "3"},
+			},
+		},
+		{
+			name: "updateRows",
+			rows: []Row{
+				{"id": "1", "name": "alpha", "replicas": "200"},
+				{"id": "1", "name": "beta", "replicas": "201"},
+			},
+		},
+		{
+			name: "deleteRows",
+			rows: []Row{
+				{"id": "1", "name": "beta", "replicas": "201"},
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			header, body, err := parseBinlogEvent(getBinlogEvent(t, test.name), 4)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if !isRowsEvent(header.eventType) {
+				t.Fatalf("event type %d isn't a rows event", header.eventType)
+			}
+
+			table, rows, err := parseRowsEvent(header.eventType, body, parseTenantsTableMap(t))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if table == nil || table.name != "tenants" {
+				t.Fatalf("unexpected table %v", table)
+			}
+
+			if !reflect.DeepEqual(rows, test.rows) {
+				t.Fatalf("expected rows %v, got %v", test.rows, rows)
+			}
+
+			// Rows events of a table that isn't mapped are skipped
+			//
+			if table, _, err := parseRowsEvent(header.eventType, body, map[uint64]*tableMap{}); table != nil || err != nil {
+				t.Fatalf("expected an unmapped table to be skipped, got %v %v", table, err)
+			}
+		})
+	}
+}
+
+func newTestBinlogReplication() *BinlogReplication {
+	return &BinlogReplication{
+		changeTracker: &changeTracker{
+			Tablewatch:  &Tablewatch{name: DEFAULT_SOURCE_NAME, dbConn: &dbConn{driver: "mysql"}},
+			tableName:   "tenants",
+			keyColumn:   "id",
+			rows:        make(map[string]Row),
+			changedKeys: make(map[string]bool),
+		},
+		tables:  make(map[uint64]*tableMap),
+		columns: map[string][]tableColumn{"app.tenants": tenantsColumns},
+	}
+}
+
+func TestBinlogReplicationHandleEvent(t *testing.T) {
+	r := newTestBinlogReplication()
+	stream := binlogPosition{file: "binlog.000001", offset: 4}
+
+	for _, name := range []string{"begin", "tableMap", "writeRows", "updateRows"} {
+		if err := r.handleEvent(context.Background(), nil, getBinlogEvent(t, name), 4, &stream); err != nil {
+			t.Fatalf("unable to handle %s %s", name, err)
+		}
+	}
+
+	if !r.inTransaction {
+		t.Fatalf("expected a transaction after BEGIN")
+	}
+
+	if !reflect.DeepEqual(r.changedKeys, map[string]bool{"1": true, "-2": true}) {
+		t.Fatalf("unexpected changed keys %v", r.changedKeys)
+	}
+
+	if stream != (binlogPosition{file: "binlog.000001", offset: 217}) {
+		t.Fatalf("unexpected stream position %s", stream)
+	}
+
+	// The position is checkpointed only between transactions
+	//
+	if r.position != (binlogPosition{}) {
+		t.Fatalf("position moved inside a transaction %s", r.position)
+	}
+
+	r.inTransaction = false
+	if err := r.handleEvent(context.Background(), nil, getBinlogEvent(t, "alter"), 4, &stream); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(r.columns) != 0 {
+		t.Fatalf("expected a schema change to drop the known columns")
+	}
+
+	if err := r.handleEvent(context.Background(), nil, getBinlogEvent(t, "rotate"), 4, &stream); err != nil {
+		t.Fatal(err)
+	}
+
+	if r.position != (binlogPosition{file: "binlog.000002", offset: 4}) {
+		t.Fatalf("unexpected position after rotate %s", r.position)
+	}
+}
+
+func TestBinlogReplicationRejectedPosition(t *testing.T) {
+	tests := []struct {
+		name     string
+		packet   string
+		rejected bool
+	}{
+		{
+			name:     "purged binlog",
+			packet:   "ff" + "d404" + "23" + hex.EncodeToString([]byte("HY000Could not find first log file name in binary log index file")),
+			rejected: true,
+		},
+		{
+			name:   "access denied",
+			packet: "ff" + "1504" + "23" + hex.EncodeToString([]byte("28000Access denied")),
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			r := newTestBinlogReplication()
+			r.position = binlogPosition{file: "binlog.000001", offset: 157}
+			stream := r.position
+
+			data, err := hex.DecodeString(test.packet)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if err := r.handlePacket(context.Background(), nil, data, 4, &stream); err == nil {
+				t.Fatalf("expected an error packet to fail")
+			}
+
+			if r.rejected != test.rejected {
+				t.Fatalf("expected rejected %v, got %v", test.rejected, r.rejected)
+			}
+
+			if test.rejected != (r.position == binlogPosition{}) {
+				t.Fatalf("unexpected position %s", r.position)
+			}
+		})
+	}
+}
@@ -0,0 +1,241 @@
+package tablewatch
+
+import (
+	"context"
+	"dvdlevanon/kubernetes-database-scaler/pkg/logs"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+const DEFAULT_REPLICATION_SNAPSHOT_INTERVAL = time.Hour
+
+// changeTracker keeps the rows of a source fed by change events. The changed rows are queried
+//
+//	again by keyColumn through the watched query, so the filters apply as usual, and sent as
+//	partial snapshots along with the removed rows.
+type changeTracker struct {
+	*Tablewatch
+	tableName        string
+	keyColumn        string
+	snapshotInterval time.Duration
+	rows             map[string]Row
+	changedKeys      map[string]bool
+	needsResync      bool
+}
+
+func newChangeTracker(w *Tablewatch, tableName string, keyColumn string,
+	snapshotInterval time.Duration) (*changeTracker, error) {
+
+	if tableName == "" {
+		return nil, fmt.Errorf("replication table name is empty")
+	}
+
+	if keyColumn == "" {
+		return nil, fmt.Errorf("replication key column is empty")
+	}
+
+	for _, identifier := range []string{tableName, keyColumn} {
+		if err := isValidIdentifier(identifier); err != nil {
+			return nil, err
+		}
+	}
+
+	if snapshotInterval <= 0 {
+		snapshotInterval = DEFAULT_REPLICATION_SNAPSHOT_INTERVAL
+	}
+
+	return &changeTracker{
+		Tablewatch:       w,
+		tableName:        tableName,
+		keyColumn:        keyColumn,
+		snapshotInterval: snapshotInterval,
+		rows:             make(map[string]Row),
+		changedKeys:      make(map[string]bool),
+	}, nil
+}
+
+// isWatchedTable matches the table name, without a schema any schema matches.
+func (t *changeTracker) isWatchedTable(schema string, name string) bool {
+	if tableSchema, tableName, found := strings.Cut(t.tableName, "."); found {
+		return schema == tableSchema && name == tableName
+	}
+
+	return name == t.tableName
+}
+
+// addChangedKeys finds the key of a row, the old row of an update or delete may hold only the
+//
+//	replica identity (e.g. the primary key), so the known rows are searched by its columns.
+func (t *changeTracker) addChangedKeys(row Row) {
+	if key, ok := row[t.keyColumn]; ok {
+		t.changedKeys[key] = true
+		return
+	}
+
+	found := false
+	for key, known := range t.rows {
+		if isPartialRow(known, row) {
+			t.changedKeys[key] = true
+			found = true
+		}
+	}
+
+	if !found && len(row) > 0 {
+		t.log(logs.OPERATION_REPLICATION).Debugf("Row %v not found by its replica identity, resyncing %s", row, t.name)
+		t.needsResync = true
+	}
+}
+
+func isPartialRow(row Row, partial Row) bool {
+	if len(partial) == 0 {
+		return false
+	}
+
+	for column, value := range partial {
+		if known, ok := row[column]; !ok || known != value {
+			return false
+		}
+	}
+
+	return true
+}
+
+// handleCommit sends the changes of a committed transaction
+func (t *changeTracker) handleCommit(ctx context.Context, output chan<- Snapshot) error {
+	defer func() {
+		t.changedKeys = make(map[string]bool)
+		t.needsResync = false
+	}()
+
+	if t.needsResync {
+		return t.resync(ctx, output)
+	}
+
+	if len(t.changedKeys) == 0 {
+		return nil
+	}
+
+	return t.refresh(ctx, output)
+}
+
+func (t *changeTracker) buildKeyQuery(keys []string) (string, []any) {
+	args := append(make([]any, 0, len(t.sqlArgs)+len(keys)), t.sqlArgs...)
+
+	if t.dbConn.driver == "postgres" {
+		args = append(args, pq.Array(keys))
+		return fmt.Sprintf("SELECT * FROM (%s) AS watched WHERE %s::text = ANY($%d)",
+			t.sqlQuery, t.keyColumn, len(args)), args
+	}
+
+	for _, key := range keys {
+		args = append(args, key)
+	}
+
+	placeholders := strings.TrimSuffix(strings.Repeat("?, ", len(keys)), ", ")
+	return fmt.Sprintf("SELECT * FROM (%s) AS watched WHERE CAST(%s AS CHAR) IN (%s)",
+		t.sqlQuery, t.keyColumn, placeholders), args
+}
+
+// refresh queries the changed keys, a key no longer returned was deleted or stopped matching the filters
+func (t *changeTracker) refresh(ctx context.Context, output chan<- Snapshot) error {
+	keys := make([]string, 0, len(t.changedKeys))
+	for key := range t.changedKeys {
+		keys = append(keys, key)
+	}
+
+	queryCtx, cancel := t.dbConn.withQueryTimeout(ctx)
+	defer cancel()
+
+	log := t.queryLog()
+	start := time.Now()
+	keyQuery, args := t.buildKeyQuery(keys)
+	result, err := t.dbConn.getConn().QueryContext(queryCtx, keyQuery, args...)
+	if err != nil {
+		return err
+	}
+
+	defer result.Close()
+	rows, err := t.handleRows(result)
+	if err != nil {
+		return err
+	}
+
+	changed := make([]Row, 0, len(rows))
+	for _, row := range rows {
+		key := row[t.keyColumn]
+		t.rows[key] = row
+		delete(t.changedKeys, key)
+		changed = append(changed, copyRow(row))
+	}
+
+	removed := make([]Row, 0)
+	for key := range t.changedKeys {
+		if row, ok := t.rows[key]; ok {
+			removed = append(removed, row)
+			delete(t.rows, key)
+		}
+	}
+
+	log.WithDuration(time.Since(start)).Debugf("Replicated %d changed and %d removed rows of %s", len(changed), len(removed), t.name)
+	return t.emit(ctx, output, changed, removed, true)
+}
+
+// resync replaces the known rows with a full query of the table
+func (t *changeTracker) resync(ctx context.Context, output chan<- Snapshot) error {
+	log := t.queryLog()
+	log.Debugf("Full snapshot of %s", t.name)
+
+	rows, err := t.query(ctx, log)
+	if err != nil {
+		return err
+	}
+
+	previous := t.rows
+	t.rows = make(map[string]Row, len(rows))
+	for _, row := range rows {
+		t.rows[row[t.keyColumn]] = row
+	}
+
+	removed := make([]Row, 0)
+	for key, row := range previous {
+		if _, ok := t.rows[key]; !ok {
+			removed = append(removed, row)
+		}
+	}
+
+	return t.emit(ctx, output, t.getRows(), removed, false)
+}
+
+// The consumers may add columns to the rows, the known rows are never handed out
+func (t *changeTracker) getRows() []Row {
+	result := make([]Row, 0, len(t.rows))
+	for _, row := range t.rows {
+		result = append(result, copyRow(row))
+	}
+
+	return result
+}
+
+func copyRow(row Row) Row {
+	result := make(Row, len(row))
+	for column, value := range row {
+		result[column] = value
+	}
+
+	return result
+}
+
+func (t *changeTracker) emit(ctx context.Context, output chan<- Snapshot, rows []Row, removed []Row, partial bool) error {
+	select {
+	case output <- Snapshot{Source: t.name, Rows: rows, Removed: removed, Partial: partial}:
+		t.lock.Lock()
+		t.lastSuccess = time.Now()
+		t.lock.Unlock()
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -1,18 +1,57 @@
 package tablewatch
 
 import (
+	"context"
+	"crypto/sha256"
 	"database/sql"
+	"dvdlevanon/kubernetes-database-scaler/pkg/logs"
 	"fmt"
 	"os"
 	"path"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/fsnotify/fsnotify"
+	"github.com/go-sql-driver/mysql"
+	"github.com/lib/pq"
 )
 
+var credentialsLogger = logger.WithOperation(logs.OPERATION_CREDENTIALS)
+
+// TLSConfig holds the libpq ssl options, the certificate files are read on every new connection
+//
+//	and the connection pool is reopened when they change.
+type TLSConfig struct {
+	Mode     string
+	RootCert string
+	Cert     string
+	Key      string
+}
+
+func (t TLSConfig) getFiles() []string {
+	files := make([]string, 0)
+	for _, file := range []string{t.RootCert, t.Cert, t.Key} {
+		if file != "" {
+			files = append(files, file)
+		}
+	}
+
+	return files
+}
+
+// dbCredentials is what the connection depends on, the certificates are compared by their digest.
+type dbCredentials struct {
+	url          string
+	username     string
+	password     string
+	certificates string
+}
+
 type dbConn struct {
 	driver       string
+	url          string
+	urlFile      string
 	host         string
 	port         string
 	dbname       string
@@ -20,6 +59,9 @@ type dbConn struct {
 	password     string
 	usernameFile string
 	passwordFile string
+	tls          TLSConfig
+	queryTimeout time.Duration
+	lock         sync.RWMutex
 	conn         *sql.DB
 }
 
@@ -32,7 +74,7 @@ func (d *dbConn) getUsername() (string, error) {
 		return "", nil
 	}
 
-	logger.Debugf("Reading DB username from file %s", d.usernameFile)
+	credentialsLogger.Debugf("Reading DB username from file %s", d.usernameFile)
 
 	usernameBytes, err := os.ReadFile(d.usernameFile)
 	if err != nil {
@@ -51,7 +93,7 @@ func (d *dbConn) getPassword() (string, error) {
 		return "", nil
 	}
 
-	logger.Debugf("Reading DB password from file %s", d.passwordFile)
+	credentialsLogger.Debugf("Reading DB password from file %s", d.passwordFile)
 
 	passwordBytes, err := os.ReadFile(d.passwordFile)
 	if err != nil {
@@ -61,6 +103,53 @@ func (d *dbConn) getPassword() (string, error) {
 	return strings.Trim(string(passwordBytes), " \n"), nil
 }
 
+func (d *dbConn) getUrl() (string, error) {
+	if d.url != "" {
+		return d.url, nil
+	}
+
+	if d.urlFile == "" {
+		return "", nil
+	}
+
+	credentialsLogger.Debugf("Reading DB url from file %s", d.urlFile)
+
+	urlBytes, err := os.ReadFile(d.urlFile)
+	if err != nil {
+		return "", err
+	}
+
+	return strings.Trim(string(urlBytes), " \n"), nil
+}
+
+func (d *dbConn) getCertificatesDigest() (string, error) {
+	hash := sha256.New()
+	for _, file := range d.tls.getFiles() {
+		content, err := os.ReadFile(file)
+		if err != nil {
+			return "", err
+		}
+
+		hash.Write([]byte(file))
+		hash.Write(content)
+	}
+
+	return fmt.Sprintf("%x", hash.Sum(nil)), nil
+}
+
+// quoteDsnValue quotes values containing spaces, quotes or backslashes as libpq expects.
+func quoteDsnValue(value string) string {
+	if value != "" && !strings.ContainsAny(value, ` '\`) {
+		return value
+	}
+
+	return fmt.Sprintf("'%s'", strings.NewReplacer(`\`, `\\`, `'`, `\'`).Replace(value))
+}
+
+// buildPostgresConnectionInfo starts with the database url, if any, and appends the options that are set,
+//
+//	libpq takes the last value of a repeated key so the options override the url.
+//	Missing options are left for libpq to take from the PG* environment variables and .pgpass.
 func (d *dbConn) buildPostgresConnectionInfo() (string, error) {
 	password, err := d.getPassword()
 	if err != nil {
@@ -72,18 +161,41 @@ func (d *dbConn) buildPostgresConnectionInfo() (string, error) {
 		return "", err
 	}
 
-	dsn := fmt.Sprintf("host=%s port=%s dbname=%s",
-		d.host, d.port, d.dbname)
+	url, err := d.getUrl()
+	if err != nil {
+		return "", err
+	}
 
-	if username != "" {
-		dsn = fmt.Sprintf("%s user=%s", dsn, username)
+	dsn := url
+	if strings.HasPrefix(url, "postgres://") || strings.HasPrefix(url, "postgresql://") {
+		dsn, err = pq.ParseURL(url)
+		if err != nil {
+			return "", fmt.Errorf("invalid database url %s", err)
+		}
 	}
 
-	if password != "" {
-		dsn = fmt.Sprintf("%s password=%s", dsn, password)
+	options := []struct {
+		key   string
+		value string
+	}{
+		{"host", d.host},
+		{"port", d.port},
+		{"dbname", d.dbname},
+		{"user", username},
+		{"password", password},
+		{"sslmode", d.tls.Mode},
+		{"sslrootcert", d.tls.RootCert},
+		{"sslcert", d.tls.Cert},
+		{"sslkey", d.tls.Key},
 	}
 
-	return dsn, nil
+	for _, option := range options {
+		if option.value != "" {
+			dsn = fmt.Sprintf("%s %s=%s", dsn, option.key, quoteDsnValue(option.value))
+		}
+	}
+
+	return strings.TrimSpace(dsn), nil
 }
 
 func (d *dbConn) openDbConnection() (*sql.DB, error) {
@@ -97,21 +209,46 @@ func (d *dbConn) openDbConnection() (*sql.DB, error) {
 		if err == nil {
 			sqlconn, err = sql.Open("postgres", dsn)
 		}
+	case "mysql":
+		var config *mysql.Config
+		config, _, err = d.buildMysqlConfig()
+		if err == nil {
+			sqlconn, err = sql.Open("mysql", config.FormatDSN())
+		}
 	default:
 		err = fmt.Errorf("unsupported database driver %s", d.driver)
 	}
 
 	if err != nil {
-		logger.Errorf("Error openning db connection %s", err)
+		credentialsLogger.Errorf("Error openning db connection %s", err)
 		return nil, err
 	}
 
 	return sqlconn, err
 }
 
-func (d *dbConn) verifyDbConnection() error {
-	if err := d.conn.Ping(); err != nil {
-		logger.Errorf("Error pinging db %s", err)
+// getConn returns the current connection, it is replaced when the credentials are rotated.
+func (d *dbConn) getConn() *sql.DB {
+	d.lock.RLock()
+	defer d.lock.RUnlock()
+
+	return d.conn
+}
+
+func (d *dbConn) withQueryTimeout(ctx context.Context) (context.Context, context.CancelFunc) {
+	if d.queryTimeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+
+	return context.WithTimeout(ctx, d.queryTimeout)
+}
+
+func (d *dbConn) verifyDbConnection(ctx context.Context) error {
+	ctx, cancel := d.withQueryTimeout(ctx)
+	defer cancel()
+
+	if err := d.getConn().PingContext(ctx); err != nil {
+		credentialsLogger.Errorf("Error pinging db %s", err)
 		return err
 	}
 
@@ -119,14 +256,17 @@ func (d *dbConn) verifyDbConnection() error {
 }
 
 func (d *dbConn) openAndVerify() error {
-	oldConn := d.conn
 	conn, err := d.openDbConnection()
 	if err != nil {
 		return err
 	}
 
+	d.lock.Lock()
+	oldConn := d.conn
 	d.conn = conn
-	result := d.verifyDbConnection()
+	d.lock.Unlock()
+
+	result := d.verifyDbConnection(context.Background())
 
 	if oldConn != nil {
 		oldConn.Close()
@@ -135,6 +275,24 @@ func (d *dbConn) openAndVerify() error {
 	return result
 }
 
+func (d *dbConn) close() error {
+	return d.getConn().Close()
+}
+
+func (d *dbConn) exec(query string, args ...any) error {
+	ctx, cancel := d.withQueryTimeout(context.Background())
+	defer cancel()
+
+	log := newQueryLog()
+	start := time.Now()
+	if _, err := d.getConn().ExecContext(ctx, query, args...); err != nil {
+		log.WithDuration(time.Since(start)).Errorf("Error executing %s %s", query, err)
+		return err
+	}
+
+	return nil
+}
+
 func (d *dbConn) getDirsToWatch() map[string]bool {
 	dirs := make(map[string]bool)
 
@@ -148,24 +306,42 @@ func (d *dbConn) getDirsToWatch() map[string]bool {
 		dirs[dir] = true
 	}
 
+	if d.urlFile != "" {
+		dirs[path.Dir(d.urlFile)] = true
+	}
+
+	for _, file := range d.tls.getFiles() {
+		dirs[path.Dir(file)] = true
+	}
+
 	return dirs
 }
 
-func (d *dbConn) getCurrentCredentials() (string, string, error) {
+func (d *dbConn) getCurrentCredentials() (dbCredentials, error) {
+	url, err := d.getUrl()
+	if err != nil {
+		return dbCredentials{}, err
+	}
+
 	username, err := d.getUsername()
 	if err != nil {
-		return "", "", err
+		return dbCredentials{}, err
 	}
 
 	password, err := d.getPassword()
 	if err != nil {
-		return "", "", err
+		return dbCredentials{}, err
 	}
 
-	return username, password, nil
+	certificates, err := d.getCertificatesDigest()
+	if err != nil {
+		return dbCredentials{}, err
+	}
+
+	return dbCredentials{url: url, username: username, password: password, certificates: certificates}, nil
 }
 
-func (d *dbConn) watchDbCredentials() {
+func (d *dbConn) watchDbCredentials(ctx context.Context) {
 	dirs := d.getDirsToWatch()
 	if len(dirs) == 0 {
 		return
@@ -173,24 +349,24 @@ func (d *dbConn) watchDbCredentials() {
 
 	watcher, err := fsnotify.NewWatcher()
 	if err != nil {
-		logger.Errorf("Error initializing watcher %s", err)
+		credentialsLogger.Errorf("Error initializing watcher %s", err)
 		return
 	}
 	defer watcher.Close()
 
 	for dir := range dirs {
 		if err := watcher.Add(dir); err != nil {
-			logger.Errorf("Unable to watch directory %s: %s", dir, err)
+			credentialsLogger.Errorf("Unable to watch directory %s: %s", dir, err)
 			return
 		}
 	}
 
-	logger.Debugf("Start watching for DB credential changes in directories: %v", dirs)
+	credentialsLogger.Debugf("Start watching for DB credential changes in directories: %v", dirs)
 
 	// Get initial credentials
-	currentUsername, currentPassword, err := d.getCurrentCredentials()
+	currentCredentials, err := d.getCurrentCredentials()
 	if err != nil {
-		logger.Errorf("Failed to get initial credentials: %s", err)
+		credentialsLogger.Errorf("Failed to get initial credentials: %s", err)
 		return
 	}
 
@@ -200,6 +376,9 @@ func (d *dbConn) watchDbCredentials() {
 
 	for {
 		select {
+		case <-ctx.Done():
+			return
+
 		case event, ok := <-watcher.Events:
 			if !ok {
 				return
@@ -208,7 +387,7 @@ func (d *dbConn) watchDbCredentials() {
 			dir := path.Dir(event.Name)
 			name := path.Base(event.Name)
 
-			logger.Debugf("File Changed on the Filesystem [dir: %s] [name: %s] [operation: %s]", dir, name, event.Op)
+			credentialsLogger.Debugf("File Changed on the Filesystem [dir: %s] [name: %s] [operation: %s]", dir, name, event.Op)
 
 			// Check if this event is in one of our watched directories
 			if _, ok := dirs[dir]; !ok {
@@ -224,23 +403,22 @@ func (d *dbConn) watchDbCredentials() {
 
 		case <-reloadChan:
 			// Timer expired, check if credentials actually changed
-			newUsername, newPassword, err := d.getCurrentCredentials()
+			newCredentials, err := d.getCurrentCredentials()
 			if err != nil {
-				logger.Errorf("Failed to read credentials during reload check: %s", err)
+				credentialsLogger.Errorf("Failed to read credentials during reload check: %s", err)
 				continue
 			}
 
-			if newUsername != currentUsername || newPassword != currentPassword {
-				logger.Infof("Credentials changed, reloading DB connection")
+			if newCredentials != currentCredentials {
+				credentialsLogger.Infof("Credentials changed, reloading DB connection")
 				if err := d.openAndVerify(); err != nil {
-					logger.Errorf("Error opening db connection during rotation: %s", err)
+					credentialsLogger.Errorf("Error opening db connection during rotation: %s", err)
 				} else {
-					logger.Infof("Successfully reloaded DB credentials")
-					currentUsername = newUsername
-					currentPassword = newPassword
+					credentialsLogger.Infof("Successfully reloaded DB credentials")
+					currentCredentials = newCredentials
 				}
 			} else {
-				logger.Debugf("File system event detected but credentials unchanged, skipping reload")
+				credentialsLogger.Debugf("File system event detected but credentials unchanged, skipping reload")
 			}
 
 			// Clear the channel to prevent it from being selected again
@@ -250,7 +428,7 @@ func (d *dbConn) watchDbCredentials() {
 			if !ok {
 				return
 			}
-			logger.Errorf("Error reading from watcher: %s", err)
+			credentialsLogger.Errorf("Error reading from watcher: %s", err)
 		}
 	}
 }
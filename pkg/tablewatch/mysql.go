@@ -0,0 +1,159 @@
+package tablewatch
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"os"
+
+	"github.com/go-sql-driver/mysql"
+)
+
+// getClientConfig maps the libpq ssl modes to a tls config for the drivers other than postgres,
+//
+//	nil means no TLS. Like libpq, verify-ca checks the certificate chain but not the host name.
+func (t TLSConfig) getClientConfig(serverName string) (*tls.Config, error) {
+	config := &tls.Config{ServerName: serverName}
+
+	switch t.Mode {
+	case "", "disable", "allow", "prefer":
+		return nil, nil
+	case "require":
+		config.InsecureSkipVerify = true
+	case "verify-ca", "verify-full":
+	default:
+		return nil, fmt.Errorf("invalid sslmode %s", t.Mode)
+	}
+
+	if t.RootCert != "" {
+		pem, err := os.ReadFile(t.RootCert)
+		if err != nil {
+			return nil, err
+		}
+
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificate found in %s", t.RootCert)
+		}
+	}
+
+	if t.Cert != "" || t.Key != "" {
+		certificate, err := tls.LoadX509KeyPair(t.Cert, t.Key)
+		if err != nil {
+			return nil, err
+		}
+
+		config.Certificates = []tls.Certificate{certificate}
+	}
+
+	if t.Mode == "verify-ca" {
+		config.InsecureSkipVerify = true
+		config.VerifyPeerCertificate = func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+			return verifyChain(rawCerts, config.RootCAs)
+		}
+	}
+
+	return config, nil
+}
+
+func verifyChain(rawCerts [][]byte, roots *x509.CertPool) error {
+	if len(rawCerts) == 0 {
+		return fmt.Errorf("no server certificate")
+	}
+
+	intermediates := x509.NewCertPool()
+	certificates := make([]*x509.Certificate, 0, len(rawCerts))
+	for _, raw := range rawCerts {
+		certificate, err := x509.ParseCertificate(raw)
+		if err != nil {
+			return err
+		}
+
+		certificates = append(certificates, certificate)
+	}
+
+	for _, certificate := range certificates[1:] {
+		intermediates.AddCert(certificate)
+	}
+
+	_, err := certificates[0].Verify(x509.VerifyOptions{Roots: roots, Intermediates: intermediates})
+	return err
+}
+
+// buildMysqlConfig starts with the database url, if any, in the go-sql-driver dsn format
+//
+//	(e.g. user:password@tcp(host:3306)/dbname), and overrides it with the options that are set.
+func (d *dbConn) buildMysqlConfig() (*mysql.Config, *tls.Config, error) {
+	password, err := d.getPassword()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	username, err := d.getUsername()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	url, err := d.getUrl()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	config := mysql.NewConfig()
+	if url != "" {
+		config, err = mysql.ParseDSN(url)
+		if err != nil {
+			return nil, nil, fmt.Errorf("invalid database url %s", err)
+		}
+	}
+
+	config.Net = "tcp"
+	if d.host != "" || d.port != "" || config.Addr == "" {
+		config.Addr = net.JoinHostPort(withDefault(d.host, "localhost"), withDefault(d.port, "3306"))
+	}
+
+	if d.dbname != "" {
+		config.DBName = d.dbname
+	}
+
+	if username != "" {
+		config.User = username
+	}
+
+	if password != "" {
+		config.Passwd = password
+	}
+
+	host, _, err := net.SplitHostPort(config.Addr)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	tlsConfig, err := d.tls.getClientConfig(host)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if tlsConfig != nil {
+		// Registered by address, so a rotated certificate replaces the previous config
+		//
+		if err := mysql.RegisterTLSConfig(config.Addr, tlsConfig); err != nil {
+			return nil, nil, err
+		}
+
+		config.TLSConfig = config.Addr
+	} else if d.tls.Mode == "prefer" || d.tls.Mode == "allow" {
+		config.TLSConfig = "preferred"
+	}
+
+	return config, tlsConfig, nil
+}
+
+func withDefault(value string, defaultValue string) string {
+	if value == "" {
+		return defaultValue
+	}
+
+	return value
+}
@@ -0,0 +1,376 @@
+package tablewatch
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/binary"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"net"
+
+	"github.com/go-sql-driver/mysql"
+)
+
+// The sql driver doesn't expose the replication commands, mysqlConn implements the few
+//
+//	parts of the client protocol needed to stream the binlog.
+//	https://dev.mysql.com/doc/dev/mysql-server/latest/PAGE_PROTOCOL.html
+const (
+	mysqlMaxPacketSize = 1<<24 - 1
+
+	clientLongPassword     = 0x1
+	clientProtocol41       = 0x200
+	clientSsl              = 0x800
+	clientTransactions     = 0x2000
+	clientSecureConnection = 0x8000
+	clientPluginAuth       = 0x80000
+
+	utf8mb4GeneralCi = 45
+
+	comQuery      = 0x03
+	comBinlogDump = 0x12
+
+	nativePassword      = "mysql_native_password"
+	cachingSha2Password = "caching_sha2_password"
+)
+
+type mysqlConn struct {
+	conn     net.Conn
+	sequence byte
+	secure   bool
+}
+
+func dialMysql(ctx context.Context, config *mysql.Config, tlsConfig *tls.Config) (*mysqlConn, error) {
+	dialer := net.Dialer{}
+	conn, err := dialer.DialContext(ctx, "tcp", config.Addr)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &mysqlConn{conn: conn}
+	if err := c.handshake(config.User, config.Passwd, tlsConfig); err != nil {
+		c.close()
+		return nil, err
+	}
+
+	return c, nil
+}
+
+func (c *mysqlConn) close() error {
+	return c.conn.Close()
+}
+
+func (c *mysqlConn) readPacket() ([]byte, error) {
+	payload := make([]byte, 0)
+	header := make([]byte, 4)
+	for {
+		if _, err := io.ReadFull(c.conn, header); err != nil {
+			return nil, err
+		}
+
+		length := int(header[0]) | int(header[1])<<8 | int(header[2])<<16
+		c.sequence = header[3] + 1
+
+		data := make([]byte, length)
+		if _, err := io.ReadFull(c.conn, data); err != nil {
+			return nil, err
+		}
+
+		payload = append(payload, data...)
+		if length < mysqlMaxPacketSize {
+			return payload, nil
+		}
+	}
+}
+
+func (c *mysqlConn) writePacket(payload []byte) error {
+	for {
+		length := len(payload)
+		if length > mysqlMaxPacketSize {
+			length = mysqlMaxPacketSize
+		}
+
+		packet := append([]byte{byte(length), byte(length >> 8), byte(length >> 16), c.sequence}, payload[:length]...)
+		c.sequence++
+		if _, err := c.conn.Write(packet); err != nil {
+			return err
+		}
+
+		payload = payload[length:]
+		if length < mysqlMaxPacketSize {
+			return nil
+		}
+	}
+}
+
+func parseMysqlError(data []byte) error {
+	reader := &littleEndianReader{data: data[1:]}
+	mysqlErr := &mysql.MySQLError{Number: reader.uint16()}
+	if len(reader.data) > 0 && reader.data[0] == '#' {
+		reader.next(1)
+		copy(mysqlErr.SQLState[:], reader.next(5))
+	}
+
+	mysqlErr.Message = string(reader.data)
+	return mysqlErr
+}
+
+func (c *mysqlConn) handshake(username string, password string, tlsConfig *tls.Config) error {
+	data, err := c.readPacket()
+	if err != nil {
+		return err
+	}
+
+	if data[0] == 0xff {
+		return parseMysqlError(data)
+	}
+
+	reader := &littleEndianReader{data: data[1:]}
+	reader.nulString()
+	reader.uint32()
+	scramble := append(make([]byte, 0, 20), reader.next(8)...)
+	reader.next(1)
+	capabilities := uint32(reader.uint16())
+	reader.uint8()
+	reader.uint16()
+	capabilities |= uint32(reader.uint16()) << 16
+	scrambleLength := int(reader.uint8())
+	reader.next(10)
+
+	if capabilities&clientSecureConnection != 0 {
+		length := scrambleLength - 8
+		if length < 13 {
+			length = 13
+		}
+
+		scramble = append(scramble, bytes.TrimRight(reader.next(length), "\x00")...)
+	}
+
+	plugin := nativePassword
+	if capabilities&clientPluginAuth != 0 {
+		plugin = reader.nulString()
+	}
+
+	if reader.err != nil {
+		return fmt.Errorf("invalid handshake %s", reader.err)
+	}
+
+	flags := uint32(clientLongPassword | clientProtocol41 | clientTransactions | clientSecureConnection | clientPluginAuth)
+	if tlsConfig != nil {
+		if capabilities&clientSsl == 0 {
+			return fmt.Errorf("server doesn't support TLS")
+		}
+
+		if err := c.upgradeToTls(flags|clientSsl, tlsConfig); err != nil {
+			return err
+		}
+
+		flags |= clientSsl
+	}
+
+	authResponse, err := scramblePassword(plugin, password, scramble)
+	if err != nil {
+		return err
+	}
+
+	response := buildHandshakePrefix(flags)
+	response = append(append(response, username...), 0)
+	response = append(append(response, byte(len(authResponse))), authResponse...)
+	response = append(append(response, plugin...), 0)
+	if err := c.writePacket(response); err != nil {
+		return err
+	}
+
+	return c.authenticate(plugin, password, scramble)
+}
+
+func buildHandshakePrefix(flags uint32) []byte {
+	prefix := binary.LittleEndian.AppendUint32(make([]byte, 0, 32), flags)
+	prefix = binary.LittleEndian.AppendUint32(prefix, 0)
+	prefix = append(prefix, utf8mb4GeneralCi)
+	return append(prefix, make([]byte, 23)...)
+}
+
+func (c *mysqlConn) upgradeToTls(flags uint32, tlsConfig *tls.Config) error {
+	if err := c.writePacket(buildHandshakePrefix(flags)); err != nil {
+		return err
+	}
+
+	tlsConn := tls.Client(c.conn, tlsConfig)
+	if err := tlsConn.Handshake(); err != nil {
+		return err
+	}
+
+	c.conn = tlsConn
+	c.secure = true
+	return nil
+}
+
+func (c *mysqlConn) authenticate(plugin string, password string, scramble []byte) error {
+	for {
+		data, err := c.readPacket()
+		if err != nil {
+			return err
+		}
+
+		switch data[0] {
+		case 0x00:
+			return nil
+		case 0xff:
+			return parseMysqlError(data)
+		case 0xfe:
+			reader := &littleEndianReader{data: data[1:]}
+			plugin = reader.nulString()
+			scramble = bytes.TrimRight(reader.data, "\x00")
+
+			authResponse, err := scramblePassword(plugin, password, scramble)
+			if err != nil {
+				return err
+			}
+
+			if err := c.writePacket(authResponse); err != nil {
+				return err
+			}
+		case 0x01:
+			if plugin != cachingSha2Password || len(data) < 2 {
+				return fmt.Errorf("unexpected authentication data of %s", plugin)
+			}
+
+			// 3 is a cached password, an OK packet follows. 4 asks for the full password
+			//
+			if data[1] == 4 {
+				if err := c.sendFullPassword(password, scramble); err != nil {
+					return err
+				}
+			}
+		default:
+			return fmt.Errorf("unexpected authentication packet %x", data[0])
+		}
+	}
+}
+
+// sendFullPassword sends the password in clear over TLS, otherwise encrypted by the public key of the server
+func (c *mysqlConn) sendFullPassword(password string, scramble []byte) error {
+	plain := append([]byte(password), 0)
+	if c.secure {
+		return c.writePacket(plain)
+	}
+
+	if err := c.writePacket([]byte{2}); err != nil {
+		return err
+	}
+
+	data, err := c.readPacket()
+	if err != nil {
+		return err
+	}
+
+	if data[0] == 0xff {
+		return parseMysqlError(data)
+	}
+
+	block, _ := pem.Decode(data[1:])
+	if block == nil {
+		return fmt.Errorf("invalid public key of server")
+	}
+
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return err
+	}
+
+	publicKey, ok := key.(*rsa.PublicKey)
+	if !ok {
+		return fmt.Errorf("public key of server is not an rsa key")
+	}
+
+	for i := range plain {
+		plain[i] ^= scramble[i%len(scramble)]
+	}
+
+	encrypted, err := rsa.EncryptOAEP(sha1.New(), rand.Reader, publicKey, plain, nil)
+	if err != nil {
+		return err
+	}
+
+	return c.writePacket(encrypted)
+}
+
+func scramblePassword(plugin string, password string, scramble []byte) ([]byte, error) {
+	if password == "" {
+		return []byte{}, nil
+	}
+
+	switch plugin {
+	case nativePassword:
+		// SHA1(password) XOR SHA1(scramble + SHA1(SHA1(password)))
+		stage1 := sha1.Sum([]byte(password))
+		stage2 := sha1.Sum(stage1[:])
+		hash := sha1.New()
+		hash.Write(scramble)
+		hash.Write(stage2[:])
+		result := hash.Sum(nil)
+		for i := range result {
+			result[i] ^= stage1[i]
+		}
+
+		return result, nil
+	case cachingSha2Password:
+		// SHA256(password) XOR SHA256(SHA256(SHA256(password)) + scramble)
+		stage1 := sha256.Sum256([]byte(password))
+		stage2 := sha256.Sum256(stage1[:])
+		hash := sha256.New()
+		hash.Write(stage2[:])
+		hash.Write(scramble)
+		result := hash.Sum(nil)
+		for i := range result {
+			result[i] ^= stage1[i]
+		}
+
+		return result, nil
+	default:
+		return nil, fmt.Errorf("unsupported authentication plugin %s", plugin)
+	}
+}
+
+func (c *mysqlConn) command(command byte, payload []byte) error {
+	c.sequence = 0
+	return c.writePacket(append([]byte{command}, payload...))
+}
+
+// exec runs a statement without a result set (e.g. SET)
+func (c *mysqlConn) exec(query string) error {
+	if err := c.command(comQuery, []byte(query)); err != nil {
+		return err
+	}
+
+	data, err := c.readPacket()
+	if err != nil {
+		return err
+	}
+
+	switch data[0] {
+	case 0x00:
+		return nil
+	case 0xff:
+		return parseMysqlError(data)
+	default:
+		return fmt.Errorf("unexpected result of %s", query)
+	}
+}
+
+// binlogDump asks the server to stream the binlog from position, the events are read with readPacket.
+func (c *mysqlConn) binlogDump(position binlogPosition, serverId uint32) error {
+	payload := binary.LittleEndian.AppendUint32(make([]byte, 0), position.offset)
+	payload = binary.LittleEndian.AppendUint16(payload, 0)
+	payload = binary.LittleEndian.AppendUint32(payload, serverId)
+	payload = append(payload, position.file...)
+	return c.command(comBinlogDump, payload)
+}
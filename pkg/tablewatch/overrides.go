@@ -0,0 +1,115 @@
+package tablewatch
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Override is a patch of the duplicated deployment of a tenant, read from the overrides table
+type Override struct {
+	Tenant string
+	Type   string
+	Patch  string
+}
+
+// OverridesReader reads the per tenant patches of the duplicated deployments. The type column
+//
+//	is optional, overrides of a tenant are applied in the order of orderColumn when it's set.
+type OverridesReader struct {
+	dbConn       *dbConn
+	tableName    string
+	tenantColumn string
+	patchColumn  string
+	typeColumn   string
+	orderColumn  string
+}
+
+func (w *Tablewatch) NewOverridesReader(tableName string, tenantColumn string, patchColumn string,
+	typeColumn string, orderColumn string) (*OverridesReader, error) {
+
+	if tableName == "" {
+		return nil, fmt.Errorf("overrides table name is empty")
+	}
+
+	if tenantColumn == "" {
+		return nil, fmt.Errorf("overrides tenant column is empty")
+	}
+
+	if patchColumn == "" {
+		return nil, fmt.Errorf("overrides patch column is empty")
+	}
+
+	for _, identifier := range []string{tableName, tenantColumn, patchColumn, typeColumn, orderColumn} {
+		if identifier == "" {
+			continue
+		}
+
+		if err := isValidIdentifier(identifier); err != nil {
+			return nil, err
+		}
+	}
+
+	return &OverridesReader{
+		dbConn:       w.dbConn,
+		tableName:    tableName,
+		tenantColumn: tenantColumn,
+		patchColumn:  patchColumn,
+		typeColumn:   typeColumn,
+		orderColumn:  orderColumn,
+	}, nil
+}
+
+func (r *OverridesReader) buildQuery() string {
+	typeColumn := "NULL"
+	if r.typeColumn != "" {
+		typeColumn = r.typeColumn
+	}
+
+	order := []string{r.tenantColumn}
+	if r.orderColumn != "" {
+		order = append(order, r.orderColumn)
+	}
+
+	return fmt.Sprintf("SELECT %s, %s, %s FROM %s ORDER BY %s", r.tenantColumn, r.patchColumn,
+		typeColumn, r.tableName, strings.Join(order, ", "))
+}
+
+func (r *OverridesReader) ReadOverrides(ctx context.Context) ([]Override, error) {
+	ctx, cancel := r.dbConn.withQueryTimeout(ctx)
+	defer cancel()
+
+	log := newQueryLog()
+	start := time.Now()
+	rows, err := r.dbConn.getConn().QueryContext(ctx, r.buildQuery())
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	result := make([]Override, 0)
+	for rows.Next() {
+		var tenant, patch, patchType sql.NullString
+		if err := rows.Scan(&tenant, &patch, &patchType); err != nil {
+			return nil, err
+		}
+
+		if !tenant.Valid || !patch.Valid {
+			continue
+		}
+
+		result = append(result, Override{Tenant: tenant.String, Type: patchType.String, Patch: patch.String})
+	}
+
+	// A partial read would drop the overrides of the missing tenants
+	//
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	log.WithDuration(time.Since(start)).Debugf("Read %d overrides from %s", len(result), r.tableName)
+	return result, nil
+}
@@ -0,0 +1,193 @@
+package tablewatch
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"time"
+)
+
+// The replication protocol counts time in microseconds since 2000-01-01
+var postgresEpoch = time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC)
+
+// Messages of the pgoutput plugin, protocol version 1, only the fields used by Replication are kept.
+//
+//	https://www.postgresql.org/docs/current/protocol-logicalrep-message-formats.html
+type relationMessage struct {
+	id        uint32
+	namespace string
+	name      string
+	columns   []string
+}
+
+type tupleColumn struct {
+	kind  byte
+	value string
+}
+
+type changeMessage struct {
+	kind        byte
+	relationIds []uint32
+	oldTuple    []tupleColumn
+	newTuple    []tupleColumn
+}
+
+type beginMessage struct{}
+
+type commitMessage struct {
+	endLsn uint64
+}
+
+// messageReader consumes a message, the first read past the end records an error
+type messageReader struct {
+	data []byte
+	err  error
+}
+
+func (r *messageReader) next(n int) []byte {
+	if r.err != nil {
+		return make([]byte, n)
+	}
+
+	if len(r.data) < n {
+		r.err = fmt.Errorf("message is too short")
+		return make([]byte, n)
+	}
+
+	result := r.data[:n]
+	r.data = r.data[n:]
+	return result
+}
+
+func (r *messageReader) byte() byte {
+	return r.next(1)[0]
+}
+
+func (r *messageReader) uint16() uint16 {
+	return binary.BigEndian.Uint16(r.next(2))
+}
+
+func (r *messageReader) uint32() uint32 {
+	return binary.BigEndian.Uint32(r.next(4))
+}
+
+func (r *messageReader) uint64() uint64 {
+	return binary.BigEndian.Uint64(r.next(8))
+}
+
+func (r *messageReader) string() string {
+	end := bytes.IndexByte(r.data, 0)
+	if end < 0 {
+		r.err = fmt.Errorf("string is not terminated")
+		return ""
+	}
+
+	value := string(r.data[:end])
+	r.data = r.data[end+1:]
+	return value
+}
+
+func (r *messageReader) tuple() []tupleColumn {
+	count := int(r.uint16())
+	columns := make([]tupleColumn, 0, count)
+	for i := 0; i < count && r.err == nil; i++ {
+		column := tupleColumn{kind: r.byte()}
+		if column.kind == 't' {
+			column.value = string(r.next(int(r.uint32())))
+		}
+
+		columns = append(columns, column)
+	}
+
+	return columns
+}
+
+// decodePgoutput returns nil for the messages that don't matter to the watched table (e.g. type, origin).
+func decodePgoutput(data []byte) (interface{}, error) {
+	if len(data) == 0 {
+		return nil, fmt.Errorf("empty pgoutput message")
+	}
+
+	reader := &messageReader{data: data[1:]}
+	var message interface{}
+
+	switch data[0] {
+	case 'B':
+		message = &beginMessage{}
+	case 'C':
+		reader.byte()
+		reader.uint64()
+		message = &commitMessage{endLsn: reader.uint64()}
+	case 'R':
+		relation := &relationMessage{
+			id:        reader.uint32(),
+			namespace: reader.string(),
+			name:      reader.string(),
+		}
+
+		reader.byte()
+		count := int(reader.uint16())
+		for i := 0; i < count && reader.err == nil; i++ {
+			reader.byte()
+			relation.columns = append(relation.columns, reader.string())
+			reader.uint32()
+			reader.uint32()
+		}
+
+		message = relation
+	case 'I':
+		change := &changeMessage{kind: 'I', relationIds: []uint32{reader.uint32()}}
+		reader.byte()
+		change.newTuple = reader.tuple()
+		message = change
+	case 'U':
+		change := &changeMessage{kind: 'U', relationIds: []uint32{reader.uint32()}}
+		tupleType := reader.byte()
+		if tupleType == 'K' || tupleType == 'O' {
+			change.oldTuple = reader.tuple()
+			reader.byte()
+		}
+
+		change.newTuple = reader.tuple()
+		message = change
+	case 'D':
+		change := &changeMessage{kind: 'D', relationIds: []uint32{reader.uint32()}}
+		reader.byte()
+		change.oldTuple = reader.tuple()
+		message = change
+	case 'T':
+		change := &changeMessage{kind: 'T'}
+		count := int(reader.uint32())
+		reader.byte()
+		for i := 0; i < count && reader.err == nil; i++ {
+			change.relationIds = append(change.relationIds, reader.uint32())
+		}
+
+		message = change
+	default:
+		return nil, nil
+	}
+
+	if reader.err != nil {
+		return nil, fmt.Errorf("invalid pgoutput message %c %s", data[0], reader.err)
+	}
+
+	return message, nil
+}
+
+// buildStandbyStatusUpdate reports lsn as written, flushed and applied, the slot
+//
+//	won't send the changes before it again.
+func buildStandbyStatusUpdate(lsn uint64) []byte {
+	data := make([]byte, 0, 34)
+	data = append(data, 'r')
+	data = binary.BigEndian.AppendUint64(data, lsn)
+	data = binary.BigEndian.AppendUint64(data, lsn)
+	data = binary.BigEndian.AppendUint64(data, lsn)
+	data = binary.BigEndian.AppendUint64(data, uint64(time.Since(postgresEpoch).Microseconds()))
+	return append(data, 0)
+}
+
+func formatLsn(lsn uint64) string {
+	return fmt.Sprintf("%X/%X", uint32(lsn>>32), uint32(lsn))
+}
@@ -0,0 +1,258 @@
+package tablewatch
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/hex"
+	"reflect"
+	"testing"
+)
+
+// pgoutput messages (protocol version 1) of the table public.tenants (id, name, replicas)
+//
+//	with replica identity default, and of another table of the same publication.
+var pgoutputMessages = map[string]string{
+	"begin":         "4200000000016b37480002b5e0a3c1d2f000000007",
+	"relation":      "52000040017075626c69630074656e616e7473006400030169640000000017ffffffff006e616d650000000019ffffffff007265706c696361730000000017ffffffff",
+	"otherRelation": "52000040067075626c6963006f74686572006400010169640000000017ffffffff",
+	"insert":        "49000040014e00037400000001317400000005616c706861740000000132",
+	"update":        "55000040014e0003740000000131740000000462657461740000000133",
+	"updateKey":     "55000040014b00037400000001316e6e4e0003740000000134740000000462657461740000000133",
+	"delete":        "44000040014b00037400000001326e6e",
+	"otherInsert":   "49000040064e0001740000000139",
+	"truncate":      "54000000010000004001",
+	"commit":        "430000000000016b374800000000016b37780002b5e0a3c1d2f0",
+	"type":          "59000040107075626c6963006d6f6f6400",
+}
+
+func getPgoutputMessage(t *testing.T, name string) []byte {
+	data, err := hex.DecodeString(pgoutputMessages[name])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return data
+}
+
+// buildXLogData wraps a pgoutput message the way the walsender sends it
+func buildXLogData(message []byte) []byte {
+	data := []byte{'w'}
+	data = binary.BigEndian.AppendUint64(data, 0x16B3748)
+	data = binary.BigEndian.AppendUint64(data, 0x16B3778)
+	data = binary.BigEndian.AppendUint64(data, 0)
+	return append(data, message...)
+}
+
+func buildKeepalive(walEnd uint64, replyRequested bool) []byte {
+	data := []byte{'k'}
+	data = binary.BigEndian.AppendUint64(data, walEnd)
+	data = binary.BigEndian.AppendUint64(data, 0)
+	if replyRequested {
+		return append(data, 1)
+	}
+
+	return append(data, 0)
+}
+
+func TestDecodePgoutput(t *testing.T) {
+	tests := []struct {
+		name    string
+		message interface{}
+	}{
+		{name: "begin", message: &beginMessage{}},
+		{
+			name:    "relation",
+			message: &relationMessage{id: 16385, namespace: "public", name: "tenants", columns: []string{"id", "name", "replicas"}},
+		},
+		{
+			name: "insert",
+			message: &changeMessage{kind: 'I', relationIds: []uint32{16385},
+				newTuple: []tupleColumn{{kind: 't', value: "1"}, {kind: 't', value: "alpha"}, {kind: 't', value: "2"}}},
+		},
+		{
+			name: "update",
+			message: &changeMessage{kind: 'U', relationIds: []uint32{16385},
+				newTuple: []tupleColumn{{kind: 't', value: "1"}, {kind: 't', value: "beta"}, {kind: 't', value: "3"}}},
+		},
+		{
+			name: "updateKey",
+			message: &changeMessage{kind: 'U', relationIds: []uint32{16385},
+				oldTuple: []tupleColumn{{kind: 't', value: "1"}, {kind: 'n'}, {kind: 'n'}},
+				newTuple: []tupleColumn{{kind: 't', value: "4"}, {kind: 't', value: "beta"}, {kind: 't', value: "3"}}},
+		},
+		{
+			name: "delete",
+			message: &changeMessage{kind: 'D', relationIds: []uint32{16385},
+				oldTuple: []tupleColumn{{kind: 't', value: "2"}, {kind: 'n'}, {kind: 'n'}}},
+		},
+		{name: "truncate", message: &changeMessage{kind: 'T', relationIds: []uint32{16385}}},
+		{name: "commit", message: &commitMessage{endLsn: 0x16B3778}},
+		{name: "type", message: nil},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			message, err := decodePgoutput(getPgoutputMessage(t, test.name))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if !reflect.DeepEqual(message, test.message) {
+				t.Fatalf("expected %+v, got %+v", test.message, message)
+			}
+		})
+	}
+}
+
+func TestDecodeInvalidPgoutput(t *testing.T) {
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{name: "empty", data: []byte{}},
+		{name: "truncated insert", data: getPgoutputMessage(t, "insert")[:20]},
+		{name: "truncated commit", data: getPgoutputMessage(t, "commit")[:9]},
+		{name: "unterminated relation", data: getPgoutputMessage(t, "relation")[:10]},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if _, err := decodePgoutput(test.data); err == nil {
+				t.Fatalf("expected an error")
+			}
+		})
+	}
+}
+
+func newTestReplication() *Replication {
+	return &Replication{
+		changeTracker: &changeTracker{
+			Tablewatch:  &Tablewatch{name: DEFAULT_SOURCE_NAME, dbConn: &dbConn{driver: "postgres"}},
+			tableName:   "tenants",
+			keyColumn:   "id",
+			rows:        map[string]Row{"2": {"id": "2", "name": "gamma", "replicas": "1"}},
+			changedKeys: make(map[string]bool),
+		},
+		relations: make(map[uint32]*relationMessage),
+	}
+}
+
+func TestReplicationChangedKeys(t *testing.T) {
+	tests := []struct {
+		name        string
+		messages    []string
+		changedKeys map[string]bool
+		needsResync bool
+	}{
+		{
+			name:        "insert",
+			messages:    []string{"begin", "relation", "insert"},
+			changedKeys: map[string]bool{"1": true},
+		},
+		{
+			name:        "update of the key",
+			messages:    []string{"begin", "relation", "updateKey"},
+			changedKeys: map[string]bool{"1": true, "4": true},
+		},
+		{
+			name:        "delete by key",
+			messages:    []string{"begin", "relation", "delete"},
+			changedKeys: map[string]bool{"2": true},
+		},
+		{
+			name:        "another table",
+			messages:    []string{"begin", "relation", "otherRelation", "otherInsert"},
+			changedKeys: map[string]bool{},
+		},
+		{
+			name:        "unknown relation",
+			messages:    []string{"begin", "update"},
+			changedKeys: map[string]bool{},
+			needsResync: true,
+		},
+		{
+			name:        "truncate",
+			messages:    []string{"begin", "relation", "truncate"},
+			changedKeys: map[string]bool{},
+			needsResync: true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			r := newTestReplication()
+			for _, name := range test.messages {
+				if _, err := r.handleCopyData(context.Background(), nil, buildXLogData(getPgoutputMessage(t, name))); err != nil {
+					t.Fatalf("unable to handle %s %s", name, err)
+				}
+			}
+
+			if !r.inTransaction {
+				t.Fatalf("expected a transaction after begin")
+			}
+
+			if !reflect.DeepEqual(r.changedKeys, test.changedKeys) {
+				t.Fatalf("expected changed keys %v, got %v", test.changedKeys, r.changedKeys)
+			}
+
+			if r.needsResync != test.needsResync {
+				t.Fatalf("expected needs resync %v, got %v", test.needsResync, r.needsResync)
+			}
+		})
+	}
+}
+
+func TestReplicationKeepalive(t *testing.T) {
+	tests := []struct {
+		name           string
+		inTransaction  bool
+		replyRequested bool
+		flushedLsn     uint64
+	}{
+		{name: "idle", flushedLsn: 0x16B3778},
+		{name: "reply requested", replyRequested: true, flushedLsn: 0x16B3778},
+		{name: "in transaction", inTransaction: true, flushedLsn: 0x16B3700},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			r := newTestReplication()
+			r.flushedLsn = 0x16B3700
+			r.inTransaction = test.inTransaction
+
+			replyRequested, err := r.handleCopyData(context.Background(), nil, buildKeepalive(0x16B3778, test.replyRequested))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if replyRequested != test.replyRequested {
+				t.Fatalf("expected reply requested %v, got %v", test.replyRequested, replyRequested)
+			}
+
+			if r.flushedLsn != test.flushedLsn {
+				t.Fatalf("expected flushed lsn %s, got %s", formatLsn(test.flushedLsn), formatLsn(r.flushedLsn))
+			}
+		})
+	}
+
+	if _, err := newTestReplication().handleCopyData(context.Background(), nil, []byte{'k', 0, 1}); err == nil {
+		t.Fatalf("expected a truncated keepalive to fail")
+	}
+}
+
+func TestFormatLsn(t *testing.T) {
+	tests := []struct {
+		lsn      uint64
+		expected string
+	}{
+		{lsn: 0, expected: "0/0"},
+		{lsn: 0x16B3778, expected: "0/16B3778"},
+		{lsn: 0x1000000A0, expected: "1/A0"},
+	}
+
+	for _, test := range tests {
+		if formatLsn(test.lsn) != test.expected {
+			t.Fatalf("expected %s, got %s", test.expected, formatLsn(test.lsn))
+		}
+	}
+}
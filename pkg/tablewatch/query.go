@@ -0,0 +1,189 @@
+package tablewatch
+
+import (
+	"dvdlevanon/kubernetes-database-scaler/pkg/logs"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/xwb1989/sqlparser"
+)
+
+// Filter is a single condition of the watched query, its values are passed as query parameters
+//
+//	and are never formatted into the sql text.
+type Filter struct {
+	Column   string        `mapstructure:"column"`
+	Operator string        `mapstructure:"operator"`
+	Values   []interface{} `mapstructure:"values"`
+}
+
+// The number of values each operator takes, -1 stands for one or more
+var filterOperators = map[string]int{
+	"=":           1,
+	"!=":          1,
+	"<":           1,
+	"<=":          1,
+	">":           1,
+	">=":          1,
+	"like":        1,
+	"not like":    1,
+	"in":          -1,
+	"not in":      -1,
+	"is null":     0,
+	"is not null": 0,
+}
+
+// Keywords are matched as whole words, so columns like updated_by or created_at are allowed
+var disallowedKeywordsRegex = regexp.MustCompile(
+	`\b(truncate|insert|delete|update|drop|create|alter|grant|shutdown|exec)\b`)
+
+// This function help to prevent sql injection using the where clause.
+func isValidWhereClause(whereClause string) error {
+	if whereClause == "" {
+		return nil
+	}
+
+	stmt := fmt.Sprintf("select * from fake_table where %s", whereClause)
+	_, err := sqlparser.Parse(stmt)
+	if err != nil {
+		// Parsing fail if the where clause contains more than a single sql statement, like this sql injection
+		//
+		// 	"'1' = '1'; TRUNCATE table;"
+		//
+		logger.WithOperation(logs.OPERATION_QUERY).Warningf("Invalid where clause %s", stmt)
+		return err
+	}
+
+	disallowedPatterns := []string{
+		";",        // Prevents multiple statements
+		"--",       // Single line comment
+		"xp_",      // Common prefix for SQL Server system stored procedures
+		"/*", "*/", // Multi-line comment
+	}
+
+	normalizedClause := strings.ToLower(whereClause)
+
+	for _, pattern := range disallowedPatterns {
+		if strings.Contains(normalizedClause, pattern) {
+			return errors.New("disallowed pattern found in WHERE clause: " + pattern)
+		}
+	}
+
+	// DML, DDL and dangerous SQL Server commands
+	//
+	if keyword := disallowedKeywordsRegex.FindString(normalizedClause); keyword != "" {
+		return errors.New("disallowed keyword found in WHERE clause: " + keyword)
+	}
+
+	return nil
+}
+
+// queryBuilder renders the placeholders of the driver, $1, $2... for postgres and ? otherwise.
+type queryBuilder struct {
+	driver string
+	args   []any
+}
+
+func (b *queryBuilder) placeholder(value any) string {
+	b.args = append(b.args, value)
+	if b.driver == "postgres" {
+		return fmt.Sprintf("$%d", len(b.args))
+	}
+
+	return "?"
+}
+
+func (b *queryBuilder) buildCondition(filter Filter) (string, error) {
+	if err := isValidIdentifier(filter.Column); err != nil {
+		return "", err
+	}
+
+	operator := strings.ToLower(strings.Join(strings.Fields(filter.Operator), " "))
+	valuesCount, ok := filterOperators[operator]
+	if !ok {
+		return "", fmt.Errorf("invalid filter operator %s on column %s", filter.Operator, filter.Column)
+	}
+
+	switch {
+	case valuesCount == -1 && len(filter.Values) == 0:
+		return "", fmt.Errorf("filter operator %s on column %s requires values", operator, filter.Column)
+	case valuesCount != -1 && len(filter.Values) != valuesCount:
+		return "", fmt.Errorf("filter operator %s on column %s requires %d values, got %d",
+			operator, filter.Column, valuesCount, len(filter.Values))
+	}
+
+	switch operator {
+	case "is null", "is not null":
+		return fmt.Sprintf("%s %s", filter.Column, strings.ToUpper(operator)), nil
+	case "in", "not in":
+		placeholders := make([]string, len(filter.Values))
+		for i, value := range filter.Values {
+			placeholders[i] = b.placeholder(value)
+		}
+
+		return fmt.Sprintf("%s %s (%s)", filter.Column, strings.ToUpper(operator), strings.Join(placeholders, ", ")), nil
+	default:
+		return fmt.Sprintf("%s %s %s", filter.Column, strings.ToUpper(operator), b.placeholder(filter.Values[0])), nil
+	}
+}
+
+func buildColumnsList(columns []string) (string, error) {
+	if len(columns) == 0 {
+		return "*", nil
+	}
+
+	for _, column := range columns {
+		if err := isValidIdentifier(column); err != nil {
+			return "", err
+		}
+	}
+
+	return strings.Join(columns, ", "), nil
+}
+
+// buildSqlQuery compiles the watched query, sqlCondition is the legacy free form where clause,
+//
+//	it is validated and combined with the structured filters.
+func buildSqlQuery(driver string, tableName string, columns []string,
+	sqlCondition string, filters []Filter) (string, []any, error) {
+	if tableName == "" {
+		return "", nil, fmt.Errorf("table name is missing")
+	}
+
+	if err := isValidIdentifier(tableName); err != nil {
+		return "", nil, err
+	}
+
+	columnsList, err := buildColumnsList(columns)
+	if err != nil {
+		return "", nil, err
+	}
+
+	if err := isValidWhereClause(sqlCondition); err != nil {
+		return "", nil, err
+	}
+
+	builder := queryBuilder{driver: driver, args: make([]any, 0)}
+	conditions := make([]string, 0)
+	if sqlCondition != "" {
+		conditions = append(conditions, fmt.Sprintf("(%s)", sqlCondition))
+	}
+
+	for _, filter := range filters {
+		condition, err := builder.buildCondition(filter)
+		if err != nil {
+			return "", nil, err
+		}
+
+		conditions = append(conditions, condition)
+	}
+
+	query := fmt.Sprintf("SELECT %s FROM %s", columnsList, tableName)
+	if len(conditions) > 0 {
+		query = fmt.Sprintf("%s WHERE %s", query, strings.Join(conditions, " AND "))
+	}
+
+	return query, builder.args, nil
+}
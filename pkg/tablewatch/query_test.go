@@ -0,0 +1,259 @@
+package tablewatch
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestIsValidIdentifier(t *testing.T) {
+	tests := []struct {
+		identifier string
+		valid      bool
+	}{
+		{identifier: "tenants", valid: true},
+		{identifier: "_tenants2", valid: true},
+		{identifier: "app.tenants", valid: true},
+		{identifier: ""},
+		{identifier: "2tenants"},
+		{identifier: "app.db.tenants"},
+		{identifier: "tenants;"},
+		{identifier: "tenant id"},
+		{identifier: "`tenants`"},
+		{identifier: "tenants--"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.identifier, func(t *testing.T) {
+			if err := isValidIdentifier(test.identifier); test.valid != (err == nil) {
+				t.Fatalf("expected valid %v, got %v", test.valid, err)
+			}
+		})
+	}
+}
+
+func TestIsValidWhereClause(t *testing.T) {
+	tests := []struct {
+		whereClause string
+		valid       bool
+	}{
+		{whereClause: "", valid: true},
+		{whereClause: "active = 1", valid: true},
+		{whereClause: "updated_by = 'admin' and created_at > '2024-01-01'", valid: true},
+		{whereClause: "plan in ('pro', 'enterprise')", valid: true},
+		{whereClause: "'1' = '1'; TRUNCATE table tenants"},
+		{whereClause: "active = 1 -- comment"},
+		{whereClause: "active = 1 /* comment */"},
+		{whereClause: "id = 1 or exists (delete from tenants)"},
+		{whereClause: "name = xp_cmdshell"},
+		{whereClause: "active ="},
+	}
+
+	for _, test := range tests {
+		t.Run(test.whereClause, func(t *testing.T) {
+			if err := isValidWhereClause(test.whereClause); test.valid != (err == nil) {
+				t.Fatalf("expected valid %v, got %v", test.valid, err)
+			}
+		})
+	}
+}
+
+func TestBuildCondition(t *testing.T) {
+	tests := []struct {
+		name      string
+		driver    string
+		filter    Filter
+		condition string
+		args      []any
+		valid     bool
+	}{
+		{
+			name:      "equals",
+			driver:    "postgres",
+			filter:    Filter{Column: "plan", Operator: "=", Values: []interface{}{"pro"}},
+			condition: "plan = $1",
+			args:      []any{"pro"},
+			valid:     true,
+		},
+		{
+			name:      "not like, spaces and case normalized",
+			driver:    "mysql",
+			filter:    Filter{Column: "name", Operator: " NOT   like", Values: []interface{}{"test%"}},
+			condition: "name NOT LIKE ?",
+			args:      []any{"test%"},
+			valid:     true,
+		},
+		{
+			name:      "in",
+			driver:    "postgres",
+			filter:    Filter{Column: "region", Operator: "in", Values: []interface{}{"eu", "us", 3}},
+			condition: "region IN ($1, $2, $3)",
+			args:      []any{"eu", "us", 3},
+			valid:     true,
+		},
+		{
+			name:      "is null",
+			driver:    "mysql",
+			filter:    Filter{Column: "deleted_at", Operator: "is null"},
+			condition: "deleted_at IS NULL",
+			args:      []any{},
+			valid:     true,
+		},
+		{
+			name:   "invalid column",
+			driver: "mysql",
+			filter: Filter{Column: "plan; drop table tenants", Operator: "=", Values: []interface{}{"pro"}},
+		},
+		{
+			name:   "invalid operator",
+			driver: "mysql",
+			filter: Filter{Column: "plan", Operator: "= 1 or 1 =", Values: []interface{}{"pro"}},
+		},
+		{
+			name:   "missing value",
+			driver: "mysql",
+			filter: Filter{Column: "plan", Operator: "="},
+		},
+		{
+			name:   "too many values",
+			driver: "mysql",
+			filter: Filter{Column: "plan", Operator: "!=", Values: []interface{}{"pro", "free"}},
+		},
+		{
+			name:   "in without values",
+			driver: "mysql",
+			filter: Filter{Column: "plan", Operator: "not in"},
+		},
+		{
+			name:   "is null with a value",
+			driver: "mysql",
+			filter: Filter{Column: "plan", Operator: "is not null", Values: []interface{}{"pro"}},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			builder := queryBuilder{driver: test.driver, args: make([]any, 0)}
+			condition, err := builder.buildCondition(test.filter)
+			if test.valid != (err == nil) {
+				t.Fatalf("expected valid %v, got %v", test.valid, err)
+			}
+
+			if !test.valid {
+				return
+			}
+
+			if condition != test.condition {
+				t.Fatalf("expected condition %s, got %s", test.condition, condition)
+			}
+
+			if !reflect.DeepEqual(builder.args, test.args) {
+				t.Fatalf("expected args %v, got %v", test.args, builder.args)
+			}
+		})
+	}
+}
+
+func TestBuildSqlQuery(t *testing.T) {
+	tests := []struct {
+		name         string
+		driver       string
+		tableName    string
+		columns      []string
+		sqlCondition string
+		filters      []Filter
+		query        string
+		args         []any
+		valid        bool
+	}{
+		{
+			name:      "all columns",
+			driver:    "mysql",
+			tableName: "tenants",
+			query:     "SELECT * FROM tenants",
+			args:      []any{},
+			valid:     true,
+		},
+		{
+			name:      "selected columns of a schema table",
+			driver:    "postgres",
+			tableName: "app.tenants",
+			columns:   []string{"id", "plan"},
+			query:     "SELECT id, plan FROM app.tenants",
+			args:      []any{},
+			valid:     true,
+		},
+		{
+			name:         "legacy condition with filters",
+			driver:       "postgres",
+			tableName:    "tenants",
+			sqlCondition: "active = 1 or trial = 1",
+			filters: []Filter{
+				{Column: "plan", Operator: "in", Values: []interface{}{"pro", "enterprise"}},
+				{Column: "replicas", Operator: ">", Values: []interface{}{0}},
+			},
+			query: "SELECT * FROM tenants WHERE (active = 1 or trial = 1) AND plan IN ($1, $2) AND replicas > $3",
+			args:  []any{"pro", "enterprise", 0},
+			valid: true,
+		},
+		{
+			name:      "filters with mysql placeholders",
+			driver:    "mysql",
+			tableName: "tenants",
+			filters: []Filter{
+				{Column: "plan", Operator: "=", Values: []interface{}{"pro"}},
+				{Column: "deleted_at", Operator: "is null"},
+			},
+			query: "SELECT * FROM tenants WHERE plan = ? AND deleted_at IS NULL",
+			args:  []any{"pro"},
+			valid: true,
+		},
+		{
+			name:   "missing table",
+			driver: "mysql",
+		},
+		{
+			name:      "invalid table",
+			driver:    "mysql",
+			tableName: "tenants; drop table tenants",
+		},
+		{
+			name:      "invalid column",
+			driver:    "mysql",
+			tableName: "tenants",
+			columns:   []string{"id", "count(*)"},
+		},
+		{
+			name:         "invalid condition",
+			driver:       "mysql",
+			tableName:    "tenants",
+			sqlCondition: "1 = 1; drop table tenants",
+		},
+		{
+			name:      "invalid filter",
+			driver:    "mysql",
+			tableName: "tenants",
+			filters:   []Filter{{Column: "plan", Operator: "between", Values: []interface{}{1, 2}}},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			query, args, err := buildSqlQuery(test.driver, test.tableName, test.columns, test.sqlCondition, test.filters)
+			if test.valid != (err == nil) {
+				t.Fatalf("expected valid %v, got %v", test.valid, err)
+			}
+
+			if !test.valid {
+				return
+			}
+
+			if query != test.query {
+				t.Fatalf("expected query %s, got %s", test.query, query)
+			}
+
+			if !reflect.DeepEqual(args, test.args) {
+				t.Fatalf("expected args %v, got %v", test.args, args)
+			}
+		})
+	}
+}
@@ -0,0 +1,371 @@
+package tablewatch
+
+import (
+	"context"
+	"dvdlevanon/kubernetes-database-scaler/pkg/logs"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jackc/pgx/v5/pgproto3"
+)
+
+const STANDBY_STATUS_INTERVAL = 10 * time.Second
+
+// The slot already exists, it is reused so the changes made while we were down are not lost
+const duplicateObjectCode = "42710"
+
+// Replication consumes the changes of the watched table from a Postgres logical replication
+//
+//	slot (pgoutput) instead of querying the whole table every check interval. The full table
+//	is queried on start and every snapshot interval to reconcile missed changes. A change is
+//	acknowledged to the slot only after its snapshot was delivered, so a restart resumes from
+//	the last delivered change.
+type Replication struct {
+	*changeTracker
+	slotName      string
+	publication   string
+	relations     map[uint32]*relationMessage
+	inTransaction bool
+	flushedLsn    uint64
+}
+
+func (w *Tablewatch) NewReplication(tableName string, keyColumn string, slotName string,
+	publication string, snapshotInterval time.Duration) (*Replication, error) {
+
+	if w.dbConn.driver != "postgres" {
+		return nil, fmt.Errorf("logical replication is supported only by postgres, not %s", w.dbConn.driver)
+	}
+
+	tracker, err := newChangeTracker(w, tableName, keyColumn, snapshotInterval)
+	if err != nil {
+		return nil, err
+	}
+
+	if publication == "" {
+		publication = slotName
+	}
+
+	for _, identifier := range []string{slotName, publication} {
+		if err := isValidIdentifier(identifier); err != nil {
+			return nil, err
+		}
+	}
+
+	return &Replication{
+		changeTracker: tracker,
+		slotName:      slotName,
+		publication:   publication,
+	}, nil
+}
+
+// Watch streams the changes until ctx is done, the whole table is sent every checkInterval
+//
+//	seconds from memory, so the cleaner and the readiness check see the source as healthy.
+func (r *Replication) Watch(ctx context.Context, checkInterval int, output chan<- Snapshot) {
+	r.log(logs.OPERATION_REPLICATION).Infof("Replicating %s from slot %s of publication %s", r.name, r.slotName, r.publication)
+
+	r.lock.Lock()
+	r.checkInterval = time.Duration(checkInterval) * time.Second
+	r.lock.Unlock()
+
+	go r.dbConn.watchDbCredentials(ctx)
+
+	for {
+		if err := r.replicate(ctx, time.Duration(checkInterval)*time.Second, output); err != nil && ctx.Err() == nil {
+			r.log(logs.OPERATION_REPLICATION).Errorf("Replication of %s failed with %s", r.name, err)
+		}
+
+		select {
+		case <-ctx.Done():
+			r.log(logs.OPERATION_REPLICATION).Infof("Stopped replicating %s", r.name)
+			return
+		case <-time.After(time.Duration(checkInterval) * time.Second):
+		}
+	}
+}
+
+func (r *Replication) connect(ctx context.Context) (*pgconn.PgConn, error) {
+	connectionInfo, err := r.dbConn.buildPostgresConnectionInfo()
+	if err != nil {
+		return nil, err
+	}
+
+	config, err := pgconn.ParseConfig(connectionInfo)
+	if err != nil {
+		return nil, err
+	}
+
+	config.RuntimeParams["replication"] = "database"
+	return pgconn.ConnectConfig(ctx, config)
+}
+
+// ensurePublication creates the publication of the table when missing, it requires
+//
+//	the ownership of the table, otherwise it should be created beforehand.
+func (r *Replication) ensurePublication(ctx context.Context) error {
+	ctx, cancel := r.dbConn.withQueryTimeout(ctx)
+	defer cancel()
+
+	var exists bool
+	err := r.dbConn.getConn().QueryRowContext(ctx,
+		"SELECT EXISTS (SELECT 1 FROM pg_publication WHERE pubname = $1)", r.publication).Scan(&exists)
+	if err != nil {
+		return err
+	}
+
+	if exists {
+		return nil
+	}
+
+	r.log(logs.OPERATION_REPLICATION).Infof("Creating publication %s for table %s", r.publication, r.tableName)
+	return r.dbConn.exec(fmt.Sprintf("CREATE PUBLICATION %s FOR TABLE %s", r.publication, r.tableName))
+}
+
+func (r *Replication) ensureSlot(ctx context.Context, conn *pgconn.PgConn) error {
+	_, err := conn.Exec(ctx, fmt.Sprintf("CREATE_REPLICATION_SLOT %s LOGICAL pgoutput NOEXPORT_SNAPSHOT", r.slotName)).ReadAll()
+
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) && pgErr.Code == duplicateObjectCode {
+		return nil
+	}
+
+	if err == nil {
+		r.log(logs.OPERATION_REPLICATION).Infof("Created replication slot %s", r.slotName)
+	}
+
+	return err
+}
+
+// startReplication resumes from the position the slot confirmed last
+func (r *Replication) startReplication(ctx context.Context, conn *pgconn.PgConn) error {
+	conn.Frontend().SendQuery(&pgproto3.Query{String: fmt.Sprintf(
+		"START_REPLICATION SLOT %s LOGICAL 0/0 (proto_version '1', publication_names '%s')",
+		r.slotName, r.publication)})
+
+	if err := conn.Frontend().Flush(); err != nil {
+		return err
+	}
+
+	for {
+		msg, err := conn.ReceiveMessage(ctx)
+		if err != nil {
+			return err
+		}
+
+		switch msg := msg.(type) {
+		case *pgproto3.CopyBothResponse:
+			return nil
+		case *pgproto3.ErrorResponse:
+			return pgconn.ErrorResponseToPgError(msg)
+		case *pgproto3.NoticeResponse:
+		default:
+			return fmt.Errorf("unexpected message %T while starting replication", msg)
+		}
+	}
+}
+
+func (r *Replication) sendStandbyStatus(conn *pgconn.PgConn) error {
+	r.log(logs.OPERATION_REPLICATION).Debugf("Acknowledging %s of slot %s", formatLsn(r.flushedLsn), r.slotName)
+	conn.Frontend().Send(&pgproto3.CopyData{Data: buildStandbyStatusUpdate(r.flushedLsn)})
+	return conn.Frontend().Flush()
+}
+
+func (r *Replication) replicate(ctx context.Context, heartbeatInterval time.Duration, output chan<- Snapshot) error {
+	if err := r.ensurePublication(ctx); err != nil {
+		return err
+	}
+
+	conn, err := r.connect(ctx)
+	if err != nil {
+		return err
+	}
+
+	defer conn.Close(context.Background())
+
+	if err := r.ensureSlot(ctx, conn); err != nil {
+		return err
+	}
+
+	// The changes replayed from the slot are applied on top of this snapshot,
+	//	they are queried again so the rows end up as they are now.
+	//
+	if err := r.resync(ctx, output); err != nil {
+		return err
+	}
+
+	if err := r.startReplication(ctx, conn); err != nil {
+		return err
+	}
+
+	r.relations = make(map[uint32]*relationMessage)
+	r.changedKeys = make(map[string]bool)
+	r.needsResync = false
+	r.inTransaction = false
+
+	nextStatus := time.Now().Add(STANDBY_STATUS_INTERVAL)
+	nextHeartbeat := time.Now().Add(heartbeatInterval)
+	nextResync := time.Now().Add(r.snapshotInterval)
+
+	for {
+		if time.Now().After(nextStatus) {
+			if err := r.sendStandbyStatus(conn); err != nil {
+				return err
+			}
+
+			nextStatus = time.Now().Add(STANDBY_STATUS_INTERVAL)
+		}
+
+		if time.Now().After(nextResync) {
+			if err := r.resync(ctx, output); err != nil {
+				return err
+			}
+
+			nextResync = time.Now().Add(r.snapshotInterval)
+			nextHeartbeat = time.Now().Add(heartbeatInterval)
+		}
+
+		if time.Now().After(nextHeartbeat) {
+			if err := r.emit(ctx, output, r.getRows(), nil, false); err != nil {
+				return err
+			}
+
+			nextHeartbeat = time.Now().Add(heartbeatInterval)
+		}
+
+		deadline := nextStatus
+		for _, next := range []time.Time{nextHeartbeat, nextResync} {
+			if next.Before(deadline) {
+				deadline = next
+			}
+		}
+
+		receiveCtx, cancel := context.WithDeadline(ctx, deadline)
+		msg, err := conn.ReceiveMessage(receiveCtx)
+		cancel()
+
+		if err != nil {
+			if pgconn.Timeout(err) && ctx.Err() == nil {
+				continue
+			}
+
+			return err
+		}
+
+		switch msg := msg.(type) {
+		case *pgproto3.CopyData:
+			replyRequested, err := r.handleCopyData(ctx, output, msg.Data)
+			if err != nil {
+				return err
+			}
+
+			if replyRequested {
+				nextStatus = time.Now()
+			}
+		case *pgproto3.ErrorResponse:
+			return pgconn.ErrorResponseToPgError(msg)
+		default:
+			r.log(logs.OPERATION_REPLICATION).Debugf("Ignoring replication message %T", msg)
+		}
+	}
+}
+
+func (r *Replication) handleCopyData(ctx context.Context, output chan<- Snapshot, data []byte) (bool, error) {
+	reader := &messageReader{data: data[1:]}
+
+	switch data[0] {
+	case 'k':
+		walEnd := reader.uint64()
+		reader.uint64()
+		replyRequested := reader.byte() == 1
+		if reader.err != nil {
+			return false, fmt.Errorf("invalid keepalive message %s", reader.err)
+		}
+
+		// Everything up to walEnd was sent already, outside of a transaction it was handled too
+		//
+		if !r.inTransaction && walEnd > r.flushedLsn {
+			r.flushedLsn = walEnd
+		}
+
+		return replyRequested, nil
+	case 'w':
+		reader.uint64()
+		reader.uint64()
+		reader.uint64()
+		if reader.err != nil {
+			return false, fmt.Errorf("invalid xlog data message %s", reader.err)
+		}
+
+		message, err := decodePgoutput(reader.data)
+		if err != nil {
+			return false, err
+		}
+
+		return false, r.handleMessage(ctx, output, message)
+	default:
+		r.log(logs.OPERATION_REPLICATION).Debugf("Ignoring replication copy data %c", data[0])
+		return false, nil
+	}
+}
+
+func (r *Replication) handleMessage(ctx context.Context, output chan<- Snapshot, message interface{}) error {
+	switch message := message.(type) {
+	case *beginMessage:
+		r.inTransaction = true
+	case *relationMessage:
+		r.relations[message.id] = message
+	case *changeMessage:
+		r.handleChange(message)
+	case *commitMessage:
+		if err := r.handleCommit(ctx, output); err != nil {
+			return err
+		}
+
+		r.inTransaction = false
+		r.flushedLsn = message.endLsn
+	}
+
+	return nil
+}
+
+func (r *Replication) buildTupleRow(relation *relationMessage, tuple []tupleColumn) Row {
+	row := make(Row)
+	for i, column := range tuple {
+		if i < len(relation.columns) && column.kind == 't' {
+			row[relation.columns[i]] = column.value
+		}
+	}
+
+	return row
+}
+
+// handleChange collects the keys whose rows should be queried again when the transaction commits
+func (r *Replication) handleChange(change *changeMessage) {
+	for _, relationId := range change.relationIds {
+		relation, ok := r.relations[relationId]
+		if !ok {
+			r.log(logs.OPERATION_REPLICATION).Warningf("Change of unknown relation %d, resyncing %s", relationId, r.name)
+			r.needsResync = true
+			return
+		}
+
+		if !r.isWatchedTable(relation.namespace, relation.name) {
+			continue
+		}
+
+		if change.kind == 'T' {
+			r.needsResync = true
+			continue
+		}
+
+		for _, tuple := range [][]tupleColumn{change.oldTuple, change.newTuple} {
+			if tuple == nil {
+				continue
+			}
+
+			r.addChangedKeys(r.buildTupleRow(relation, tuple))
+		}
+	}
+}
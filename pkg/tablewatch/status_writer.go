@@ -0,0 +1,126 @@
+package tablewatch
+
+import (
+	"dvdlevanon/kubernetes-database-scaler/pkg/logs"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+)
+
+var identifierRegex = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*(\.[A-Za-z_][A-Za-z0-9_]*)?$`)
+
+func isValidIdentifier(identifier string) error {
+	if !identifierRegex.MatchString(identifier) {
+		return fmt.Errorf("invalid sql identifier %s", identifier)
+	}
+
+	return nil
+}
+
+// StatusWriter writes the state of the duplicated deployments back to the database.
+//
+//	When insert is false, the columns of the row identified by keyColumn are updated in place,
+//	otherwise a new row is inserted into tableName on every status change.
+type StatusWriter struct {
+	dbConn              *dbConn
+	tableName           string
+	keyColumn           string
+	statusColumn        string
+	readyReplicasColumn string
+	updatedAtColumn     string
+	insert              bool
+}
+
+func (w *Tablewatch) NewStatusWriter(tableName string, keyColumn string, statusColumn string,
+	readyReplicasColumn string, updatedAtColumn string, insert bool) (*StatusWriter, error) {
+
+	if tableName == "" {
+		return nil, fmt.Errorf("status table name is empty")
+	}
+
+	if keyColumn == "" {
+		return nil, fmt.Errorf("status key column is empty")
+	}
+
+	if statusColumn == "" && readyReplicasColumn == "" && updatedAtColumn == "" {
+		return nil, fmt.Errorf("no status column configured")
+	}
+
+	for _, identifier := range []string{tableName, keyColumn, statusColumn, readyReplicasColumn, updatedAtColumn} {
+		if identifier == "" {
+			continue
+		}
+
+		if err := isValidIdentifier(identifier); err != nil {
+			return nil, err
+		}
+	}
+
+	return &StatusWriter{
+		dbConn:              w.dbConn,
+		tableName:           tableName,
+		keyColumn:           keyColumn,
+		statusColumn:        statusColumn,
+		readyReplicasColumn: readyReplicasColumn,
+		updatedAtColumn:     updatedAtColumn,
+		insert:              insert,
+	}, nil
+}
+
+func (s *StatusWriter) buildColumns(status string, readyReplicas int32) ([]string, []any) {
+	columns := make([]string, 0)
+	values := make([]any, 0)
+
+	if s.statusColumn != "" {
+		columns = append(columns, s.statusColumn)
+		values = append(values, status)
+	}
+
+	if s.readyReplicasColumn != "" {
+		columns = append(columns, s.readyReplicasColumn)
+		values = append(values, readyReplicas)
+	}
+
+	if s.updatedAtColumn != "" {
+		columns = append(columns, s.updatedAtColumn)
+		values = append(values, time.Now().UTC())
+	}
+
+	return columns, values
+}
+
+func (s *StatusWriter) buildUpdateQuery(columns []string, values []any, deploymentId string) (string, []any) {
+	builder := queryBuilder{driver: s.dbConn.driver, args: make([]any, 0)}
+	assignments := make([]string, len(columns))
+	for i, column := range columns {
+		assignments[i] = fmt.Sprintf("%s = %s", column, builder.placeholder(values[i]))
+	}
+
+	return fmt.Sprintf("UPDATE %s SET %s WHERE %s = %s", s.tableName,
+		strings.Join(assignments, ", "), s.keyColumn, builder.placeholder(deploymentId)), builder.args
+}
+
+func (s *StatusWriter) buildInsertQuery(columns []string, values []any) (string, []any) {
+	builder := queryBuilder{driver: s.dbConn.driver, args: make([]any, 0)}
+	placeholders := make([]string, len(columns))
+	for i := range columns {
+		placeholders[i] = builder.placeholder(values[i])
+	}
+
+	return fmt.Sprintf("INSERT INTO %s (%s) VALUES (%s)", s.tableName,
+		strings.Join(columns, ", "), strings.Join(placeholders, ", ")), builder.args
+}
+
+func (s *StatusWriter) ReportStatus(deploymentId string, status string, readyReplicas int32) error {
+	columns, values := s.buildColumns(status, readyReplicas)
+
+	var query string
+	if s.insert {
+		query, values = s.buildInsertQuery(append([]string{s.keyColumn}, columns...), append([]any{deploymentId}, values...))
+	} else {
+		query, values = s.buildUpdateQuery(columns, values, deploymentId)
+	}
+	logger.WithTenant(deploymentId).WithOperation(logs.OPERATION_STATUS).Debugf("Writing status %s of %s to the database", status, deploymentId)
+	return s.dbConn.exec(query, values...)
+}
@@ -0,0 +1,71 @@
+package tablewatch
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestStatusWriterQueries(t *testing.T) {
+	tests := []struct {
+		name   string
+		driver string
+		insert bool
+		query  string
+		args   []any
+	}{
+		{
+			name:   "postgres update",
+			driver: "postgres",
+			query:  "UPDATE tenants SET status = $1, ready = $2 WHERE id = $3",
+			args:   []any{"ready", int32(2), "a"},
+		},
+		{
+			name:   "mysql update",
+			driver: "mysql",
+			query:  "UPDATE tenants SET status = ?, ready = ? WHERE id = ?",
+			args:   []any{"ready", int32(2), "a"},
+		},
+		{
+			name:   "postgres insert",
+			driver: "postgres",
+			insert: true,
+			query:  "INSERT INTO tenants (id, status, ready) VALUES ($1, $2, $3)",
+			args:   []any{"a", "ready", int32(2)},
+		},
+		{
+			name:   "mysql insert",
+			driver: "mysql",
+			insert: true,
+			query:  "INSERT INTO tenants (id, status, ready) VALUES (?, ?, ?)",
+			args:   []any{"a", "ready", int32(2)},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			w := &Tablewatch{dbConn: &dbConn{driver: test.driver}}
+			writer, err := w.NewStatusWriter("tenants", "id", "status", "ready", "", test.insert)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			columns, values := writer.buildColumns("ready", 2)
+
+			var query string
+			var args []any
+			if test.insert {
+				query, args = writer.buildInsertQuery(append([]string{"id"}, columns...), append([]any{"a"}, values...))
+			} else {
+				query, args = writer.buildUpdateQuery(columns, values, "a")
+			}
+
+			if query != test.query {
+				t.Fatalf("expected query %s, got %s", test.query, query)
+			}
+
+			if !reflect.DeepEqual(args, test.args) {
+				t.Fatalf("expected args %v, got %v", test.args, args)
+			}
+		})
+	}
+}
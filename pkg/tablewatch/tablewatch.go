@@ -1,89 +1,61 @@
 package tablewatch
 
 import (
+	"context"
 	"database/sql"
-	"errors"
+	"dvdlevanon/kubernetes-database-scaler/pkg/logs"
 	"fmt"
-	"strings"
+	"net/http"
+	"sync"
+	"sync/atomic"
 	"time"
-
-	"github.com/op/go-logging"
-	"github.com/xwb1989/sqlparser"
 )
 
 type Row map[string]string
 
-var logger = logging.MustGetLogger("tablewatch")
-
-type Tablewatch struct {
-	sqlQuery string
-	dbConn   *dbConn
+// Snapshot holds all the rows returned by a single successful query of a source.
+//
+//	A partial snapshot holds only the rows that changed since the previous one, Removed holds
+//	the rows known to be deleted, so they don't wait for the cleaner to notice.
+type Snapshot struct {
+	Source  string
+	Rows    []Row
+	Removed []Row
+	Partial bool
 }
 
-// This function help to prevent sql injection using the where clause.
-func isValidWhereClause(whereClause string) error {
-	if whereClause == "" {
-		return nil
-	}
-
-	stmt := fmt.Sprintf("select * from fake_table where %s", whereClause)
-	_, err := sqlparser.Parse(stmt)
-	if err != nil {
-		// Parsing fail if the where clause contains more than a single sql statement, like this sql injection
-		//
-		// 	"'1' = '1'; TRUNCATE table;"
-		//
-		logger.Warningf("Invalid where clause %s", stmt)
-		return err
-	}
-
-	disallowedPatterns := []string{
-		";",        // Prevents multiple statements
-		"--",       // Single line comment
-		"xp_",      // Common prefix for SQL Server system stored procedures
-		"/*", "*/", // Multi-line comment
-		"truncate", "insert", "delete", "update", // DML operations
-		"drop", "create", "alter", "grant", // DDL operations
-		"shutdown", "exec", // Dangerous SQL Server commands
-	}
+const DEFAULT_SOURCE_NAME = "default"
+const DEFAULT_QUERY_TIMEOUT = 30 * time.Second
 
-	normalizedClause := strings.ToLower(whereClause)
+var logger = logs.MustGetLogger("tablewatch")
 
-	for _, pattern := range disallowedPatterns {
-		if strings.Contains(normalizedClause, pattern) {
-			return errors.New("disallowed pattern found in WHERE clause: " + pattern)
-		}
-	}
+// Every query gets a new id, so the lines of a slow or failing query can be followed
+var lastQueryId atomic.Uint64
 
-	return nil
+func newQueryLog() *logs.Logger {
+	return logger.WithOperation(logs.OPERATION_QUERY).With(logs.FIELD_QUERY_ID, lastQueryId.Add(1))
 }
 
-func getSqlQuery(tableName string, sqlCondition string) (string, error) {
-	if tableName == "" {
-		return "", fmt.Errorf("table name is missing")
-	}
-
-	if err := isValidWhereClause(sqlCondition); err != nil {
-		return "", err
-	}
-
-	where := sqlCondition
-
-	if where != "" {
-		return fmt.Sprintf("SELECT * FROM %s WHERE %s", tableName, where), nil
-	} else {
-		return fmt.Sprintf("SELECT * FROM %s", tableName), nil
-	}
+type Tablewatch struct {
+	name          string
+	sourceColumn  string
+	sqlQuery      string
+	sqlArgs       []any
+	dbConn        *dbConn
+	checkInterval time.Duration
+	lock          sync.Mutex
+	lastSuccess   time.Time
 }
 
-func New(driver string, host string, port string, dbname string,
-	username string, password string, usernameFile string, passwordFile string,
-	tableName string, sqlCondition string, rawSql string) (*Tablewatch, error) {
+func New(driver string, url string, urlFile string, host string, port string, dbname string,
+	username string, password string, usernameFile string, passwordFile string, tls TLSConfig,
+	tableName string, columns []string, sqlCondition string, filters []Filter, rawSql string) (*Tablewatch, error) {
 
 	sqlQuery := rawSql
-	if tableName != "" && sqlCondition != "" {
+	sqlArgs := make([]any, 0)
+	if rawSql == "" {
 		var err error
-		sqlQuery, err = getSqlQuery(tableName, sqlCondition)
+		sqlQuery, sqlArgs, err = buildSqlQuery(driver, tableName, columns, sqlCondition, filters)
 		if err != nil {
 			return nil, err
 		}
@@ -91,6 +63,8 @@ func New(driver string, host string, port string, dbname string,
 
 	dbConn := &dbConn{
 		driver:       driver,
+		url:          url,
+		urlFile:      urlFile,
 		host:         host,
 		port:         port,
 		dbname:       dbname,
@@ -98,6 +72,8 @@ func New(driver string, host string, port string, dbname string,
 		password:     password,
 		usernameFile: usernameFile,
 		passwordFile: passwordFile,
+		tls:          tls,
+		queryTimeout: DEFAULT_QUERY_TIMEOUT,
 	}
 
 	err := dbConn.openAndVerify()
@@ -105,44 +81,138 @@ func New(driver string, host string, port string, dbname string,
 		return nil, err
 	}
 
-	go dbConn.watchDbCredentials()
-
 	watcher := &Tablewatch{
+		name:     DEFAULT_SOURCE_NAME,
 		dbConn:   dbConn,
 		sqlQuery: sqlQuery,
+		sqlArgs:  sqlArgs,
 	}
 
 	return watcher, nil
 }
 
-func (w *Tablewatch) Watch(checkInterval int, output chan<- Row) {
-	logger.Infof("SQL Query %s", w.sqlQuery)
+// SetSource names the watched source, when sourceColumn is set every row gets
+//
+//	an additional column holding the source name.
+func (w *Tablewatch) SetSource(name string, sourceColumn string) {
+	w.name = name
+	w.sourceColumn = sourceColumn
+}
+
+func (w *Tablewatch) Name() string {
+	return w.name
+}
+
+// SetQueryTimeout limits the duration of every query and status write, zero disables the limit.
+func (w *Tablewatch) SetQueryTimeout(queryTimeout time.Duration) {
+	w.dbConn.queryTimeout = queryTimeout
+}
+
+// Watch queries the table every checkInterval seconds until ctx is done.
+func (w *Tablewatch) Watch(ctx context.Context, checkInterval int, output chan<- Snapshot) {
+	w.log(logs.OPERATION_QUERY).Infof("SQL Query of %s %s %v", w.name, w.sqlQuery, w.sqlArgs)
+
+	w.lock.Lock()
+	w.checkInterval = time.Duration(checkInterval) * time.Second
+	w.lock.Unlock()
+
+	go w.dbConn.watchDbCredentials(ctx)
 
 	for {
-		if err := w.periodicCheck(output); err != nil {
-			logger.Errorf("Periodic check failed with %s", err)
+		if err := w.periodicCheck(ctx, output); err == nil {
+			w.lock.Lock()
+			w.lastSuccess = time.Now()
+			w.lock.Unlock()
+		}
+
+		select {
+		case <-ctx.Done():
+			w.log(logs.OPERATION_QUERY).Infof("Stopped watching %s", w.name)
+			return
+		case <-time.After(time.Duration(checkInterval) * time.Second):
 		}
+	}
+}
+
+func (w *Tablewatch) Close() error {
+	return w.dbConn.close()
+}
+
+// ReadyCheck fails when the table wasn't queried successfully during the last
+//
+//	few check intervals or when the database doesn't respond, it matches healthz.Checker.
+func (w *Tablewatch) ReadyCheck(req *http.Request) error {
+	w.lock.Lock()
+	lastSuccess := w.lastSuccess
+	threshold := w.checkInterval * 3
+	w.lock.Unlock()
+
+	if lastSuccess.IsZero() {
+		return fmt.Errorf("table was not queried successfully yet")
+	}
 
-		time.Sleep(time.Duration(checkInterval) * time.Second)
+	if time.Since(lastSuccess) > threshold {
+		return fmt.Errorf("last successful table query was at %s", lastSuccess.Format(time.RFC3339))
 	}
+
+	return w.dbConn.verifyDbConnection(req.Context())
+}
+
+// log is the logger of lines about this source
+func (w *Tablewatch) log(operation string) *logs.Logger {
+	return logger.With(logs.FIELD_SOURCE, w.name).WithOperation(operation)
 }
 
-func (w *Tablewatch) periodicCheck(output chan<- Row) error {
-	logger.Debugf("Periodic check DB table")
+func (w *Tablewatch) queryLog() *logs.Logger {
+	return newQueryLog().With(logs.FIELD_SOURCE, w.name)
+}
+
+func (w *Tablewatch) periodicCheck(ctx context.Context, output chan<- Snapshot) error {
+	log := w.queryLog()
+	log.Debugf("Periodic check DB table of %s", w.name)
 
-	rows, err := w.dbConn.conn.Query(w.sqlQuery)
+	start := time.Now()
+	result, err := w.query(ctx, log)
 	if err != nil {
+		if ctx.Err() == nil {
+			log.WithDuration(time.Since(start)).Errorf("Periodic check of %s failed with %s", w.name, err)
+		}
+
 		return err
 	}
 
+	select {
+	case output <- Snapshot{Source: w.name, Rows: result}:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (w *Tablewatch) query(ctx context.Context, log *logs.Logger) ([]Row, error) {
+	ctx, cancel := w.dbConn.withQueryTimeout(ctx)
+	defer cancel()
+
+	start := time.Now()
+	rows, err := w.dbConn.getConn().QueryContext(ctx, w.sqlQuery, w.sqlArgs...)
+	if err != nil {
+		return nil, err
+	}
+
 	defer rows.Close()
-	return w.handleRows(rows, output)
+	result, err := w.handleRows(rows)
+	if err != nil {
+		return nil, err
+	}
+
+	log.WithDuration(time.Since(start)).Debugf("Queried %d rows of %s", len(result), w.name)
+	return result, nil
 }
 
-func (w *Tablewatch) handleRows(rows *sql.Rows, output chan<- Row) error {
+func (w *Tablewatch) handleRows(rows *sql.Rows) ([]Row, error) {
 	columns, err := rows.Columns()
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	values := make([][]byte, len(columns))
@@ -151,17 +221,28 @@ func (w *Tablewatch) handleRows(rows *sql.Rows, output chan<- Row) error {
 		valuesPtr[i] = &values[i]
 	}
 
+	result := make([]Row, 0)
 	for rows.Next() {
 		if err := rows.Scan(valuesPtr...); err != nil {
-			logger.Errorf("Error reading row %s", err)
+			w.log(logs.OPERATION_QUERY).Errorf("Error reading row %s", err)
 			continue
 		}
 
 		row := w.getRow(columns, valuesPtr)
-		output <- row
+		if w.sourceColumn != "" {
+			row[w.sourceColumn] = w.name
+		}
+
+		result = append(result, row)
+	}
+
+	// A snapshot cut in the middle would make the cleaner remove the missing rows
+	//
+	if err := rows.Err(); err != nil {
+		return nil, err
 	}
 
-	return nil
+	return result, nil
 }
 
 func (w *Tablewatch) getRow(columns []string, values []any) Row {